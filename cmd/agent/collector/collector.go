@@ -2,9 +2,12 @@
 package collector
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"runtime"
+	"strconv"
 
 	"github.com/and161185/metrics-alerting/internal/utils"
 	"github.com/and161185/metrics-alerting/model"
@@ -12,15 +15,21 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
-var pollCount int64
+// RuntimeCollector reads runtime memory statistics. It is safe for concurrent use.
+type RuntimeCollector struct{}
 
-// CollectRuntimeMetrics reads runtime memory statistics and returns them as a slice of metrics.
-func CollectRuntimeMetrics() []model.Metric {
+// NewRuntimeCollector creates a new RuntimeCollector.
+func NewRuntimeCollector() *RuntimeCollector {
+	return &RuntimeCollector{}
+}
+
+// Collect reads runtime memory statistics and returns them as a slice of metrics.
+// PollCount is a true delta: every call reports a single poll, and the caller
+// accumulates deltas until they are reported.
+func (c *RuntimeCollector) Collect(_ context.Context) ([]model.Metric, error) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	pollCount++
-
 	res := []model.Metric{
 		{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(float64(m.Alloc))},
 		{ID: "BuckHashSys", Type: model.Gauge, Value: utils.F64Ptr(float64(m.BuckHashSys))},
@@ -50,23 +59,22 @@ func CollectRuntimeMetrics() []model.Metric {
 		{ID: "Sys", Type: model.Gauge, Value: utils.F64Ptr(float64(m.Sys))},
 		{ID: "TotalAlloc", Type: model.Gauge, Value: utils.F64Ptr(float64(m.TotalAlloc))},
 
-		{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(pollCount)},
+		{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(1)},
 		{ID: "RandomValue", Type: model.Gauge, Value: utils.F64Ptr(rand.Float64())},
 	}
 
-	return res
-}
-
-// ResetPollCount resets the internal poll counter used in runtime metrics.
-func ResetPollCount() {
-	pollCount = 0
+	return res, nil
 }
 
 // CollectGopsutilMetrics gathers system memory and CPU metrics using gopsutil.
-func CollectGopsutilMetrics() []model.Metric {
-	var res []model.Metric
+// CPU utilization is reported per core with a 1-based core label.
+func CollectGopsutilMetrics(ctx context.Context) ([]model.Metric, error) {
+	var (
+		res  []model.Metric
+		errs []error
+	)
 
-	vmem, err := mem.VirtualMemory()
+	vmem, err := mem.VirtualMemoryWithContext(ctx)
 	if err == nil {
 		res = append(res, model.Metric{
 			ID:    "TotalMemory",
@@ -78,18 +86,23 @@ func CollectGopsutilMetrics() []model.Metric {
 			Type:  model.Gauge,
 			Value: utils.F64Ptr(float64(vmem.Free)),
 		})
+	} else {
+		errs = append(errs, fmt.Errorf("memory: %w", err))
 	}
 
-	cpuPercents, err := cpu.Percent(0, true)
+	cpuPercents, err := cpu.PercentWithContext(ctx, 0, true)
 	if err == nil {
 		for i, p := range cpuPercents {
 			res = append(res, model.Metric{
-				ID:    fmt.Sprintf("CPUutilization%d", i+1),
-				Type:  model.Gauge,
-				Value: utils.F64Ptr(p),
+				ID:     "CPUutilization",
+				Type:   model.Gauge,
+				Value:  utils.F64Ptr(p),
+				Labels: map[string]string{"core": strconv.Itoa(i + 1)},
 			})
 		}
+	} else {
+		errs = append(errs, fmt.Errorf("cpu: %w", err))
 	}
 
-	return res
+	return res, errors.Join(errs...)
 }
@@ -1,11 +1,14 @@
 package collector
 
 import (
+	"context"
 	"testing"
 )
 
 func BenchmarkCollectRuntimeMetrics(b *testing.B) {
+	c := NewRuntimeCollector()
+	ctx := context.Background()
 	for i := 0; i < b.N; i++ {
-		_ = CollectRuntimeMetrics()
+		_, _ = c.Collect(ctx)
 	}
 }
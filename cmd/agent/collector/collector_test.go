@@ -1,6 +1,9 @@
 package collector
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/and161185/metrics-alerting/model"
@@ -16,7 +19,9 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 		"RandomValue": false,
 	}
 
-	metrics := CollectRuntimeMetrics()
+	c := &countingCollector{Collector: NewRuntimeCollector()}
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
 
 	for _, m := range metrics {
 		require.Condition(t, func() bool {
@@ -32,11 +37,11 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 		require.True(t, found, "required metric %s not found", id)
 	}
 
-	poll1 := getMetricValue(metrics, "PollCount")
-	metrics2 := CollectRuntimeMetrics()
-	poll2 := getMetricValue(metrics2, "PollCount")
-
-	require.Equal(t, poll1+1, poll2, "PollCount should increment by 1")
+	require.Equal(t, float64(1), getMetricValue(metrics, "PollCount"), "PollCount is a delta of one poll")
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, float64(1), getMetricValue(metrics, "PollCount"), "PollCount must not accumulate")
+	require.EqualValues(t, 2, c.calls.Load())
 }
 
 func getMetricValue(metrics []model.Metric, id string) float64 {
@@ -54,26 +59,52 @@ func getMetricValue(metrics []model.Metric, id string) float64 {
 	return -1
 }
 
-func TestResetPollCount(t *testing.T) {
-	ResetPollCount()
-	metrics := CollectRuntimeMetrics()
+// countingCollector counts the Collect calls made to the wrapped collector.
+type countingCollector struct {
+	Collector
+	calls atomic.Int64
+}
+
+func (c *countingCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	c.calls.Add(1)
+	return c.Collector.Collect(ctx)
+}
+
+func TestRuntimeCollector_Concurrent(t *testing.T) {
+	c := &countingCollector{Collector: NewRuntimeCollector()}
+	var polls atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				metrics, err := c.Collect(context.Background())
+				if err == nil {
+					polls.Add(int64(getMetricValue(metrics, "PollCount")))
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
-	poll := getMetricValue(metrics, "PollCount")
-	require.Equal(t, float64(1), poll, "после ResetPollCount первый вызов должен дать PollCount=1")
+	require.EqualValues(t, 80, c.calls.Load())
+	require.EqualValues(t, 80, polls.Load(), "every call reports a single poll")
 }
 
 func TestCollectGopsutilMetrics_Smoke(t *testing.T) {
 	t.Parallel()
 
-	metrics := CollectGopsutilMetrics()
+	metrics, _ := CollectGopsutilMetrics(context.Background()) // some stats may be unavailable in containers
 
 	seen := map[string]struct{}{}
 	for _, m := range metrics {
 
-		if _, ok := seen[m.ID]; ok {
-			t.Fatalf("duplicate metric id: %s", m.ID)
+		if _, ok := seen[m.Key()]; ok {
+			t.Fatalf("duplicate metric series: %s", m.Key())
 		}
-		seen[m.ID] = struct{}{}
+		seen[m.Key()] = struct{}{}
 
 		require.True(t, m.Type == model.Gauge || m.Type == model.Counter)
 		if m.Type == model.Gauge {
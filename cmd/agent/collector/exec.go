@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	// maxExecOutput limits the stdout read from a command; the rest is discarded.
+	maxExecOutput = 1 << 20
+	// maxExecStderr limits the stderr quoted in errors.
+	maxExecStderr = 512
+	// execWaitDelay bounds the wait for output pipes after the command is killed,
+	// so children that inherited them can't block the collector.
+	execWaitDelay = time.Second
+)
+
+// ExecLimiter caps the number of commands run concurrently by exec collectors sharing it.
+type ExecLimiter struct {
+	slots chan struct{}
+}
+
+// NewExecLimiter creates a limiter allowing n concurrent commands; n <= 0 means no limit.
+func NewExecLimiter(n int) *ExecLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &ExecLimiter{slots: make(chan struct{}, n)}
+}
+
+func (l *ExecLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for exec slot: %w", ctx.Err())
+	}
+}
+
+func (l *ExecLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// ExecCollector runs a command and parses its stdout into metrics.
+// The output is either lines of "name type value", where blank lines and lines
+// starting with # are skipped, or JSON: a single model.Metric or an array of them.
+// The command is killed when the context is done.
+type ExecCollector struct {
+	command []string
+	limiter *ExecLimiter
+}
+
+// NewExecCollector creates a collector running command[0] with arguments command[1:].
+// limiter may be nil.
+func NewExecCollector(command []string, limiter *ExecLimiter) *ExecCollector {
+	return &ExecCollector{command: command, limiter: limiter}
+}
+
+// Collect runs the command and returns the parsed metrics. Metrics parsed before
+// a malformed line are returned together with the error.
+func (c *ExecCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	if len(c.command) == 0 {
+		return nil, errors.New("exec: empty command")
+	}
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+
+	var stdout, stderr limitedBuffer
+	stdout.limit = maxExecOutput
+	stderr.limit = maxExecStderr
+
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = execWaitDelay
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("exec %s: %w: %s", c.command[0], err, msg)
+		}
+		return nil, fmt.Errorf("exec %s: %w", c.command[0], err)
+	}
+
+	out := stdout.Bytes()
+	if stdout.truncated {
+		// the last line may be cut mid-value, so only complete lines are parsed
+		out = out[:bytes.LastIndexByte(out, '\n')+1]
+	}
+	metrics, err := ParseExecOutput(out)
+	if err != nil {
+		return metrics, fmt.Errorf("exec %s: %w", c.command[0], err)
+	}
+	if stdout.truncated {
+		return metrics, fmt.Errorf("exec %s: output exceeds %d bytes", c.command[0], maxExecOutput)
+	}
+	return metrics, nil
+}
+
+// ParseExecOutput parses command output in the line or JSON format.
+func ParseExecOutput(out []byte) ([]model.Metric, error) {
+	trimmed := bytes.TrimSpace(out)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	switch trimmed[0] {
+	case '[':
+		var metrics []model.Metric
+		if err := json.Unmarshal(trimmed, &metrics); err != nil {
+			return nil, fmt.Errorf("decode json: %w", err)
+		}
+		return validMetrics(metrics)
+	case '{':
+		var m model.Metric
+		if err := json.Unmarshal(trimmed, &m); err != nil {
+			return nil, fmt.Errorf("decode json: %w", err)
+		}
+		return validMetrics([]model.Metric{m})
+	}
+	return parseExecLines(trimmed)
+}
+
+func parseExecLines(out []byte) ([]model.Metric, error) {
+	var res []model.Metric
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return res, fmt.Errorf("line %d: want \"name type value\", got %q", n, line)
+		}
+		m := model.Metric{ID: fields[0], Type: model.MetricType(fields[1])}
+		switch m.Type {
+		case model.Gauge:
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return res, fmt.Errorf("line %d: invalid gauge value %q", n, fields[2])
+			}
+			m.Value = &v
+		case model.Counter:
+			d, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return res, fmt.Errorf("line %d: invalid counter value %q", n, fields[2])
+			}
+			m.Delta = &d
+		default:
+			return res, fmt.Errorf("line %d: invalid metric type %q", n, fields[1])
+		}
+		res = append(res, m)
+	}
+	return res, sc.Err()
+}
+
+// validMetrics returns metrics up to the first one without an ID or a value matching its type.
+func validMetrics(metrics []model.Metric) ([]model.Metric, error) {
+	for i, m := range metrics {
+		valid := m.ID != "" &&
+			(m.Type == model.Gauge && m.Value != nil || m.Type == model.Counter && m.Delta != nil)
+		if !valid {
+			return metrics[:i], fmt.Errorf("metric %d: invalid metric %q of type %q", i, m.ID, m.Type)
+		}
+	}
+	return metrics, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// ReadFrom hides bytes.Buffer.ReadFrom, through which io.Copy would bypass the limit.
+func (b *limitedBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{b}, r)
+}
@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExecOutput_Lines(t *testing.T) {
+	metrics, err := ParseExecOutput([]byte("# queue stats\nQueueDepth gauge 12.5\n\nJobsDone counter 3\n"))
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	require.Equal(t, "QueueDepth", metrics[0].ID)
+	require.Equal(t, 12.5, *metrics[0].Value)
+	require.Equal(t, model.Counter, metrics[1].Type)
+	require.EqualValues(t, 3, *metrics[1].Delta)
+}
+
+func TestParseExecOutput_JSON(t *testing.T) {
+	metrics, err := ParseExecOutput([]byte(`[{"id":"A","type":"gauge","value":1,"labels":{"queue":"q1"}},{"id":"B","type":"counter","delta":2}]`))
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	require.Equal(t, "q1", metrics[0].Labels["queue"])
+
+	metrics, err = ParseExecOutput([]byte(`{"id":"A","type":"gauge","value":1}`))
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+}
+
+func TestParseExecOutput_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"fields":        "A gauge",
+		"type":          "A histogram 1",
+		"gauge value":   "A gauge x",
+		"counter value": "A counter 1.5",
+		"json":          `[{"id":"A"`,
+		"json value":    `[{"id":"A","type":"counter","value":1}]`,
+	}
+	for name, out := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseExecOutput([]byte(out))
+			require.Error(t, err)
+		})
+	}
+
+	metrics, err := ParseExecOutput([]byte("A gauge 1\nbroken\nB gauge 2"))
+	require.Error(t, err)
+	require.Len(t, metrics, 1, "metrics before the malformed line are kept")
+}
+
+func TestExecCollector_Collect(t *testing.T) {
+	c := NewExecCollector([]string{"sh", "-c", "echo 'Answer gauge 42'"}, nil)
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	require.Equal(t, 42.0, *metrics[0].Value)
+}
+
+func TestExecCollector_TruncatedOutput(t *testing.T) {
+	// 20-byte lines, so that the output limit cuts the last line to "Backlog gauge 12"
+	line := "Backlog gauge 12345"
+	c := NewExecCollector([]string{"sh", "-c", fmt.Sprintf("yes '%s' | head -c %d", line, maxExecOutput+100)}, nil)
+	metrics, err := c.Collect(context.Background())
+	require.ErrorContains(t, err, "output exceeds")
+	require.Len(t, metrics, maxExecOutput/(len(line)+1))
+	for _, m := range metrics {
+		require.Equal(t, 12345.0, *m.Value, "the cut last line is dropped")
+	}
+}
+
+func TestExecCollector_Failure(t *testing.T) {
+	c := NewExecCollector([]string{"sh", "-c", "echo oops >&2; exit 3"}, nil)
+	_, err := c.Collect(context.Background())
+	require.ErrorContains(t, err, "oops")
+
+	_, err = NewExecCollector(nil, nil).Collect(context.Background())
+	require.Error(t, err)
+}
+
+func TestExecCollector_Timeout(t *testing.T) {
+	c := NewExecCollector([]string{"sh", "-c", "sleep 10"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.Collect(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestExecLimiter(t *testing.T) {
+	limiter := NewExecLimiter(2)
+	var running, peak atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, limiter.acquire(context.Background()))
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			limiter.release()
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, peak.Load(), int32(2))
+
+	// a full limiter gives up when the context is done
+	require.NoError(t, limiter.acquire(context.Background()))
+	require.NoError(t, limiter.acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, limiter.acquire(ctx))
+
+	require.Nil(t, NewExecLimiter(0))
+}
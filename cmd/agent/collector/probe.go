@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// Probe kinds.
+const (
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+)
+
+// Probe metrics, labeled with ProbeTargetLabel.
+const (
+	ProbeSuccessMetric    = "ProbeSuccess"         // 1 if the probe succeeded, 0 otherwise.
+	ProbeDurationMetric   = "ProbeDuration"        // Probe duration in seconds.
+	ProbeHTTPStatusMetric = "ProbeHTTPStatus"      // HTTP status code, 0 if no response was received.
+	ProbeCertDaysMetric   = "ProbeTLSCertDaysLeft" // Days until the server certificate expires.
+
+	ProbeTargetLabel = "target"
+
+	// maxProbeBodyDiscard limits the response body read before the connection is closed.
+	maxProbeBodyDiscard = 1 << 20
+)
+
+// ProbeCollector checks the availability of an HTTP URL or a TCP endpoint.
+// A failed probe is reported through ProbeSuccess, not as a collector error.
+type ProbeCollector struct {
+	kind   string
+	target string
+	client *http.Client
+}
+
+// NewProbeCollector creates a probe of the given kind, ProbeHTTP or ProbeTCP.
+// For HTTP probes, a 2xx response after redirects is a success; client may be nil.
+// For TCP probes, target is host:port and an established connection is a success.
+func NewProbeCollector(kind, target string, client *http.Client) (*ProbeCollector, error) {
+	switch kind {
+	case ProbeHTTP, ProbeTCP:
+	default:
+		return nil, fmt.Errorf("unknown probe kind %q", kind)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("%s probe: empty target", kind)
+	}
+	return &ProbeCollector{kind: kind, target: target, client: probeClient(client)}, nil
+}
+
+// probeClient returns a copy of client whose transport opens a new connection for
+// every probe, so ProbeDurationMetric includes connect and TLS handshake time.
+func probeClient(client *http.Client) *http.Client {
+	var c http.Client
+	if client != nil {
+		c = *client
+	}
+	tr, ok := c.Transport.(*http.Transport)
+	if c.Transport == nil {
+		tr, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if ok {
+		tr = tr.Clone()
+		tr.DisableKeepAlives = true
+		c.Transport = tr
+	}
+	return &c
+}
+
+// Collect runs the probe within the context deadline.
+func (c *ProbeCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	labels := map[string]string{ProbeTargetLabel: c.target}
+	gauge := func(id string, v float64) model.Metric {
+		return model.Metric{ID: id, Type: model.Gauge, Value: utils.F64Ptr(v), Labels: labels}
+	}
+
+	start := time.Now()
+	var res []model.Metric
+	success := false
+	if c.kind == ProbeHTTP {
+		status, certExpiry, err := c.probeHTTP(ctx)
+		success = err == nil && status >= 200 && status < 300
+		res = append(res, gauge(ProbeHTTPStatusMetric, float64(status)))
+		if !certExpiry.IsZero() {
+			res = append(res, gauge(ProbeCertDaysMetric, time.Until(certExpiry).Hours()/24))
+		}
+	} else {
+		success = c.probeTCP(ctx) == nil
+	}
+
+	var ok float64
+	if success {
+		ok = 1
+	}
+	return append(res,
+		gauge(ProbeSuccessMetric, ok),
+		gauge(ProbeDurationMetric, time.Since(start).Seconds()),
+	), nil
+}
+
+// probeHTTP returns the response status and the expiry of the leaf server certificate, if any.
+func (c *ProbeCollector) probeHTTP(ctx context.Context) (int, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.target, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxProbeBodyDiscard))
+
+	var expiry time.Time
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiry = resp.TLS.PeerCertificates[0].NotAfter
+	}
+	return resp.StatusCode, expiry, nil
+}
+
+func (c *ProbeCollector) probeTCP(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
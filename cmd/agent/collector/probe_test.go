@@ -0,0 +1,121 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func probeValues(t *testing.T, metrics []model.Metric, target string) map[string]float64 {
+	t.Helper()
+	res := map[string]float64{}
+	for _, m := range metrics {
+		require.Equal(t, model.Gauge, m.Type)
+		require.Equal(t, target, m.Labels[ProbeTargetLabel])
+		res[m.ID] = *m.Value
+	}
+	return res
+}
+
+func TestProbeCollector_HTTP(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	c, err := NewProbeCollector(ProbeHTTP, ts.URL, nil)
+	require.NoError(t, err)
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	v := probeValues(t, metrics, ts.URL)
+	require.Equal(t, 1.0, v[ProbeSuccessMetric])
+	require.Equal(t, 200.0, v[ProbeHTTPStatusMetric])
+	require.Contains(t, v, ProbeDurationMetric)
+	require.NotContains(t, v, ProbeCertDaysMetric)
+
+	status = http.StatusInternalServerError
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err, "a failed probe is not a collector error")
+	v = probeValues(t, metrics, ts.URL)
+	require.Equal(t, 0.0, v[ProbeSuccessMetric])
+	require.Equal(t, 500.0, v[ProbeHTTPStatusMetric])
+}
+
+func TestProbeCollector_HTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	c, err := NewProbeCollector(ProbeHTTP, ts.URL, ts.Client())
+	require.NoError(t, err)
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	v := probeValues(t, metrics, ts.URL)
+	require.Equal(t, 1.0, v[ProbeSuccessMetric])
+	require.Greater(t, v[ProbeCertDaysMetric], 0.0)
+
+	// the default client doesn't trust the test certificate
+	c, err = NewProbeCollector(ProbeHTTP, ts.URL, nil)
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	v = probeValues(t, metrics, ts.URL)
+	require.Equal(t, 0.0, v[ProbeSuccessMetric])
+	require.Equal(t, 0.0, v[ProbeHTTPStatusMetric])
+}
+
+func TestProbeCollector_NewConnectionPerProbe(t *testing.T) {
+	var conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := NewProbeCollector(ProbeHTTP, ts.URL, ts.Client())
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		metrics, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		require.Contains(t, probeValues(t, metrics, ts.URL), ProbeCertDaysMetric)
+	}
+	require.Equal(t, int32(2), conns.Load(), "each probe includes connect and TLS handshake time")
+}
+
+func TestProbeCollector_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+
+	c, err := NewProbeCollector(ProbeTCP, addr, nil)
+	require.NoError(t, err)
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1.0, probeValues(t, metrics, addr)[ProbeSuccessMetric])
+
+	require.NoError(t, ln.Close())
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	v := probeValues(t, metrics, addr)
+	require.Equal(t, 0.0, v[ProbeSuccessMetric])
+	require.NotContains(t, v, ProbeHTTPStatusMetric)
+}
+
+func TestNewProbeCollector_Invalid(t *testing.T) {
+	_, err := NewProbeCollector("icmp", "host", nil)
+	require.Error(t, err)
+	_, err = NewProbeCollector(ProbeTCP, "", nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,402 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	// maxScrapeBody limits the size of a scraped response.
+	maxScrapeBody = 10 << 20
+	// NameLabel refers to the metric name in relabel rules.
+	NameLabel = "__name__"
+	// JobLabel is set on scraped metrics to the collector name.
+	JobLabel = "job"
+
+	scrapeAccept = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+)
+
+// Relabel actions.
+const (
+	RelabelReplace   = "replace"   // Set TargetLabel to Replacement if SourceLabel matches.
+	RelabelKeep      = "keep"      // Drop metrics whose SourceLabel doesn't match.
+	RelabelDrop      = "drop"      // Drop metrics whose SourceLabel matches.
+	RelabelLabelDrop = "labeldrop" // Remove labels whose names match.
+)
+
+// Relabel is a rule rewriting or filtering scraped metrics, applied in order.
+type Relabel struct {
+	Action      string
+	SourceLabel string // Label matched by Regex; NameLabel is the metric name.
+	Regex       *regexp.Regexp
+	TargetLabel string // Label set by replace; NameLabel renames the metric.
+	Replacement string // Value set by replace; may reference Regex groups as $1.
+}
+
+// NewRelabel validates and compiles a relabel rule. The regex is anchored;
+// an empty action means replace and an empty regex matches everything.
+func NewRelabel(action, sourceLabel, regex, targetLabel, replacement string) (Relabel, error) {
+	if action == "" {
+		action = RelabelReplace
+	}
+	if regex == "" {
+		regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return Relabel{}, fmt.Errorf("relabel regex: %w", err)
+	}
+
+	r := Relabel{Action: action, SourceLabel: sourceLabel, Regex: re, TargetLabel: targetLabel, Replacement: replacement}
+	switch action {
+	case RelabelReplace:
+		if sourceLabel == "" || targetLabel == "" {
+			return Relabel{}, errors.New("relabel replace: source and target labels are required")
+		}
+	case RelabelKeep, RelabelDrop:
+		if sourceLabel == "" {
+			return Relabel{}, fmt.Errorf("relabel %s: source label is required", action)
+		}
+	case RelabelLabelDrop:
+	default:
+		return Relabel{}, fmt.Errorf("unknown relabel action %q", action)
+	}
+	return r, nil
+}
+
+// apply rewrites the metric in place and reports whether it is kept.
+func (r Relabel) apply(m *model.Metric) bool {
+	value := func(label string) string {
+		if label == NameLabel {
+			return m.ID
+		}
+		return m.Labels[label]
+	}
+
+	switch r.Action {
+	case RelabelKeep:
+		return r.Regex.MatchString(value(r.SourceLabel))
+	case RelabelDrop:
+		return !r.Regex.MatchString(value(r.SourceLabel))
+	case RelabelLabelDrop:
+		for name := range m.Labels {
+			if r.Regex.MatchString(name) {
+				delete(m.Labels, name)
+			}
+		}
+	case RelabelReplace:
+		src := value(r.SourceLabel)
+		match := r.Regex.FindStringSubmatchIndex(src)
+		if match == nil {
+			return true
+		}
+		v := string(r.Regex.ExpandString(nil, r.Replacement, src, match))
+		switch {
+		case r.TargetLabel == NameLabel:
+			if v == "" {
+				return false
+			}
+			m.ID = v
+		case v == "":
+			delete(m.Labels, r.TargetLabel)
+		default:
+			m.Labels[r.TargetLabel] = v
+		}
+	}
+	return true
+}
+
+// ScrapeCollector scrapes a target exposing metrics in the Prometheus text format.
+// Gauges and untyped samples become gauges. Counters become counter deltas since
+// the previous scrape, so the first scrape only records the baseline. Histograms
+// and summaries are flattened: _bucket, _sum and _count samples as counters and
+// summary quantiles as gauges. Every metric gets the job label, then relabel rules
+// are applied. It is safe for concurrent use.
+type ScrapeCollector struct {
+	url     string
+	job     string
+	allow   []*regexp.Regexp
+	relabel []Relabel
+	client  *http.Client
+
+	mu   sync.Mutex
+	base map[string]float64 // cumulative value already reported, by series key
+}
+
+// NewScrapeCollector creates a collector scraping url. Only metrics whose names match
+// one of the allow patterns are kept; no patterns keep everything.
+func NewScrapeCollector(url, job string, allow []string, relabel []Relabel) (*ScrapeCollector, error) {
+	c := &ScrapeCollector{
+		url:     url,
+		job:     job,
+		relabel: relabel,
+		client:  &http.Client{},
+		base:    make(map[string]float64),
+	}
+	for _, p := range allow {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("allow pattern %q: %w", p, err)
+		}
+		c.allow = append(c.allow, re)
+	}
+	return c, nil
+}
+
+// Collect scrapes the target and returns the mapped metrics.
+func (c *ScrapeCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scrape %s: %w", c.url, err)
+	}
+	req.Header.Set("Accept", scrapeAccept)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("scrape %s: %w", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scrape %s: unexpected status %d", c.url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScrapeBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("scrape %s: %w", c.url, err)
+	}
+	if len(body) > maxScrapeBody {
+		return nil, fmt.Errorf("scrape %s: response exceeds %d bytes", c.url, maxScrapeBody)
+	}
+
+	samples, err := ParsePrometheusText(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("scrape %s: %w", c.url, err)
+	}
+	return c.toMetrics(samples), nil
+}
+
+func (c *ScrapeCollector) allowed(name string) bool {
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, re := range c.allow {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ScrapeCollector) toMetrics(samples []PromSample) []model.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res []model.Metric
+	for _, s := range samples {
+		if !c.allowed(s.Name) {
+			continue
+		}
+
+		labels := make(map[string]string, len(s.Labels)+1)
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		if c.job != "" {
+			labels[JobLabel] = c.job
+		}
+		m := model.Metric{ID: s.Name, Labels: labels}
+		kept := true
+		for _, r := range c.relabel {
+			if kept = r.apply(&m); !kept {
+				break
+			}
+		}
+		if !kept {
+			continue
+		}
+		if len(m.Labels) == 0 {
+			m.Labels = nil
+		}
+
+		if !s.Cumulative {
+			v := s.Value
+			m.Type = model.Gauge
+			m.Value = &v
+			res = append(res, m)
+			continue
+		}
+
+		key := model.SeriesKey(m.ID, m.Labels)
+		base, ok := c.base[key]
+		if !ok {
+			c.base[key] = s.Value
+			continue
+		}
+		if s.Value < base { // counter reset
+			base = 0
+		}
+		// fractions are carried over to the next scrape
+		delta := math.Floor(s.Value - base)
+		c.base[key] = base + delta
+		m.Type = model.Counter
+		d := int64(delta)
+		m.Delta = &d
+		res = append(res, m)
+	}
+	return res
+}
+
+// PromSample is a sample parsed from the Prometheus text format.
+type PromSample struct {
+	Name       string
+	Labels     map[string]string
+	Value      float64
+	Cumulative bool // Counter, or histogram/summary bucket, sum or count.
+}
+
+// ParsePrometheusText parses the Prometheus text exposition format.
+// Samples with non-finite values are skipped; timestamps are ignored.
+func ParsePrometheusText(r io.Reader) ([]PromSample, error) {
+	types := make(map[string]string) // metric family type by name
+
+	var res []PromSample
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		s, err := parsePromLine(line)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %w", n, err)
+		}
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		s.Cumulative = isCumulative(s.Name, types)
+		res = append(res, s)
+	}
+	return res, sc.Err()
+}
+
+// isCumulative reports whether the sample belongs to a counter or is a cumulative
+// part of a histogram or summary.
+func isCumulative(name string, types map[string]string) bool {
+	if types[name] == "counter" {
+		return true
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		family, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		switch types[family] {
+		case "histogram":
+			return true
+		case "summary":
+			return suffix != "_bucket"
+		}
+	}
+	return false
+}
+
+// parsePromLine parses name{label="value",...} value [timestamp].
+func parsePromLine(line string) (PromSample, error) {
+	var s PromSample
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, tail, err := parsePromLabels(rest[1:])
+		if err != nil {
+			return s, err
+		}
+		s.Labels = labels
+		rest = tail
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value %q", fields[0])
+	}
+	s.Value = v
+	return s, nil
+}
+
+// parsePromLabels parses labels up to the closing brace and returns the rest of the line.
+func parsePromLabels(in string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		in = strings.TrimLeft(in, " \t,")
+		if strings.HasPrefix(in, "}") {
+			if len(labels) == 0 {
+				labels = nil
+			}
+			return labels, in[1:], nil
+		}
+
+		eq := strings.IndexByte(in, '=')
+		if eq <= 0 || len(in) < eq+2 || in[eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid labels %q", in)
+		}
+		name := strings.TrimSpace(in[:eq])
+		in = in[eq+2:]
+
+		var b strings.Builder
+		closed := false
+		for i := 0; i < len(in); i++ {
+			ch := in[i]
+			if ch == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					b.WriteByte('\n')
+				default:
+					b.WriteByte(in[i])
+				}
+				continue
+			}
+			if ch == '"' {
+				in = in[i+1:]
+				closed = true
+				break
+			}
+			b.WriteByte(ch)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated label value of %q", name)
+		}
+		labels[name] = b.String()
+	}
+}
@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+const promText = `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{method="get",path="/a\"b"} 10 1700000000000
+http_requests_total{method="post"} 2
+# TYPE temperature gauge
+temperature 21.5
+untyped_thing 3
+# TYPE latency histogram
+latency_bucket{le="0.1"} 4
+latency_bucket{le="+Inf"} 5
+latency_sum 0.7
+latency_count 5
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.2
+rpc_sum 12
+rpc_count 40
+nan_gauge NaN
+`
+
+func TestParsePrometheusText(t *testing.T) {
+	samples, err := ParsePrometheusText(strings.NewReader(promText))
+	require.NoError(t, err)
+	require.Len(t, samples, 11)
+
+	byKey := map[string]PromSample{}
+	for _, s := range samples {
+		byKey[model.SeriesKey(s.Name, s.Labels)] = s
+	}
+
+	s := byKey[model.SeriesKey("http_requests_total", map[string]string{"method": "get", "path": `/a"b`})]
+	require.Equal(t, 10.0, s.Value)
+	require.True(t, s.Cumulative)
+
+	require.False(t, byKey["temperature"].Cumulative)
+	require.False(t, byKey["untyped_thing"].Cumulative)
+	require.True(t, byKey[model.SeriesKey("latency_bucket", map[string]string{"le": "+Inf"})].Cumulative)
+	require.True(t, byKey["latency_sum"].Cumulative)
+	require.False(t, byKey[model.SeriesKey("rpc", map[string]string{"quantile": "0.5"})].Cumulative)
+	require.True(t, byKey["rpc_count"].Cumulative)
+
+	_, err = ParsePrometheusText(strings.NewReader(`broken{a="1" 1`))
+	require.Error(t, err)
+	_, err = ParsePrometheusText(strings.NewReader(`x abc`))
+	require.Error(t, err)
+}
+
+func TestRelabel(t *testing.T) {
+	rename, err := NewRelabel("", NameLabel, "node_(.*)", NameLabel, "host_$1")
+	require.NoError(t, err)
+	drop, err := NewRelabel(RelabelDrop, "mode", "idle", "", "")
+	require.NoError(t, err)
+	labelDrop, err := NewRelabel(RelabelLabelDrop, "", "cpu", "", "")
+	require.NoError(t, err)
+
+	m := model.Metric{ID: "node_cpu", Labels: map[string]string{"cpu": "0", "mode": "user"}}
+	for _, r := range []Relabel{rename, drop, labelDrop} {
+		require.True(t, r.apply(&m))
+	}
+	require.Equal(t, "host_cpu", m.ID)
+	require.Equal(t, map[string]string{"mode": "user"}, m.Labels)
+
+	idle := model.Metric{ID: "node_cpu", Labels: map[string]string{"mode": "idle"}}
+	require.False(t, drop.apply(&idle))
+
+	_, err = NewRelabel("explode", "a", "", "", "")
+	require.Error(t, err)
+	_, err = NewRelabel(RelabelReplace, "a", "", "", "")
+	require.Error(t, err)
+	_, err = NewRelabel(RelabelKeep, "a", "(", "", "")
+	require.Error(t, err)
+}
+
+func TestScrapeCollector_Collect(t *testing.T) {
+	var scrapes atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := scrapes.Add(1)
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total %d.5\n# TYPE queue gauge\nqueue{name=\"q1\"} 7\ngo_goroutines 12\n", 10*n)
+	}))
+	defer ts.Close()
+
+	keep, err := NewRelabel(RelabelDrop, NameLabel, "go_.*", "", "")
+	require.NoError(t, err)
+	c, err := NewScrapeCollector(ts.URL, "app", nil, []Relabel{keep})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	metrics, err := c.Collect(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1, "counters only record the baseline on the first scrape")
+	require.Equal(t, "queue", metrics[0].ID)
+	require.Equal(t, map[string]string{"name": "q1", JobLabel: "app"}, metrics[0].Labels)
+	require.Equal(t, 7.0, *metrics[0].Value)
+
+	metrics, err = c.Collect(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	for _, m := range metrics {
+		if m.ID == "jobs_total" {
+			require.Equal(t, model.Counter, m.Type)
+			require.EqualValues(t, 10, *m.Delta)
+		}
+	}
+}
+
+func TestScrapeCollector_CounterDeltas(t *testing.T) {
+	c, err := NewScrapeCollector("", "", []string{"c"}, nil)
+	require.NoError(t, err)
+
+	collect := func(v float64) []model.Metric {
+		return c.toMetrics([]PromSample{{Name: "c", Value: v, Cumulative: true}, {Name: "skipped", Value: 1}})
+	}
+	require.Empty(t, collect(1.5))
+	require.EqualValues(t, 0, *collect(1.9)[0].Delta)
+	require.EqualValues(t, 1, *collect(2.6)[0].Delta, "fractions carry over")
+	require.EqualValues(t, 2, *collect(2.2)[0].Delta, "reset reports the new value")
+}
+
+func TestScrapeCollector_Errors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, err := NewScrapeCollector(ts.URL, "app", nil, nil)
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background())
+	require.ErrorContains(t, err, "503")
+
+	_, err = NewScrapeCollector(ts.URL, "app", []string{"("}, nil)
+	require.Error(t, err)
+}
+
+func TestScrapeCollector_BodyTooLarge(t *testing.T) {
+	line := "temperature 21.5\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat(line, maxScrapeBody/len(line)+1))
+	}))
+	defer ts.Close()
+
+	c, err := NewScrapeCollector(ts.URL, "app", nil, nil)
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background())
+	require.ErrorContains(t, err, "exceeds")
+	require.Empty(t, metrics)
+}
@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// Self-metrics reported for every collector run, labeled with the collector name.
+const (
+	ErrorsMetric   = "CollectorErrors"   // Counter of failed runs.
+	DurationMetric = "CollectorDuration" // Gauge with the last run duration in seconds.
+
+	collectorLabel = "collector"
+)
+
+// Collector gathers a set of metrics. It may return metrics together with an error
+// if only part of them could be collected.
+type Collector interface {
+	Collect(ctx context.Context) ([]model.Metric, error)
+}
+
+// CollectorFunc adapts a function to the Collector interface.
+type CollectorFunc func(ctx context.Context) ([]model.Metric, error)
+
+// Collect calls f(ctx).
+func (f CollectorFunc) Collect(ctx context.Context) ([]model.Metric, error) {
+	return f(ctx)
+}
+
+// Builtin returns constructors of the collectors shipped with the agent, by name.
+func Builtin() map[string]func() Collector {
+	return map[string]func() Collector{
+		"runtime":   func() Collector { return NewRuntimeCollector() },
+		"gopsutil":  func() Collector { return CollectorFunc(CollectGopsutilMetrics) },
+		"disk":      func() Collector { return CollectorFunc(CollectDiskUsage) },
+		"diskio":    func() Collector { return NewDiskIOCollector() },
+		"net":       func() Collector { return NewNetCollector() },
+		"load":      func() Collector { return CollectorFunc(CollectLoadAverage) },
+		"swap":      func() Collector { return CollectorFunc(CollectSwap) },
+		"processes": func() Collector { return CollectorFunc(CollectProcessCount) },
+	}
+}
+
+// Settings controls how the registry runs a collector.
+type Settings struct {
+	Enabled  bool
+	Interval time.Duration // Time between runs; collectors with a non-positive interval are not run.
+	Timeout  time.Duration // Limit for a single run; non-positive means Interval.
+}
+
+type entry struct {
+	name      string
+	collector Collector
+	settings  Settings
+}
+
+// Registry runs registered collectors, each on its own schedule.
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a collector under a unique name.
+func (r *Registry) Register(name string, c Collector, s Settings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.entries {
+		if e.name == name {
+			return fmt.Errorf("collector %q already registered", name)
+		}
+	}
+	r.entries = append(r.entries, entry{name: name, collector: c, settings: s})
+	return nil
+}
+
+// Enabled returns names of enabled collectors in registration order.
+func (r *Registry) Enabled() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var res []string
+	for _, e := range r.entries {
+		if e.settings.Enabled && e.settings.Interval > 0 {
+			res = append(res, e.name)
+		}
+	}
+	return res
+}
+
+// Run starts every enabled collector and passes collected metrics, followed by
+// the collector self-metrics, to save. It blocks until the context is canceled.
+func (r *Registry) Run(ctx context.Context, save func(ctx context.Context, name string, metrics []model.Metric)) {
+	r.mu.Lock()
+	entries := append([]entry(nil), r.entries...)
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		if !e.settings.Enabled || e.settings.Interval <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.run(ctx, save)
+		}()
+	}
+	wg.Wait()
+}
+
+func (e entry) run(ctx context.Context, save func(ctx context.Context, name string, metrics []model.Metric)) {
+	t := time.NewTicker(e.settings.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			save(ctx, e.name, e.collectOnce(ctx))
+		}
+	}
+}
+
+// collectOnce runs the collector with the timeout and appends the self-metrics.
+func (e entry) collectOnce(ctx context.Context) []model.Metric {
+	timeout := e.settings.Timeout
+	if timeout <= 0 {
+		timeout = e.settings.Interval
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	metrics, err := e.collector.Collect(cctx)
+	elapsed := time.Since(start)
+
+	var failed int64
+	if err != nil {
+		failed = 1
+		log.Printf("collector %s: %v", e.name, err)
+	}
+
+	labels := map[string]string{collectorLabel: e.name}
+	return append(metrics,
+		model.Metric{ID: ErrorsMetric, Type: model.Counter, Delta: utils.I64Ptr(failed), Labels: labels},
+		model.Metric{ID: DurationMetric, Type: model.Gauge, Value: utils.F64Ptr(elapsed.Seconds()), Labels: labels},
+	)
+}
@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) model.Metric {
+	return model.Metric{ID: id, Type: model.Gauge, Value: utils.F64Ptr(v)}
+}
+
+func findMetric(metrics []model.Metric, id, collector string) *model.Metric {
+	for i, m := range metrics {
+		if m.ID == id && m.Labels[collectorLabel] == collector {
+			return &metrics[i]
+		}
+	}
+	return nil
+}
+
+func TestRegistry_RegisterDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	c := CollectorFunc(func(context.Context) ([]model.Metric, error) { return nil, nil })
+
+	require.NoError(t, reg.Register("a", c, Settings{Enabled: true, Interval: time.Second}))
+	require.Error(t, reg.Register("a", c, Settings{Enabled: true, Interval: time.Second}))
+	require.NoError(t, reg.Register("b", c, Settings{Interval: time.Second}))
+
+	require.Equal(t, []string{"a"}, reg.Enabled())
+}
+
+func TestRegistry_Run(t *testing.T) {
+	reg := NewRegistry()
+
+	var disabledCalls int
+	require.NoError(t, reg.Register("ok", CollectorFunc(func(context.Context) ([]model.Metric, error) {
+		return []model.Metric{gauge("G", 1)}, nil
+	}), Settings{Enabled: true, Interval: 10 * time.Millisecond}))
+	require.NoError(t, reg.Register("fail", CollectorFunc(func(context.Context) ([]model.Metric, error) {
+		return []model.Metric{gauge("Partial", 2)}, errors.New("boom")
+	}), Settings{Enabled: true, Interval: 10 * time.Millisecond}))
+	require.NoError(t, reg.Register("off", CollectorFunc(func(context.Context) ([]model.Metric, error) {
+		disabledCalls++
+		return nil, nil
+	}), Settings{Enabled: false, Interval: 10 * time.Millisecond}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu  sync.Mutex
+		got = map[string][]model.Metric{}
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reg.Run(ctx, func(_ context.Context, name string, metrics []model.Metric) {
+			mu.Lock()
+			defer mu.Unlock()
+			got[name] = metrics
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got["ok"]) > 0 && len(got["fail"]) > 0
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	require.Zero(t, disabledCalls)
+	require.NotContains(t, got, "off")
+
+	ok := got["ok"]
+	require.NotNil(t, findMetric(ok, "G", ""))
+	require.EqualValues(t, 0, *findMetric(ok, ErrorsMetric, "ok").Delta)
+	require.NotNil(t, findMetric(ok, DurationMetric, "ok").Value)
+
+	fail := got["fail"]
+	require.NotNil(t, findMetric(fail, "Partial", ""), "partial results are kept")
+	require.EqualValues(t, 1, *findMetric(fail, ErrorsMetric, "fail").Delta)
+}
+
+func TestEntry_CollectOnceTimeout(t *testing.T) {
+	e := entry{
+		name: "slow",
+		collector: CollectorFunc(func(ctx context.Context) ([]model.Metric, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+		settings: Settings{Enabled: true, Interval: time.Hour, Timeout: 20 * time.Millisecond},
+	}
+
+	start := time.Now()
+	metrics := e.collectOnce(context.Background())
+	require.Less(t, time.Since(start), time.Second)
+	require.EqualValues(t, 1, *findMetric(metrics, ErrorsMetric, "slow").Delta)
+}
@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// CollectDiskUsage reports total, free and used percent of every mounted physical partition,
+// labeled by mount point.
+func CollectDiskUsage(ctx context.Context) ([]model.Metric, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("disk partitions: %w", err)
+	}
+
+	var (
+		res  []model.Metric
+		errs []error
+	)
+	for _, p := range partitions {
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disk usage %s: %w", p.Mountpoint, err))
+			continue
+		}
+		labels := map[string]string{"mount": p.Mountpoint}
+		res = append(res,
+			model.Metric{ID: "DiskTotal", Type: model.Gauge, Value: utils.F64Ptr(float64(u.Total)), Labels: labels},
+			model.Metric{ID: "DiskFree", Type: model.Gauge, Value: utils.F64Ptr(float64(u.Free)), Labels: labels},
+			model.Metric{ID: "DiskUsedPercent", Type: model.Gauge, Value: utils.F64Ptr(u.UsedPercent), Labels: labels},
+		)
+	}
+	return res, errors.Join(errs...)
+}
+
+// DiskIOCollector reports disk I/O per device as counter deltas since the previous call.
+// The first call only records the baseline. It is safe for concurrent use.
+type DiskIOCollector struct {
+	deltas counterDeltas
+}
+
+// NewDiskIOCollector creates a new DiskIOCollector.
+func NewDiskIOCollector() *DiskIOCollector {
+	return &DiskIOCollector{}
+}
+
+// Collect returns DiskReadBytes, DiskWriteBytes, DiskReads and DiskWrites labeled by device.
+func (c *DiskIOCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("disk io: %w", err)
+	}
+
+	values := make(map[string]map[string]uint64, len(counters))
+	for name, s := range counters {
+		values[name] = map[string]uint64{
+			"DiskReadBytes":  s.ReadBytes,
+			"DiskWriteBytes": s.WriteBytes,
+			"DiskReads":      s.ReadCount,
+			"DiskWrites":     s.WriteCount,
+		}
+	}
+	return c.deltas.collect("device", values), nil
+}
+
+// NetCollector reports network traffic per interface as counter deltas since the previous call.
+// The first call only records the baseline. It is safe for concurrent use.
+type NetCollector struct {
+	deltas counterDeltas
+}
+
+// NewNetCollector creates a new NetCollector.
+func NewNetCollector() *NetCollector {
+	return &NetCollector{}
+}
+
+// Collect returns NetBytesSent, NetBytesRecv, NetPacketsSent and NetPacketsRecv labeled by interface.
+func (c *NetCollector) Collect(ctx context.Context) ([]model.Metric, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("net io: %w", err)
+	}
+
+	values := make(map[string]map[string]uint64, len(counters))
+	for _, s := range counters {
+		values[s.Name] = map[string]uint64{
+			"NetBytesSent":   s.BytesSent,
+			"NetBytesRecv":   s.BytesRecv,
+			"NetPacketsSent": s.PacketsSent,
+			"NetPacketsRecv": s.PacketsRecv,
+		}
+	}
+	return c.deltas.collect("interface", values), nil
+}
+
+// CollectLoadAverage reports the 1, 5 and 15 minute load averages.
+func CollectLoadAverage(ctx context.Context) ([]model.Metric, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load average: %w", err)
+	}
+	return []model.Metric{
+		{ID: "Load1", Type: model.Gauge, Value: utils.F64Ptr(avg.Load1)},
+		{ID: "Load5", Type: model.Gauge, Value: utils.F64Ptr(avg.Load5)},
+		{ID: "Load15", Type: model.Gauge, Value: utils.F64Ptr(avg.Load15)},
+	}, nil
+}
+
+// CollectSwap reports swap total, free and used percent.
+func CollectSwap(ctx context.Context) ([]model.Metric, error) {
+	swap, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("swap: %w", err)
+	}
+	return []model.Metric{
+		{ID: "SwapTotal", Type: model.Gauge, Value: utils.F64Ptr(float64(swap.Total))},
+		{ID: "SwapFree", Type: model.Gauge, Value: utils.F64Ptr(float64(swap.Free))},
+		{ID: "SwapUsedPercent", Type: model.Gauge, Value: utils.F64Ptr(swap.UsedPercent)},
+	}, nil
+}
+
+// CollectProcessCount reports the number of running processes.
+func CollectProcessCount(ctx context.Context) ([]model.Metric, error) {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("processes: %w", err)
+	}
+	return []model.Metric{
+		{ID: "ProcessCount", Type: model.Gauge, Value: utils.F64Ptr(float64(len(pids)))},
+	}, nil
+}
+
+// counterDeltas turns cumulative system counters into deltas between calls.
+type counterDeltas struct {
+	mu   sync.Mutex
+	last map[string]uint64 // by series key
+}
+
+// collect converts values[labelValue][metricID] to counter deltas labeled with labelName.
+// Series seen for the first time only record the baseline; a counter that went
+// backwards (e.g. the device was reset) reports its current value.
+func (d *counterDeltas) collect(labelName string, values map[string]map[string]uint64) []model.Metric {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last == nil {
+		d.last = make(map[string]uint64)
+	}
+
+	var res []model.Metric
+	for labelValue, counters := range values {
+		labels := map[string]string{labelName: labelValue}
+		for id, v := range counters {
+			key := model.SeriesKey(id, labels)
+			prev, ok := d.last[key]
+			d.last[key] = v
+			if !ok {
+				continue
+			}
+			delta := v - prev
+			if v < prev {
+				delta = v
+			}
+			res = append(res, model.Metric{ID: id, Type: model.Counter, Delta: utils.I64Ptr(int64(delta)), Labels: labels})
+		}
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterDeltas(t *testing.T) {
+	var d counterDeltas
+
+	first := d.collect("device", map[string]map[string]uint64{"sda": {"DiskReads": 100}})
+	require.Empty(t, first, "first call records the baseline")
+
+	second := d.collect("device", map[string]map[string]uint64{
+		"sda": {"DiskReads": 130},
+		"sdb": {"DiskReads": 5},
+	})
+	require.Len(t, second, 1)
+	require.Equal(t, "DiskReads", second[0].ID)
+	require.Equal(t, model.Counter, second[0].Type)
+	require.EqualValues(t, 30, *second[0].Delta)
+	require.Equal(t, map[string]string{"device": "sda"}, second[0].Labels)
+
+	reset := d.collect("device", map[string]map[string]uint64{"sda": {"DiskReads": 7}})
+	require.Len(t, reset, 1)
+	require.EqualValues(t, 7, *reset[0].Delta)
+}
+
+func TestSystemCollectors_Smoke(t *testing.T) {
+	collectors := map[string]func(context.Context) ([]model.Metric, error){
+		"disk":      CollectDiskUsage,
+		"diskio":    NewDiskIOCollector().Collect,
+		"net":       NewNetCollector().Collect,
+		"load":      CollectLoadAverage,
+		"swap":      CollectSwap,
+		"processes": CollectProcessCount,
+	}
+
+	for name, collect := range collectors {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, _ = collect(ctx) // delta collectors only record the baseline on the first call
+
+			metrics, _ := collect(ctx) // some stats may be unavailable in containers
+			seen := map[string]struct{}{}
+			for _, m := range metrics {
+				if _, ok := seen[m.Key()]; ok {
+					t.Fatalf("duplicate metric series: %s", m.Key())
+				}
+				seen[m.Key()] = struct{}{}
+
+				require.True(t, m.Type == model.Gauge || m.Type == model.Counter)
+				if m.Type == model.Gauge {
+					require.NotNil(t, m.Value)
+				} else {
+					require.NotNil(t, m.Delta)
+					require.GreaterOrEqual(t, *m.Delta, int64(0))
+				}
+			}
+		})
+	}
+}
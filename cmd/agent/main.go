@@ -21,14 +21,14 @@ func main() {
 	defer stop()
 
 	config := config.NewClientConfig()
-	storage := inmemory.NewMemStorage(ctx)
+	storage := inmemory.NewMemStorageWithHistory(ctx, 0)
 	clnt, err := client.NewClient(storage, config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("Client config: ServerAddr=%s, ReportInterval=%d, PollInterval=%d, Timeout=%d",
-		config.ServerAddr, config.ReportInterval, config.PollInterval, config.ClientTimeout)
+	log.Printf("Client config: AgentID=%s, ServerAddr=%s, ReportInterval=%d, PollInterval=%d, Timeout=%d, SendMode=%s",
+		config.AgentID, config.ServerAddr, config.ReportInterval, config.PollInterval, config.ClientTimeout, config.SendMode)
 
 	if err := clnt.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatal(err)
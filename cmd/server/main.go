@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/and161185/metrics-alerting/internal/buildinfo"
 	"github.com/and161185/metrics-alerting/internal/config"
@@ -26,24 +27,26 @@ func main() {
 	defer func() { _ = config.Logger.Sync() }()
 
 	var (
-		storage server.Storage
-		err     error
+		storage   server.Storage
+		err       error
+		retention = time.Duration(config.Retention) * time.Second
 	)
 	if config.DatabaseDsn != "" {
-		storage, err = postgres.NewPostgresStorage(ctx, config.DatabaseDsn)
+		storage, err = postgres.NewPostgresStorageWithRetention(ctx, config.DatabaseDsn, config.HistoryLimit, retention)
 		if err != nil {
 			config.Logger.Fatal(err)
 		}
 	} else {
-		storage = inmemory.NewMemStorage(ctx)
+		storage = inmemory.NewMemStorageWithRetention(ctx, config.HistoryLimit, retention)
 	}
 
-	config.Logger.Infof("Server config: Addr=%s, StoreInterval=%d, FileStoragePath=%q, Restore=%t, DatabaseDSN set=%t",
+	config.Logger.Infof("Server config: Addr=%s, StoreInterval=%d, FileStoragePath=%q, Restore=%t, DatabaseDSN set=%t, AlertRules=%q",
 		config.Addr,
 		config.StoreInterval,
 		config.FileStoragePath,
 		config.Restore,
 		config.DatabaseDsn != "",
+		config.AlertRulesPath,
 	)
 
 	var priv *rsa.PrivateKey
@@ -55,7 +58,10 @@ func main() {
 		}
 	}
 
-	srv := server.NewServer(storage, config, priv)
+	srv, err := server.NewServer(storage, config, priv)
+	if err != nil {
+		config.Logger.Fatal(err)
+	}
 	if err := srv.Run(ctx); err != nil {
 		config.Logger.Fatal(err)
 	}
@@ -59,6 +59,11 @@ func CheckMetric(m *model.Metric) error {
 	if m.Type != model.Gauge && m.Type != model.Counter {
 		return errors.New("invalid type")
 	}
+	for name := range m.Labels {
+		if name == "" {
+			return errors.New("empty label name")
+		}
+	}
 	return nil
 }
 
@@ -104,6 +104,16 @@ func TestCheckMetric(t *testing.T) {
 		err := CheckMetric(&model.Metric{Type: model.Gauge, Value: &v})
 		require.NoError(t, err)
 	})
+	t.Run("ok_labels", func(t *testing.T) {
+		v := 3.14
+		err := CheckMetric(&model.Metric{Type: model.Gauge, Value: &v, Labels: map[string]string{"host": "a"}})
+		require.NoError(t, err)
+	})
+	t.Run("empty_label_name", func(t *testing.T) {
+		v := 3.14
+		err := CheckMetric(&model.Metric{Type: model.Gauge, Value: &v, Labels: map[string]string{"": "a"}})
+		require.Error(t, err)
+	})
 }
 
 func Test_invalidMetricsType(t *testing.T) {
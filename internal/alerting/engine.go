@@ -0,0 +1,281 @@
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+	"go.uber.org/zap"
+)
+
+// State is the lifecycle state of an alert.
+type State string
+
+const (
+	StatePending  State = "pending"  // Condition holds, but not yet for the required duration.
+	StateFiring   State = "firing"   // Condition has held for the required duration.
+	StateResolved State = "resolved" // Condition stopped holding after the alert fired.
+)
+
+// Alert is the current state of a rule for a single series.
+type Alert struct {
+	Rule       string            `json:"rule"`
+	MetricID   string            `json:"metric_id"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Type       model.MetricType  `json:"type"`
+	Value      float64           `json:"value"`
+	State      State             `json:"state"`
+	ActiveAt   time.Time         `json:"active_at"`
+	FiredAt    *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+}
+
+type source interface {
+	GetAll(ctx context.Context) (map[string]*model.Metric, error)
+}
+
+// Notifier delivers alerts that transitioned to firing or resolved.
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// resolvedRetention is how long resolved alerts are kept before they are deleted.
+const resolvedRetention = 24 * time.Hour
+
+// notifyQueueSize is the number of alerts a notifier may fall behind before new ones are dropped.
+const notifyQueueSize = 256
+
+// queuedNotifier delivers the alerts of its queue in a goroutine of its own, so
+// that a slow notifier delays neither evaluation nor the other notifiers.
+type queuedNotifier struct {
+	notifier Notifier
+	queue    chan Alert
+}
+
+// Engine periodically evaluates rules and tracks alert states.
+type Engine struct {
+	source source
+	rules  []Rule
+	logger *zap.SugaredLogger
+	now    func() time.Time
+
+	notifiers []*queuedNotifier
+	wg        sync.WaitGroup // notifier goroutines
+	closeOnce sync.Once
+
+	mu     sync.RWMutex
+	alerts map[string]*Alert // by rule name and series key
+}
+
+// NewEngine creates a new Engine evaluating the given rules against the source.
+func NewEngine(src source, rules []Rule, logger *zap.SugaredLogger) *Engine {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	return &Engine{
+		source: src,
+		rules:  rules,
+		logger: logger,
+		now:    time.Now,
+		alerts: make(map[string]*Alert),
+	}
+}
+
+// AddNotifier registers a notifier called on firing and resolved transitions.
+// Alerts are delivered in order by a goroutine of the notifier until Close.
+// It must be called before Run.
+func (e *Engine) AddNotifier(n Notifier) {
+	q := &queuedNotifier{notifier: n, queue: make(chan Alert, notifyQueueSize)}
+	e.notifiers = append(e.notifiers, q)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for a := range q.queue {
+			if err := n.Notify(context.Background(), a); err != nil {
+				e.logger.Errorf("alerting: notify rule %s [%s]: %v", a.Rule, a.State, err)
+			}
+		}
+	}()
+}
+
+// Close stops the notifier goroutines once they have delivered the queued alerts.
+// Evaluate must not be called after Close.
+func (e *Engine) Close() {
+	e.closeOnce.Do(func() {
+		for _, q := range e.notifiers {
+			close(q.queue)
+		}
+	})
+	e.wg.Wait()
+}
+
+// Run evaluates rules every interval until the context is canceled.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := e.Evaluate(ctx); err != nil {
+				e.logger.Errorf("alerting: evaluate: %v", err)
+			}
+		}
+	}
+}
+
+// Evaluate checks every rule against the current metrics, updates alert states
+// and notifies about alerts that started firing or got resolved. Alerts resolved
+// more than resolvedRetention ago are deleted.
+func (e *Engine) Evaluate(ctx context.Context) error {
+	all, err := e.source.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := e.now()
+
+	var changed []Alert
+	e.mu.Lock()
+	for _, rule := range e.rules {
+		changed = append(changed, e.evaluateRule(rule, all, now)...)
+	}
+	for key, a := range e.alerts {
+		if a.State == StateResolved && now.Sub(*a.ResolvedAt) > resolvedRetention {
+			delete(e.alerts, key)
+		}
+	}
+	e.mu.Unlock()
+
+	e.notify(changed)
+	return nil
+}
+
+// Forget deletes the alerts of the series without notifications, e.g. for a series
+// that stopped being reported for good, which would otherwise resolve its alerts.
+func (e *Engine) Forget(metricID string, labels map[string]string) {
+	series := model.SeriesKey(metricID, labels)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range e.rules {
+		delete(e.alerts, alertKey(rule.Name, series))
+	}
+}
+
+// notify queues changed alerts to every notifier without waiting for delivery.
+// Alerts are dropped for a notifier whose queue is full.
+func (e *Engine) notify(alerts []Alert) {
+	for _, a := range alerts {
+		for _, q := range e.notifiers {
+			select {
+			case q.queue <- a:
+			default:
+				e.logger.Errorf("alerting: notifier queue full, dropping rule %s [%s]", a.Rule, a.State)
+			}
+		}
+	}
+}
+
+// evaluateRule applies the rule to every series of its metric, including series
+// that have alerts but disappeared from storage, and returns changed alerts.
+// Callers must hold the write lock.
+func (e *Engine) evaluateRule(rule Rule, all map[string]*model.Metric, now time.Time) []Alert {
+	var changed []Alert
+	seen := make(map[string]struct{})
+
+	for _, m := range all {
+		if m.ID != rule.MetricID || m.Type != rule.Type {
+			continue
+		}
+		key := alertKey(rule.Name, m.Key())
+		seen[key] = struct{}{}
+
+		value, active := rule.matches(m)
+		if a, ok := e.transition(key, rule, m.Labels, value, active, now); ok {
+			changed = append(changed, a)
+		}
+	}
+
+	for key, a := range e.alerts {
+		if _, ok := seen[key]; ok || a.Rule != rule.Name {
+			continue
+		}
+		if a, ok := e.transition(key, rule, a.Labels, a.Value, false, now); ok {
+			changed = append(changed, a)
+		}
+	}
+
+	return changed
+}
+
+func alertKey(rule, series string) string {
+	return rule + "/" + series
+}
+
+// transition updates the alert stored under key and returns its snapshot
+// if it has just started firing or got resolved.
+func (e *Engine) transition(key string, rule Rule, labels map[string]string, value float64, active bool, now time.Time) (Alert, bool) {
+	alert, ok := e.alerts[key]
+
+	if !active {
+		if !ok {
+			return Alert{}, false
+		}
+		switch alert.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			alert.State = StateResolved
+			alert.ResolvedAt = &now
+			e.logger.Infof("alerting: rule %s resolved for %s", rule.Name, model.SeriesKey(rule.MetricID, labels))
+			return *alert, true
+		}
+		return Alert{}, false
+	}
+
+	if !ok || alert.State == StateResolved {
+		alert = &Alert{
+			Rule:     rule.Name,
+			MetricID: rule.MetricID,
+			Labels:   labels,
+			Type:     rule.Type,
+			State:    StatePending,
+			ActiveAt: now,
+		}
+		e.alerts[key] = alert
+	}
+	alert.Value = value
+
+	if alert.State == StatePending && now.Sub(alert.ActiveAt) >= rule.For {
+		alert.State = StateFiring
+		alert.FiredAt = &now
+		e.logger.Infof("alerting: rule %s firing for %s, value=%v", rule.Name, model.SeriesKey(rule.MetricID, labels), value)
+		return *alert, true
+	}
+	return Alert{}, false
+}
+
+// Alerts returns a snapshot of all pending, firing and resolved alerts sorted by rule name and series.
+func (e *Engine) Alerts() []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	keys := make([]string, 0, len(e.alerts))
+	for key := range e.alerts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]Alert, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, *e.alerts[key])
+	}
+	return res
+}
@@ -0,0 +1,292 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+type errSource struct{}
+
+func (errSource) GetAll(context.Context) (map[string]*model.Metric, error) {
+	return nil, errors.New("boom")
+}
+
+func newTestEngine(t *testing.T, expr string) (*Engine, *inmemory.MemStorage, *time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	rule, err := ParseRule("HighHeap", expr)
+	require.NoError(t, err)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := NewEngine(st, []Rule{rule}, nil)
+	e.now = func() time.Time { return now }
+	return e, st, &now
+}
+
+func TestEngine_PendingFiringResolved(t *testing.T) {
+	ctx := context.Background()
+	e, st, now := newTestEngine(t, "gauge HeapAlloc > 100 for 2m")
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	require.NoError(t, e.Evaluate(ctx))
+
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, StatePending, alerts[0].State)
+	require.Equal(t, 150.0, alerts[0].Value)
+
+	*now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StatePending, e.Alerts()[0].State)
+
+	*now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	alerts = e.Alerts()
+	require.Equal(t, StateFiring, alerts[0].State)
+	require.NotNil(t, alerts[0].FiredAt)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(50)}))
+	*now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	alerts = e.Alerts()
+	require.Equal(t, StateResolved, alerts[0].State)
+	require.NotNil(t, alerts[0].ResolvedAt)
+}
+
+func TestEngine_PendingDroppedWhenConditionClears(t *testing.T) {
+	ctx := context.Background()
+	e, st, _ := newTestEngine(t, "gauge HeapAlloc > 100 for 2m")
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.Len(t, e.Alerts(), 1)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(10)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.Empty(t, e.Alerts())
+}
+
+func TestEngine_FiresImmediatelyWithoutFor(t *testing.T) {
+	ctx := context.Background()
+	e, st, _ := newTestEngine(t, "counter PollCount >= 3")
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(3)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StateFiring, e.Alerts()[0].State)
+}
+
+func TestEngine_IgnoresTypeMismatch(t *testing.T) {
+	ctx := context.Background()
+	e, st, _ := newTestEngine(t, "counter HeapAlloc > 1")
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.Empty(t, e.Alerts())
+}
+
+func TestEngine_SourceError(t *testing.T) {
+	e := NewEngine(errSource{}, nil, nil)
+	require.Error(t, e.Evaluate(context.Background()))
+}
+
+func TestEngine_RunStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	e, st, _ := newTestEngine(t, "gauge HeapAlloc > 1")
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+
+	e.Run(ctx, 10*time.Millisecond)
+	require.Len(t, e.Alerts(), 1)
+}
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []Alert
+	err    error
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, a Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, a)
+	return n.err
+}
+
+func (n *recordingNotifier) received() []Alert {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Alert(nil), n.alerts...)
+}
+
+// waitNotified waits until the notifier has received count alerts.
+func waitNotified(t *testing.T, n *recordingNotifier, count int) []Alert {
+	t.Helper()
+	require.Eventually(t, func() bool { return len(n.received()) >= count }, time.Second, time.Millisecond)
+	return n.received()
+}
+
+func TestEngine_NotifiesOnFiringAndResolved(t *testing.T) {
+	ctx := context.Background()
+	e, st, now := newTestEngine(t, "gauge HeapAlloc > 100 for 1m")
+	n := &recordingNotifier{}
+	failing := &recordingNotifier{err: errors.New("unreachable")}
+	e.AddNotifier(failing)
+	e.AddNotifier(n)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	require.NoError(t, e.Evaluate(ctx))
+
+	*now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	require.NoError(t, e.Evaluate(ctx))
+	alerts := waitNotified(t, n, 1)
+	require.Equal(t, StateFiring, alerts[0].State)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	require.NoError(t, e.Evaluate(ctx))
+	e.Close()
+	alerts = n.received()
+	require.Len(t, alerts, 2, "pending alerts are not notified")
+	require.Equal(t, StateResolved, alerts[1].State)
+	require.Len(t, failing.received(), 2)
+}
+
+// blockingNotifier blocks every delivery until release is closed.
+type blockingNotifier struct {
+	release chan struct{}
+}
+
+func (n *blockingNotifier) Notify(context.Context, Alert) error {
+	<-n.release
+	return nil
+}
+
+func TestEngine_SlowNotifierDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	e, st, _ := newTestEngine(t, "gauge HeapAlloc > 100")
+	slow := &blockingNotifier{release: make(chan struct{})}
+	n := &recordingNotifier{}
+	e.AddNotifier(slow)
+	e.AddNotifier(n)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < notifyQueueSize+10; i++ {
+			v := 150.0
+			if i%2 == 1 {
+				v = 1
+			}
+			_ = st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(v)})
+			_ = e.Evaluate(ctx)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation blocked by a slow notifier")
+	}
+	waitNotified(t, n, notifyQueueSize)
+
+	close(slow.release)
+	e.Close()
+}
+
+func TestEngine_AlertsPerLabeledSeries(t *testing.T) {
+	ctx := context.Background()
+	e, st, _ := newTestEngine(t, "gauge CPUutilization > 90")
+
+	hot := map[string]string{"host": "a"}
+	cold := map[string]string{"host": "b"}
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(95), Labels: hot}))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(10), Labels: cold}))
+	require.NoError(t, e.Evaluate(ctx))
+
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, hot, alerts[0].Labels)
+	require.Equal(t, StateFiring, alerts[0].State)
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(99), Labels: cold}))
+	require.NoError(t, e.Evaluate(ctx))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 2)
+	require.Equal(t, cold, alerts[1].Labels)
+}
+
+func TestEngine_ResolvesWhenSeriesDisappears(t *testing.T) {
+	ctx := context.Background()
+	src := &mapSource{all: map[string]*model.Metric{
+		"HeapAlloc": {ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(200)},
+	}}
+	rule, err := ParseRule("HighHeap", "gauge HeapAlloc > 100")
+	require.NoError(t, err)
+	e := NewEngine(src, []Rule{rule}, nil)
+
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	src.all = map[string]*model.Metric{}
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StateResolved, e.Alerts()[0].State)
+}
+
+func TestEngine_ForgetDropsAlertsSilently(t *testing.T) {
+	ctx := context.Background()
+	labels := map[string]string{"source": "web-1"}
+	src := &mapSource{all: map[string]*model.Metric{
+		"up": {ID: "up", Type: model.Gauge, Value: utils.F64Ptr(0), Labels: labels},
+	}}
+	rule, err := ParseRule("AgentDown", "gauge up < 1")
+	require.NoError(t, err)
+	e := NewEngine(src, []Rule{rule}, nil)
+	n := &recordingNotifier{}
+	e.AddNotifier(n)
+
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	src.all = map[string]*model.Metric{}
+	e.Forget("up", labels)
+	require.NoError(t, e.Evaluate(ctx))
+	e.Close()
+	require.Empty(t, e.Alerts())
+	require.Len(t, n.received(), 1, "forgotten alert is not resolved")
+}
+
+func TestEngine_DeletesOldResolvedAlerts(t *testing.T) {
+	ctx := context.Background()
+	e, st, now := newTestEngine(t, "gauge HeapAlloc > 100")
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(150)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(50)}))
+	require.NoError(t, e.Evaluate(ctx))
+	require.Equal(t, StateResolved, e.Alerts()[0].State)
+
+	*now = now.Add(resolvedRetention)
+	require.NoError(t, e.Evaluate(ctx))
+	require.Len(t, e.Alerts(), 1)
+
+	*now = now.Add(time.Second)
+	require.NoError(t, e.Evaluate(ctx))
+	require.Empty(t, e.Alerts())
+}
+
+type mapSource struct {
+	all map[string]*model.Metric
+}
+
+func (s *mapSource) GetAll(context.Context) (map[string]*model.Metric, error) {
+	return s.all, nil
+}
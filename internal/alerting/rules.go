@@ -0,0 +1,128 @@
+// Package alerting evaluates threshold rules against stored metrics.
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+)
+
+var ErrInvalidRule = errors.New("invalid alert rule")
+
+// Rule describes a threshold condition on a single metric,
+// e.g. "gauge HeapAlloc > 500e6 for 2m".
+type Rule struct {
+	Name      string           // Unique rule name.
+	Type      model.MetricType // Metric type: gauge or counter.
+	MetricID  string           // Metric name.
+	Op        string           // Comparison operator: >, >=, <, <=, ==, !=.
+	Threshold float64          // Value to compare against.
+	For       time.Duration    // How long the condition must hold before firing.
+}
+
+type ruleJSON struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"` // "gauge HeapAlloc > 500e6 for 2m"
+}
+
+// LoadRules reads a JSON array of {"name", "expr"} rules from the given file.
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	var raw []ruleJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	rules := make([]Rule, 0, len(raw))
+	seen := make(map[string]struct{}, len(raw))
+	for _, r := range raw {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%w: empty name", ErrInvalidRule)
+		}
+		if _, ok := seen[r.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate name %q", ErrInvalidRule, r.Name)
+		}
+		seen[r.Name] = struct{}{}
+
+		rule, err := ParseRule(r.Name, r.Expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseRule parses an expression of the form "<type> <id> <op> <threshold> [for <duration>]".
+func ParseRule(name, expr string) (Rule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 4 && len(fields) != 6 {
+		return Rule{}, fmt.Errorf("%w %q: expected \"<type> <id> <op> <threshold> [for <duration>]\"", ErrInvalidRule, name)
+	}
+
+	rule := Rule{
+		Name:     name,
+		Type:     model.MetricType(fields[0]),
+		MetricID: fields[1],
+		Op:       fields[2],
+	}
+
+	if rule.Type != model.Gauge && rule.Type != model.Counter {
+		return Rule{}, fmt.Errorf("%w %q: unsupported metric type %q", ErrInvalidRule, name, fields[0])
+	}
+	if _, ok := operators[rule.Op]; !ok {
+		return Rule{}, fmt.Errorf("%w %q: unsupported operator %q", ErrInvalidRule, name, rule.Op)
+	}
+
+	threshold, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w %q: invalid threshold: %v", ErrInvalidRule, name, err)
+	}
+	rule.Threshold = threshold
+
+	if len(fields) == 6 {
+		if fields[4] != "for" {
+			return Rule{}, fmt.Errorf("%w %q: expected \"for\", got %q", ErrInvalidRule, name, fields[4])
+		}
+		d, err := time.ParseDuration(fields[5])
+		if err != nil || d < 0 {
+			return Rule{}, fmt.Errorf("%w %q: invalid duration %q", ErrInvalidRule, name, fields[5])
+		}
+		rule.For = d
+	}
+
+	return rule, nil
+}
+
+var operators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// matches reports whether the metric satisfies the rule condition.
+func (r Rule) matches(m *model.Metric) (float64, bool) {
+	var v float64
+	switch {
+	case r.Type == model.Gauge && m.Value != nil:
+		v = *m.Value
+	case r.Type == model.Counter && m.Delta != nil:
+		v = float64(*m.Delta)
+	default:
+		return 0, false
+	}
+	return v, operators[r.Op](v, r.Threshold)
+}
@@ -0,0 +1,76 @@
+package alerting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("HighHeap", "gauge HeapAlloc > 500e6 for 2m")
+	require.NoError(t, err)
+	require.Equal(t, Rule{
+		Name:      "HighHeap",
+		Type:      model.Gauge,
+		MetricID:  "HeapAlloc",
+		Op:        ">",
+		Threshold: 500e6,
+		For:       2 * time.Minute,
+	}, r)
+
+	r, err = ParseRule("Polls", "counter PollCount >= 10")
+	require.NoError(t, err)
+	require.Equal(t, model.Counter, r.Type)
+	require.Zero(t, r.For)
+}
+
+func TestParseRule_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"too_short":    "gauge HeapAlloc >",
+		"bad_type":     "histogram HeapAlloc > 1",
+		"bad_op":       "gauge HeapAlloc => 1",
+		"bad_value":    "gauge HeapAlloc > abc",
+		"bad_for":      "gauge HeapAlloc > 1 during 2m",
+		"bad_duration": "gauge HeapAlloc > 1 for soon",
+	}
+	for name, expr := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseRule(name, expr)
+			require.ErrorIs(t, err, ErrInvalidRule)
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(p, []byte(`[
+		{"name": "HighHeap", "expr": "gauge HeapAlloc > 500e6 for 2m"},
+		{"name": "Polls", "expr": "counter PollCount > 100"}
+	]`), 0o644))
+
+	rules, err := LoadRules(p)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "HighHeap", rules[0].Name)
+	require.Equal(t, "Polls", rules[1].Name)
+}
+
+func TestLoadRules_DuplicateName(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(p, []byte(`[
+		{"name": "A", "expr": "gauge X > 1"},
+		{"name": "A", "expr": "gauge Y > 1"}
+	]`), 0o644))
+
+	_, err := LoadRules(p)
+	require.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestLoadRules_MissingFile(t *testing.T) {
+	_, err := LoadRules(filepath.Join(t.TempDir(), "absent.json"))
+	require.Error(t, err)
+}
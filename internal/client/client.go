@@ -11,6 +11,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +21,7 @@ import (
 	"github.com/and161185/metrics-alerting/internal/client/transport"
 	"github.com/and161185/metrics-alerting/internal/config"
 	"github.com/and161185/metrics-alerting/internal/crypto"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
 	"github.com/and161185/metrics-alerting/internal/utils"
 	"github.com/and161185/metrics-alerting/model"
 )
@@ -32,20 +36,76 @@ type Client struct {
 	storage    storage
 	config     *config.ClientConfig
 	httpClient *http.Client
+	hostname   string
+	outbox     *Outbox // nil when unsent batches are not persisted
+
+	grpcClient pb.MetricsClient // set when metrics are sent over gRPC
+	grpcConn   io.Closer        // connection created by NewClient, closed when Run returns
+	stream     *metricStream    // batches reported by Run over gRPC
 }
 
 // NewClient creates a new client instance with the given storage and configuration.
 func NewClient(s storage, cfg *config.ClientConfig) (*Client, error) {
-	hc, err := NewHTTPClient(cfg)
-	if err != nil {
-		return nil, err
+	var clnt *Client
+	if cfg.Transport == config.TransportGRPC {
+		conn, err := newGRPCConn(cfg)
+		if err != nil {
+			return nil, err
+		}
+		clnt = NewClientWithGRPC(s, cfg, conn)
+		clnt.grpcConn = conn
+	} else {
+		hc, err := NewHTTPClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		clnt = NewClientWithHTTP(s, cfg, hc)
 	}
-	return NewClientWithHTTP(s, cfg, hc), nil
+	if cfg.OutboxDir != "" {
+		ob, err := OpenOutbox(cfg.OutboxDir, int64(cfg.OutboxMaxBytes))
+		if err != nil {
+			return nil, fmt.Errorf("open outbox: %w", err)
+		}
+		clnt.outbox = ob
+	}
+	return clnt, nil
 }
 
 // DI: ready http.Client
 func NewClientWithHTTP(s storage, cfg *config.ClientConfig, hc *http.Client) *Client {
-	return &Client{storage: s, config: cfg, httpClient: hc}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("failed to get hostname: %v", err)
+	}
+	return &Client{storage: s, config: cfg, httpClient: hc, hostname: hostname}
+}
+
+// setAgentHeaders identifies the agent and its report interval to the server.
+func (clnt *Client) setAgentHeaders(req *http.Request) {
+	if clnt.config.AgentID != "" {
+		req.Header.Set("X-Agent-ID", clnt.config.AgentID)
+	}
+	if clnt.config.ReportInterval > 0 {
+		req.Header.Set("X-Report-Interval", strconv.Itoa(clnt.config.ReportInterval))
+	}
+}
+
+// withHost returns a copy of the metric labeled with the agent host name.
+// A host label already set by the collector is kept.
+func (clnt *Client) withHost(m model.Metric) model.Metric {
+	if clnt.hostname == "" {
+		return m
+	}
+	if _, ok := m.Labels["host"]; ok {
+		return m
+	}
+	labels := make(map[string]string, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	labels["host"] = clnt.hostname
+	m.Labels = labels
+	return m
 }
 
 // fabric http-client
@@ -66,83 +126,147 @@ func NewHTTPClient(cfg *config.ClientConfig) (*http.Client, error) {
 // Run starts collecting metrics and sending them to the server in the background.
 func (clnt *Client) Run(ctx context.Context) error {
 	store := clnt.storage
-	poll := time.Duration(clnt.config.PollInterval) * time.Second
 	report := time.Duration(clnt.config.ReportInterval) * time.Second
 	rl := clnt.config.RateLimit
 
 	var wg sync.WaitGroup
 
 	// collectors
-	wg.Add(1)
-	go func() { defer wg.Done(); runtimeCollector(ctx, store, poll) }()
-	wg.Add(1)
-	go func() { defer wg.Done(); gopsutilCollector(ctx, store, poll) }()
-
-	metricsCh := make(chan *model.Metric, rl)
-
+	reg := newCollectorRegistry(clnt.config)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		dispatchMetrics(ctx, store, metricsCh, report)
-		close(metricsCh)
+		reg.Run(ctx, func(ctx context.Context, name string, metrics []model.Metric) {
+			collectAndSave(ctx, store, name, metrics)
+		})
 	}()
 
-	// workers
-	for i := 0; i < rl; i++ {
+	if addr := clnt.config.StatsDAddr; addr != "" {
+		l := NewStatsDListener(store, report)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for m := range metricsCh {
-				reqCtx, cancel := context.WithTimeout(context.Background(),
-					time.Duration(clnt.config.ClientTimeout)*time.Second)
-				_ = clnt.sendMetricToServer(reqCtx, m)
-				cancel()
+			if err := l.ListenAndServe(ctx, addr); err != nil {
+				log.Printf("statsd listener: %v", err)
 			}
 		}()
 	}
 
+	switch {
+	case clnt.stream != nil:
+		// one long-lived stream instead of a request per metric or batch
+		wg.Add(1)
+		go func() { defer wg.Done(); clnt.reportBatches(ctx, report, clnt.streamToServer) }()
+	case clnt.config.SendMode == config.SendModeBatch:
+		wg.Add(1)
+		go func() { defer wg.Done(); clnt.reportBatches(ctx, report, clnt.sendToServer) }()
+	default:
+		metricsCh := make(chan *model.Metric, rl)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatchMetrics(ctx, store, metricsCh, report)
+			close(metricsCh)
+		}()
+
+		// workers
+		for i := 0; i < rl; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for m := range metricsCh {
+					reqCtx, cancel := context.WithTimeout(context.Background(),
+						time.Duration(clnt.config.ClientTimeout)*time.Second)
+					_ = clnt.reportMetric(reqCtx, m)
+					cancel()
+				}
+			}()
+		}
+	}
+
 	<-ctx.Done()
 	wg.Wait()
+	if clnt.stream != nil {
+		clnt.stream.close(time.Duration(clnt.config.ClientTimeout) * time.Second)
+	}
+	if clnt.grpcConn != nil {
+		_ = clnt.grpcConn.Close()
+	}
 	return context.Canceled
 }
 
-func runtimeCollector(ctx context.Context, store storage, interval time.Duration) {
-	if interval <= 0 {
-		return
+// newCollectorRegistry registers the built-in, exec, scrape and probe collectors with the settings from the config.
+// Collectors without an interval run every PollInterval.
+func newCollectorRegistry(cfg *config.ClientConfig) *collector.Registry {
+	reg := collector.NewRegistry()
+	builtin := collector.Builtin()
+	limiter := collector.NewExecLimiter(cfg.ExecLimit)
+
+	names := make([]string, 0, len(cfg.Collectors))
+	for name := range cfg.Collectors {
+		names = append(names, name)
 	}
-	t := time.NewTicker(interval)
-	defer t.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			collectAndSave(ctx, store, collector.CollectRuntimeMetrics, "runtime")
+	sort.Strings(names)
+
+	for _, name := range names {
+		cc := cfg.Collectors[name]
+		var c collector.Collector
+		switch newCollector, ok := builtin[name]; {
+		case len(cc.Command) > 0:
+			c = collector.NewExecCollector(cc.Command, limiter)
+		case cc.URL != "":
+			sc, err := newScrapeCollector(name, cc)
+			if err != nil {
+				log.Printf("collector %s: %v, skipped", name, err)
+				continue
+			}
+			c = sc
+		case cc.Probe != "":
+			pc, err := collector.NewProbeCollector(cc.Probe, cc.Target, nil)
+			if err != nil {
+				log.Printf("collector %s: %v, skipped", name, err)
+				continue
+			}
+			c = pc
+		case ok:
+			c = newCollector()
+		default:
+			log.Printf("unknown collector %q, skipped", name)
+			continue
+		}
+		interval := cc.Interval
+		if interval <= 0 {
+			interval = cfg.PollInterval
+		}
+		s := collector.Settings{
+			Enabled:  cc.Enabled,
+			Interval: time.Duration(interval) * time.Second,
+			Timeout:  time.Duration(cc.Timeout) * time.Second,
+		}
+		if err := reg.Register(name, c, s); err != nil {
+			log.Printf("register collector: %v", err)
 		}
 	}
+	return reg
 }
 
-func gopsutilCollector(ctx context.Context, store storage, interval time.Duration) {
-	if interval <= 0 {
-		return
-	}
-	t := time.NewTicker(interval)
-	defer t.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			collectAndSave(ctx, store, collector.CollectGopsutilMetrics, "gopsutil")
+// newScrapeCollector creates a Prometheus scrape collector labeled with the collector name as job.
+func newScrapeCollector(name string, cc config.CollectorConfig) (*collector.ScrapeCollector, error) {
+	rules := make([]collector.Relabel, 0, len(cc.Relabel))
+	for _, r := range cc.Relabel {
+		rule, err := collector.NewRelabel(r.Action, r.SourceLabel, r.Regex, r.TargetLabel, r.Replacement)
+		if err != nil {
+			return nil, err
 		}
+		rules = append(rules, rule)
 	}
+	return collector.NewScrapeCollector(cc.URL, name, cc.Allow, rules)
 }
 
-func collectAndSave(ctx context.Context, store storage, collect func() []model.Metric, label string) {
-	if ctx.Err() != nil {
-		return
-	}
-	for _, m := range collect() {
+// collectAndSave saves metrics gathered by the named collector.
+func collectAndSave(ctx context.Context, store storage, label string, metrics []model.Metric) {
+	for _, m := range metrics {
 		if ctx.Err() != nil {
 			return
 		}
@@ -191,121 +315,296 @@ func dispatchMetrics(ctx context.Context, store storage, ch chan<- *model.Metric
 	}
 }
 
-func (clnt *Client) sendMetricToServer(ctx context.Context, m *model.Metric) error {
-	serverAddr := clnt.config.ServerAddr
-	httpClient := clnt.httpClient
+// reportBatches sends all stored metrics in batches with sendAll every interval and once more on shutdown.
+func (clnt *Client) reportBatches(ctx context.Context, interval time.Duration, sendAll func(ctx context.Context) error) {
+	send := func() {
+		reqCtx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(clnt.config.ClientTimeout)*time.Second)
+		defer cancel()
+		if err := sendAll(reqCtx); err != nil {
+			log.Printf("send batch: %v", err)
+		}
+	}
+
+	if interval <= 0 {
+		<-ctx.Done()
+		send()
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			send()
+		case <-ctx.Done():
+			send()
+			return
+		}
+	}
+}
 
-	bodyRaw, err := json.Marshal(m)
+// reportMetric sends a single metric. If the outbox is enabled, previously queued
+// batches are replayed first, so that older values don't overwrite the metric; while
+// they can't be replayed or another worker replays them, or if the metric fails to
+// send, the metric is queued behind them.
+// Counter deltas are reset once the metric is sent or queued.
+func (clnt *Client) reportMetric(ctx context.Context, m *model.Metric) error {
+	collected := time.Now()
+	if clnt.outbox != nil {
+		if err := clnt.replayOutbox(ctx); err != nil {
+			log.Printf("outbox replay: %v, queueing metric %s", err, m.ID)
+			return clnt.queueMetric(ctx, m, collected)
+		}
+	}
+
+	err := clnt.sendMetricToServer(ctx, m)
+	if err != nil && (clnt.outbox == nil || isPermanent(err)) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+		log.Printf("send metric %s: %v, queueing", m.ID, err)
+		return clnt.queueMetric(ctx, m, collected)
 	}
 
-	var body bytes.Buffer
-	zw := gzip.NewWriter(&body)
-	if _, err = zw.Write(bodyRaw); err != nil {
-		return fmt.Errorf("gzip write: %w", err)
+	clnt.ackCounters(ctx, []model.Metric{*m})
+	return nil
+}
+
+// queueMetric pushes the metric to the outbox as a single-metric batch stamped with
+// the time it was collected at.
+func (clnt *Client) queueMetric(ctx context.Context, m *model.Metric, collected time.Time) error {
+	queued := clnt.withHost(*m)
+	queued.Timestamp = &collected
+	bodyRaw, err := json.Marshal([]model.Metric{queued})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
 	}
-	if err = zw.Close(); err != nil {
-		return fmt.Errorf("gzip close: %w", err)
+	if err := clnt.outbox.Push(bodyRaw); err != nil {
+		return err
 	}
+	clnt.ackCounters(ctx, []model.Metric{*m})
+	return nil
+}
 
-	url := fmt.Sprintf("%s/update/", serverAddr)
-	req, err := http.NewRequest(http.MethodPost, url, &body)
+func (clnt *Client) sendMetricToServer(ctx context.Context, m *model.Metric) error {
+	bodyRaw, err := json.Marshal(clnt.withHost(*m))
 	if err != nil {
-		return fmt.Errorf("new request: %w", err)
+		return fmt.Errorf("marshal: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
+	return clnt.post(ctx, "/update/", bodyRaw)
+}
 
-	if clnt.config.Key != "" {
-		req.Header.Set("HashSHA256", utils.CalculateHash(body.Bytes(), clnt.config.Key))
+// sendToServer sends all stored metrics in one or more /updates/ batches
+// limited by MaxBatchSize and MaxBatchBytes.
+func (clnt *Client) sendToServer(ctx context.Context) error {
+	stored, batches, err := clnt.storedBatches(ctx)
+	if err != nil || len(batches) == 0 {
+		return err
 	}
 
-	var statusCode int
-	err = utils.WithRetry(ctx, func() error {
-		resp, reqErr := httpClient.Do(req)
-		if reqErr != nil {
-			return reqErr
+	if clnt.outbox != nil {
+		if err := clnt.replayOutbox(ctx); err != nil {
+			log.Printf("outbox replay: %v, queueing %d batches", err, len(batches))
+			if err := clnt.enqueue(batches); err != nil {
+				return err
+			}
+			clnt.ackCounters(ctx, stored)
+			return nil
 		}
-		defer resp.Body.Close()
+	}
 
-		_, err = io.Copy(io.Discard, resp.Body)
+	sent := 0
+	for i, b := range batches {
+		if err := clnt.post(ctx, "/updates/", b.body); err != nil {
+			if clnt.outbox == nil || isPermanent(err) {
+				clnt.ackCounters(ctx, stored[:sent])
+				return err
+			}
+			log.Printf("send batch: %v, queueing %d batches", err, len(batches)-i)
+			if err := clnt.enqueue(batches[i:]); err != nil {
+				clnt.ackCounters(ctx, stored[:sent])
+				return err
+			}
+			break
+		}
+		sent += b.n
+	}
+	clnt.ackCounters(ctx, stored)
+	return nil
+}
+
+// ackCounters subtracts reported counter deltas from the storage. Increments collected
+// while the report was in flight stay there and are sent with the next report.
+func (clnt *Client) ackCounters(ctx context.Context, reported []model.Metric) {
+	for _, m := range reported {
+		if m.Type != model.Counter || m.Delta == nil || *m.Delta == 0 {
+			continue
+		}
+		ack := model.Metric{ID: m.ID, Type: model.Counter, Delta: utils.I64Ptr(-*m.Delta), Labels: m.Labels}
+		if err := clnt.storage.Save(ctx, &ack); err != nil {
+			log.Printf("failed to reset reported counter %s: %v", m.ID, err)
+		}
+	}
+}
+
+// enqueue stores unsent batches in the outbox, their metrics stamped with the time
+// they were collected at, so that the server records them at that time when replayed.
+func (clnt *Client) enqueue(batches []batch) error {
+	for _, b := range batches {
+		metrics, err := decodePayload(b.body)
+		if err != nil {
+			return err
+		}
+		for i := range metrics {
+			metrics[i].Timestamp = &b.collected
+		}
+		bodyRaw, err := json.Marshal(metrics)
 		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		if err := clnt.outbox.Push(bodyRaw); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		statusCode = resp.StatusCode
-		return nil
+// replayOutbox resends queued batches in order. Batches rejected by the server are dropped.
+func (clnt *Client) replayOutbox(ctx context.Context) error {
+	return clnt.outbox.Replay(ctx, func(ctx context.Context, payload []byte) error {
+		err := clnt.post(ctx, "/updates/", payload)
+		if isPermanent(err) {
+			log.Printf("outbox: drop batch rejected by server: %v", err)
+			return nil
+		}
+		return err
 	})
+}
 
+// storedBatches returns all stored metrics ordered by key and their JSON batches
+// labeled with the host, limited by MaxBatchSize and MaxBatchBytes.
+func (clnt *Client) storedBatches(ctx context.Context) ([]model.Metric, []batch, error) {
+	all, err := clnt.storage.GetAll(ctx)
 	if err != nil {
-		return fmt.Errorf("send request: %w", err)
+		return nil, nil, fmt.Errorf("internal error: %w", err)
 	}
 
-	if statusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", statusCode)
+	if len(all) == 0 {
+		return nil, nil, nil
 	}
 
-	return nil
-}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-func (clnt *Client) sendToServer(ctx context.Context) error {
-	store := clnt.storage
-	serverAddr := clnt.config.ServerAddr
-	httpClient := clnt.httpClient
+	collected := time.Now()
+	stored := make([]model.Metric, 0, len(all))
+	metrics := make([]model.Metric, 0, len(all))
+	for _, k := range keys {
+		stored = append(stored, *all[k])
+		metrics = append(metrics, clnt.withHost(*all[k]))
+	}
 
-	all, err := store.GetAll(ctx)
+	batches, err := encodeBatches(metrics, clnt.config.MaxBatchSize, clnt.config.MaxBatchBytes)
 	if err != nil {
-		return fmt.Errorf("internal error: %w", err)
+		return nil, nil, err
+	}
+	for i := range batches {
+		batches[i].collected = collected
 	}
+	return stored, batches, nil
+}
 
-	if len(all) == 0 {
-		return nil
+// batch is an encoded JSON array of metrics.
+type batch struct {
+	body      []byte
+	n         int       // number of metrics in body
+	collected time.Time // time the metrics were read from the storage
+}
+
+// encodeBatches marshals metrics into JSON arrays of at most maxSize metrics and
+// maxBytes bytes each. Non-positive limits are ignored; a metric larger than maxBytes
+// is sent in a batch of its own.
+func encodeBatches(metrics []model.Metric, maxSize, maxBytes int) ([]batch, error) {
+	var (
+		batches []batch
+		cur     []byte
+		count   int
+	)
+	flush := func() {
+		if count > 0 {
+			batches = append(batches, batch{body: append(cur, ']'), n: count})
+		}
+		cur, count = nil, 0
 	}
 
-	metrics := make([]model.Metric, 0, len(all))
-	for _, m := range all {
-		metrics = append(metrics, *m)
+	for i := range metrics {
+		item, err := json.Marshal(metrics[i])
+		if err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+		if count > 0 && ((maxSize > 0 && count >= maxSize) || (maxBytes > 0 && len(cur)+1+len(item)+1 > maxBytes)) {
+			flush()
+		}
+		if count == 0 {
+			cur = append(cur, '[')
+		} else {
+			cur = append(cur, ',')
+		}
+		cur = append(cur, item...)
+		count++
 	}
+	flush()
 
-	bodyRaw, err := json.Marshal(metrics)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+	return batches, nil
+}
+
+// post sends a JSON body to the server path: gzipped over HTTP, expecting 200 OK,
+// or with UpdateMetrics over gRPC.
+func (clnt *Client) post(ctx context.Context, path string, bodyRaw []byte) error {
+	if clnt.grpcClient != nil {
+		return clnt.sendGRPC(ctx, bodyRaw)
 	}
 
 	var body bytes.Buffer
 	zw := gzip.NewWriter(&body)
-	if _, err = zw.Write(bodyRaw); err != nil {
+	if _, err := zw.Write(bodyRaw); err != nil {
 		return fmt.Errorf("gzip write: %w", err)
 	}
-	if err = zw.Close(); err != nil {
+	if err := zw.Close(); err != nil {
 		return fmt.Errorf("gzip close: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/updates/", serverAddr)
-	req, err := http.NewRequest(http.MethodPost, url, &body)
-	if err != nil {
-		return fmt.Errorf("new request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-
+	var hash string
 	if clnt.config.Key != "" {
-		req.Header.Set("HashSHA256", utils.CalculateHash(body.Bytes(), clnt.config.Key))
+		hash = utils.CalculateHash(body.Bytes(), clnt.config.Key)
 	}
 
 	var statusCode int
-	err = utils.WithRetry(ctx, func() error {
-		resp, reqErr := httpClient.Do(req)
-		if reqErr != nil {
-			return reqErr
+	err := utils.WithRetry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, clnt.config.ServerAddr+path, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return fmt.Errorf("new request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		clnt.setAgentHeaders(req)
+		if hash != "" {
+			req.Header.Set("HashSHA256", hash)
 		}
-		defer resp.Body.Close()
 
-		_, err = io.Copy(io.Discard, resp.Body)
+		resp, err := clnt.httpClient.Do(req)
 		if err != nil {
 			return err
 		}
+		defer resp.Body.Close()
+
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return err
+		}
 
 		statusCode = resp.StatusCode
 		return nil
@@ -316,8 +615,23 @@ func (clnt *Client) sendToServer(ctx context.Context) error {
 	}
 
 	if statusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", statusCode)
+		return &statusError{code: statusCode}
 	}
 
 	return nil
 }
+
+// statusError reports an unexpected HTTP status returned by the server.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %d", e.code)
+}
+
+// isPermanent reports whether resending the same request cannot succeed.
+func isPermanent(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code >= 400 && se.code < 500 || isPermanentGRPC(err)
+}
@@ -3,13 +3,18 @@ package client
 import (
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/and161185/metrics-alerting/cmd/agent/collector"
 	"github.com/and161185/metrics-alerting/internal/config"
 	"github.com/and161185/metrics-alerting/internal/utils"
 	"github.com/and161185/metrics-alerting/model"
@@ -96,6 +101,49 @@ func TestSendMetricToServer_OK(t *testing.T) {
 	require.NoError(t, c.sendMetricToServer(ctx, m))
 }
 
+func TestSendMetricToServer_HostLabel(t *testing.T) {
+	ctx := context.Background()
+	var got model.Metric
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(gr).Decode(&got))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := NewClientWithHTTP(inmemory.NewMemStorage(ctx), &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	c.hostname = "web-1"
+
+	m := &model.Metric{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(1), Labels: map[string]string{"core": "1"}}
+	require.NoError(t, c.sendMetricToServer(ctx, m))
+	require.Equal(t, map[string]string{"core": "1", "host": "web-1"}, got.Labels)
+	require.Equal(t, map[string]string{"core": "1"}, m.Labels, "source metric must not be modified")
+}
+
+func TestSendToServer_AgentHeaders(t *testing.T) {
+	ctx := context.Background()
+	var paths, ids, intervals []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		ids = append(ids, r.Header.Get("X-Agent-ID"))
+		intervals = append(intervals, r.Header.Get("X-Report-Interval"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorage(ctx)
+	m := &model.Metric{ID: "X", Type: model.Gauge, Value: utils.F64Ptr(1)}
+	require.NoError(t, st.Save(ctx, m))
+
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1, AgentID: "agent-7", ReportInterval: 5}, ts.Client())
+	require.NoError(t, c.sendMetricToServer(ctx, m))
+	require.NoError(t, c.sendToServer(ctx))
+	require.Equal(t, []string{"/update/", "/updates/"}, paths)
+	require.Equal(t, []string{"agent-7", "agent-7"}, ids)
+	require.Equal(t, []string{"5", "5"}, intervals)
+}
+
 func TestSendMetricToServer_Error(t *testing.T) {
 	ctx := context.Background()
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -118,10 +166,7 @@ func TestSendMetricToServer_Error(t *testing.T) {
 func TestCollectAndSave(t *testing.T) {
 	ctx := context.Background()
 	st := inmemory.NewMemStorage(ctx)
-	collect := func() []model.Metric {
-		return []model.Metric{{ID: "m1", Type: model.Gauge, Value: utils.F64Ptr(10)}}
-	}
-	collectAndSave(ctx, st, collect, "label")
+	collectAndSave(ctx, st, "label", []model.Metric{{ID: "m1", Type: model.Gauge, Value: utils.F64Ptr(10)}})
 	all, _ := st.GetAll(ctx)
 	require.Contains(t, all, "m1")
 }
@@ -129,9 +174,7 @@ func TestCollectAndSave(t *testing.T) {
 func TestCollectAndSave_SaveError(t *testing.T) {
 	ctx := context.Background()
 	st := &errStorage{}
-	collectAndSave(ctx, st, func() []model.Metric {
-		return []model.Metric{{ID: "bad", Type: model.Gauge, Value: utils.F64Ptr(1)}}
-	}, "test")
+	collectAndSave(ctx, st, "test", []model.Metric{{ID: "bad", Type: model.Gauge, Value: utils.F64Ptr(1)}})
 }
 
 func TestDispatchMetrics_OK(t *testing.T) {
@@ -161,25 +204,103 @@ func TestDispatchMetrics_GetAllError(t *testing.T) {
 	<-ctx.Done()
 }
 
-func TestRuntimeCollector_Saves(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+func TestCollectorRegistry_Saves(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer cancel()
 	st := inmemory.NewMemStorage(ctx)
-	go runtimeCollector(ctx, st, 10*time.Millisecond)
-	time.Sleep(20 * time.Millisecond)
-	all, _ := st.GetAll(ctx)
-	require.NotEmpty(t, all)
+
+	reg := collector.NewRegistry()
+	require.NoError(t, reg.Register("runtime", collector.NewRuntimeCollector(),
+		collector.Settings{Enabled: true, Interval: 10 * time.Millisecond}))
+	go reg.Run(ctx, func(ctx context.Context, name string, metrics []model.Metric) {
+		collectAndSave(ctx, st, name, metrics)
+	})
+
+	require.Eventually(t, func() bool {
+		all, _ := st.GetAll(ctx)
+		_, ok := all[model.SeriesKey(collector.ErrorsMetric, map[string]string{"collector": "runtime"})]
+		return ok && all["PollCount"] != nil
+	}, 150*time.Millisecond, 5*time.Millisecond)
 }
 
-func TestGopsutilCollector_Saves(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+func TestNewCollectorRegistry(t *testing.T) {
+	reg := newCollectorRegistry(&config.ClientConfig{
+		PollInterval: 2,
+		Collectors: map[string]config.CollectorConfig{
+			"runtime": {Enabled: true},
+			"disk":    {Enabled: true, Interval: 30, Timeout: 5},
+			"net":     {Enabled: false},
+			"unknown": {Enabled: true},
+		},
+	})
+	require.Equal(t, []string{"disk", "runtime"}, reg.Enabled())
+
+	require.Empty(t, newCollectorRegistry(&config.ClientConfig{PollInterval: 2}).Enabled())
+}
+
+func TestNewCollectorRegistry_Scrape(t *testing.T) {
+	reg := newCollectorRegistry(&config.ClientConfig{
+		PollInterval: 1,
+		Collectors: map[string]config.CollectorConfig{
+			"app": {Enabled: true, URL: "http://localhost:9100/metrics", Allow: []string{"app_.*"},
+				Relabel: []config.RelabelConfig{{Action: "labeldrop", Regex: "instance"}}},
+			"bad": {Enabled: true, URL: "http://localhost:9100/metrics",
+				Relabel: []config.RelabelConfig{{Action: "explode"}}},
+		},
+	})
+	require.Equal(t, []string{"app"}, reg.Enabled())
+}
+
+func TestNewCollectorRegistry_Probe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	st := inmemory.NewMemStorage(ctx)
-	go gopsutilCollector(ctx, st, 10*time.Millisecond)
-	time.Sleep(20 * time.Millisecond)
-	all, _ := st.GetAll(ctx)
 
-	_ = all
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	reg := newCollectorRegistry(&config.ClientConfig{
+		PollInterval: 1,
+		Collectors: map[string]config.CollectorConfig{
+			"site":  {Enabled: true, Probe: "http", Target: ts.URL},
+			"bogus": {Enabled: true, Probe: "icmp", Target: "localhost"},
+		},
+	})
+	require.Equal(t, []string{"site"}, reg.Enabled())
+
+	go reg.Run(ctx, func(ctx context.Context, name string, metrics []model.Metric) {
+		collectAndSave(ctx, st, name, metrics)
+	})
+
+	require.Eventually(t, func() bool {
+		m, err := st.Get(ctx, &model.Metric{ID: collector.ProbeSuccessMetric, Type: model.Gauge,
+			Labels: map[string]string{collector.ProbeTargetLabel: ts.URL}})
+		return err == nil && *m.Value == 1
+	}, 1900*time.Millisecond, 20*time.Millisecond)
+}
+
+func TestNewCollectorRegistry_Exec(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	st := inmemory.NewMemStorage(ctx)
+
+	reg := newCollectorRegistry(&config.ClientConfig{
+		PollInterval: 1,
+		ExecLimit:    1,
+		Collectors: map[string]config.CollectorConfig{
+			"script": {Enabled: true, Command: []string{"sh", "-c", "echo 'QueueDepth gauge 7'"}},
+		},
+	})
+	require.Equal(t, []string{"script"}, reg.Enabled())
+
+	go reg.Run(ctx, func(ctx context.Context, name string, metrics []model.Metric) {
+		collectAndSave(ctx, st, name, metrics)
+	})
+
+	require.Eventually(t, func() bool {
+		m, err := st.Get(ctx, &model.Metric{ID: "QueueDepth", Type: model.Gauge})
+		return err == nil && m.Value != nil && *m.Value == 7
+	}, 1900*time.Millisecond, 20*time.Millisecond)
 }
 
 func TestClientRun_StartsAndStops(t *testing.T) {
@@ -194,3 +315,288 @@ func TestClientRun_StartsAndStops(t *testing.T) {
 	err = c.Run(ctx)
 	require.ErrorIs(t, err, context.Canceled)
 }
+
+func TestEncodeBatches(t *testing.T) {
+	metrics := []model.Metric{
+		{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)},
+		{ID: "b", Type: model.Gauge, Value: utils.F64Ptr(2)},
+		{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(3)},
+	}
+
+	decode := func(b batch) []model.Metric {
+		var res []model.Metric
+		require.NoError(t, json.Unmarshal(b.body, &res))
+		require.Equal(t, len(res), b.n)
+		return res
+	}
+
+	batches, err := encodeBatches(metrics, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, metrics, decode(batches[0]))
+
+	batches, err = encodeBatches(metrics, 2, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	require.Equal(t, metrics[:2], decode(batches[0]))
+	require.Equal(t, metrics[2:], decode(batches[1]))
+
+	one, _ := json.Marshal(metrics[:1])
+	batches, err = encodeBatches(metrics, 0, len(one)+5)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+	for i, b := range batches {
+		require.LessOrEqual(t, len(b.body), len(one)+5)
+		require.Equal(t, metrics[i:i+1], decode(b))
+	}
+
+	batches, err = encodeBatches(metrics, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, batches, 3, "oversized metrics are sent one per batch")
+
+	batches, err = encodeBatches(nil, 10, 10)
+	require.NoError(t, err)
+	require.Empty(t, batches)
+}
+
+func TestSendToServer_SplitsBatches(t *testing.T) {
+	ctx := context.Background()
+	var sizes []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/updates/", r.URL.Path)
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []model.Metric
+		require.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		sizes = append(sizes, len(batch))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorage(ctx)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, st.Save(ctx, &model.Metric{ID: id, Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	}
+
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1, MaxBatchSize: 2}, ts.Client())
+	require.NoError(t, c.sendToServer(ctx))
+	require.Equal(t, []int{2, 2, 1}, sizes)
+}
+
+func TestClientRun_BatchMode(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	st := inmemory.NewMemStorage(ctx)
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "b", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+
+	cfg := &config.ClientConfig{ServerAddr: ts.URL, RateLimit: 1, ClientTimeout: 1, SendMode: config.SendModeBatch}
+	c := NewClientWithHTTP(st, cfg, ts.Client())
+
+	cancel()
+	require.ErrorIs(t, c.Run(ctx), context.Canceled)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"/updates/"}, paths, "final flush sends a single batch")
+}
+
+func TestSendToServer_OutboxReplaysAfterOutage(t *testing.T) {
+	ctx := context.Background()
+	var (
+		down     = true
+		received []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []model.Metric
+		require.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		for _, m := range batch {
+			received = append(received, fmt.Sprintf("%s=%v", m.ID, *m.Value))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorage(ctx)
+	ob, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	c.outbox = ob
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	require.NoError(t, c.sendToServer(ctx))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	require.NoError(t, c.sendToServer(ctx))
+	require.Equal(t, 2, ob.Len())
+	require.Empty(t, received)
+
+	down = false
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(3)}))
+	require.NoError(t, c.sendToServer(ctx))
+	require.Zero(t, ob.Len())
+	require.Equal(t, []string{"a=1", "a=2", "a=3"}, received)
+}
+
+func TestReportMetric_Outbox(t *testing.T) {
+	ctx := context.Background()
+	status := http.StatusServiceUnavailable
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	ob, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	c := NewClientWithHTTP(inmemory.NewMemStorage(ctx), &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	c.outbox = ob
+
+	m := &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}
+	require.NoError(t, c.reportMetric(ctx, m), "queued metric counts as reported")
+	require.Equal(t, 1, ob.Len())
+
+	paths = nil
+	require.NoError(t, c.reportMetric(ctx, m))
+	require.Equal(t, 2, ob.Len())
+	require.Equal(t, []string{"/updates/"}, paths, "metric is queued without a send while the outbox can't be replayed")
+
+	status = http.StatusOK
+	paths = nil
+	require.NoError(t, c.reportMetric(ctx, m))
+	require.Zero(t, ob.Len())
+	require.Equal(t, []string{"/updates/", "/updates/", "/update/"}, paths, "queued batches are replayed before the new metric")
+
+	status = http.StatusBadRequest
+	require.Error(t, c.reportMetric(ctx, m), "rejected metric is not queued")
+	require.Zero(t, ob.Len())
+}
+
+func TestOutbox_ReplaysCollectionTime(t *testing.T) {
+	ctx := context.Background()
+	down := true
+	var replayed []model.Metric
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		if r.URL.Path == "/updates/" {
+			var batch []model.Metric
+			require.NoError(t, json.NewDecoder(gr).Decode(&batch))
+			replayed = append(replayed, batch...)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorage(ctx)
+	ob, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	c.outbox = ob
+
+	before := time.Now()
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	require.NoError(t, c.sendToServer(ctx))
+	require.NoError(t, c.reportMetric(ctx, &model.Metric{ID: "b", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	after := time.Now()
+
+	down = false
+	require.NoError(t, c.sendToServer(ctx))
+	require.GreaterOrEqual(t, len(replayed), 2)
+	for _, m := range replayed[:2] {
+		require.NotNil(t, m.Timestamp, "queued metric %s keeps its collection time", m.ID)
+		require.False(t, m.Timestamp.Before(before))
+		require.False(t, m.Timestamp.After(after))
+	}
+}
+
+func TestNewClient_OpensOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	c, err := NewClient(inmemory.NewMemStorage(context.Background()), &config.ClientConfig{OutboxDir: dir})
+	require.NoError(t, err)
+	require.NotNil(t, c.outbox)
+	require.DirExists(t, dir)
+}
+
+func TestSendToServer_ResetsReportedCounters(t *testing.T) {
+	ctx := context.Background()
+	status := http.StatusOK
+	var got []int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []model.Metric
+		require.NoError(t, json.NewDecoder(gr).Decode(&batch))
+		if status == http.StatusOK {
+			got = append(got, *batch[0].Delta)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorageWithHistory(ctx, 0)
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	poll := func(n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, st.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(1)}))
+		}
+	}
+
+	poll(3)
+	require.NoError(t, c.sendToServer(ctx))
+
+	poll(2)
+	status = http.StatusInternalServerError
+	require.Error(t, c.sendToServer(ctx))
+
+	poll(1)
+	status = http.StatusOK
+	require.NoError(t, c.sendToServer(ctx))
+	require.NoError(t, c.sendToServer(ctx))
+
+	require.Equal(t, []int64{3, 3, 0}, got, "deltas are kept until a send succeeds")
+}
+
+func TestReportMetric_ResetsCounter(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	st := inmemory.NewMemStorageWithHistory(ctx, 0)
+	c := NewClientWithHTTP(st, &config.ClientConfig{ServerAddr: ts.URL, ClientTimeout: 1}, ts.Client())
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(5)}))
+
+	all, err := st.GetAll(ctx)
+	require.NoError(t, err)
+	m := all["PollCount"]
+
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(2)}))
+	require.NoError(t, c.reportMetric(ctx, m))
+
+	left, err := st.Get(ctx, &model.Metric{ID: "PollCount", Type: model.Counter})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, *left.Delta, "polls made during the send are kept")
+}
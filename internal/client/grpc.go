@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/and161185/metrics-alerting/internal/client/transport"
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCDialOptions returns the options of the agent gRPC connection: requests are
+// signed with the hash key and encrypted with the public key, like HTTP requests.
+func GRPCDialOptions(cfg *config.ClientConfig) ([]grpc.DialOption, error) {
+	var pub *rsa.PublicKey
+	if cfg.CryptoKeyPath != "" {
+		var err error
+		pub, err = crypto.LoadPublicKey(cfg.CryptoKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load public key: %w", err)
+		}
+	}
+	encrypt, encryptStream := transport.EncryptInterceptor(pub), transport.EncryptStreamInterceptor(pub)
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// the hash covers the request before encryption, as the server verifies it after decryption
+		grpc.WithChainUnaryInterceptor(transport.HashInterceptor(cfg.Key), encrypt),
+		grpc.WithChainStreamInterceptor(transport.HashStreamInterceptor(cfg.Key), encryptStream),
+	}, nil
+}
+
+// newGRPCConn connects to the gRPC server at GRPCAddr.
+func newGRPCConn(cfg *config.ClientConfig) (*grpc.ClientConn, error) {
+	opts, err := GRPCDialOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(cfg.GRPCAddr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("grpc client: %w", err)
+	}
+	return conn, nil
+}
+
+// NewClientWithGRPC creates a client sending metrics over a ready gRPC connection,
+// e.g. one created with GRPCDialOptions. Run streams batches over the connection
+// with at most RateLimit batches waiting for an ack.
+func NewClientWithGRPC(s storage, cfg *config.ClientConfig, conn grpc.ClientConnInterface) *Client {
+	clnt := NewClientWithHTTP(s, cfg, nil)
+	clnt.grpcClient = pb.NewMetricsClient(conn)
+	clnt.stream = newMetricStream(clnt.grpcClient, cfg.RateLimit, clnt.agentMetadata)
+	return clnt
+}
+
+// sendGRPC sends a JSON payload, a metric or an array of metrics, with UpdateMetrics.
+// Payloads are JSON so that outbox batches can be replayed over either transport.
+func (clnt *Client) sendGRPC(ctx context.Context, bodyRaw []byte) error {
+	metrics, err := decodePayload(bodyRaw)
+	if err != nil {
+		return err
+	}
+
+	req := &pb.UpdateMetricsRequest{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		req.Metrics = append(req.Metrics, pb.FromModel(m))
+	}
+
+	if _, err := clnt.grpcClient.UpdateMetrics(clnt.agentMetadata(ctx), req); err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	return nil
+}
+
+// decodePayload decodes a JSON payload holding a metric or an array of metrics.
+func decodePayload(bodyRaw []byte) ([]model.Metric, error) {
+	var metrics []model.Metric
+	if len(bodyRaw) > 0 && bodyRaw[0] == '{' {
+		var m model.Metric
+		if err := json.Unmarshal(bodyRaw, &m); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		return append(metrics, m), nil
+	}
+	if err := json.Unmarshal(bodyRaw, &metrics); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return metrics, nil
+}
+
+// agentMetadata identifies the agent and its report interval to the gRPC server.
+func (clnt *Client) agentMetadata(ctx context.Context) context.Context {
+	if clnt.config.AgentID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-agent-id", clnt.config.AgentID)
+	}
+	if clnt.config.ReportInterval > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-report-interval", strconv.Itoa(clnt.config.ReportInterval))
+	}
+	return ctx
+}
+
+// isPermanentGRPC reports whether the gRPC server rejected the request itself.
+func isPermanentGRPC(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.PermissionDenied,
+		codes.Unauthenticated, codes.Unimplemented, codes.OutOfRange:
+		return true
+	}
+	return false
+}
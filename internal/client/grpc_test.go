@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeMetricsServer records UpdateMetrics calls and StreamMetrics batches.
+type fakeMetricsServer struct {
+	pb.UnimplementedMetricsServer
+
+	mu       sync.Mutex
+	requests []*pb.UpdateMetricsRequest
+	md       []metadata.MD
+	err      error
+
+	batches []*pb.StreamMetricsRequest
+	release chan struct{}    // when set, each batch waits for a value before it is acked
+	nack    map[uint64]error // errors acked for batch numbers
+}
+
+func (s *fakeMetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.requests = append(s.requests, req)
+	s.md = append(s.md, md)
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+// dialBufconn serves fake in memory and returns a connection made with the agent dial options.
+func dialBufconn(t *testing.T, cfg *config.ClientConfig, fake *fakeMetricsServer) *grpc.ClientConn {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterMetricsServer(s, fake)
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(s.Stop)
+
+	opts, err := GRPCDialOptions(cfg)
+	require.NoError(t, err)
+	opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }))
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestGRPCTransport_SendToServer(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClientConfig{Transport: config.TransportGRPC, AgentID: "agent-7", ReportInterval: 5, Key: "secret", MaxBatchSize: 1}
+	fake := &fakeMetricsServer{}
+
+	st := inmemory.NewMemStorage(ctx)
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1.5)}))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "b", Type: model.Counter, Delta: utils.I64Ptr(4)}))
+
+	c := NewClientWithGRPC(st, cfg, dialBufconn(t, cfg, fake))
+	c.hostname = "web-1"
+	require.NoError(t, c.sendToServer(ctx))
+
+	require.Len(t, fake.requests, 2, "one request per batch")
+	require.Equal(t, &pb.Metric{Id: "a", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 1.5, Labels: map[string]string{"host": "web-1"}},
+		fake.requests[0].GetMetrics()[0])
+	require.EqualValues(t, 4, fake.requests[1].GetMetrics()[0].GetDelta())
+	require.Equal(t, []string{"agent-7"}, fake.md[0].Get("x-agent-id"))
+	require.Equal(t, []string{"5"}, fake.md[0].Get("x-report-interval"))
+	require.NotEmpty(t, fake.md[0].Get("hashsha256"))
+
+	m, err := st.Get(ctx, &model.Metric{ID: "b", Type: model.Counter})
+	require.NoError(t, err)
+	require.Zero(t, *m.Delta, "reported counter is reset")
+
+	require.NoError(t, c.reportMetric(ctx, &model.Metric{ID: "c", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	require.Len(t, fake.requests, 3)
+	require.Equal(t, "c", fake.requests[2].GetMetrics()[0].GetId())
+}
+
+func TestGRPCTransport_Errors(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClientConfig{Transport: config.TransportGRPC}
+	fake := &fakeMetricsServer{err: status.Error(codes.InvalidArgument, "bad metric")}
+	c := NewClientWithGRPC(inmemory.NewMemStorage(ctx), cfg, dialBufconn(t, cfg, fake))
+
+	err := c.reportMetric(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)})
+	require.Error(t, err)
+	require.True(t, isPermanent(err))
+
+	fake.err = status.Error(codes.Unavailable, "later")
+	err = c.reportMetric(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)})
+	require.Error(t, err)
+	require.False(t, isPermanent(err))
+}
+
+func TestNewClient_GRPCTransport(t *testing.T) {
+	c, err := NewClient(inmemory.NewMemStorage(context.Background()),
+		&config.ClientConfig{Transport: config.TransportGRPC, GRPCAddr: "localhost:0"})
+	require.NoError(t, err)
+	require.NotNil(t, c.grpcClient)
+	require.NoError(t, c.grpcConn.Close())
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt    = ".seg"
+	segmentTmpExt = ".tmp"
+	segmentHeader = 12 // magic + payload length + checksum
+)
+
+var (
+	segmentMagic = [4]byte{'M', 'O', 'B', '1'}
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorruptSegment is returned when a segment file fails validation.
+	ErrCorruptSegment = errors.New("corrupt outbox segment")
+	// ErrReplayInProgress is returned by Replay while another replay is running.
+	ErrReplayInProgress = errors.New("outbox replay in progress")
+)
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Outbox is a persistent FIFO queue of unsent metric batches.
+// Every batch is stored in its own segment file: a 4-byte magic, the big-endian
+// payload length and CRC-32C checksum, followed by the payload.
+// When the total size exceeds the limit, the oldest segments are evicted.
+type Outbox struct {
+	dir      string
+	maxBytes int64
+
+	replayMu sync.Mutex // held while replaying, so batches are not sent twice
+
+	mu       sync.Mutex
+	segments []segment // oldest first
+	size     int64
+	nextSeq  uint64
+}
+
+// OpenOutbox opens the outbox in dir, creating the directory if needed.
+// Leftovers of interrupted writes are removed. maxBytes <= 0 means no limit.
+func OpenOutbox(dir string, maxBytes int64) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create outbox dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read outbox dir: %w", err)
+	}
+
+	o := &Outbox{dir: dir, maxBytes: maxBytes}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, segmentTmpExt) {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat outbox segment: %w", err)
+		}
+		o.segments = append(o.segments, segment{seq: seq, size: info.Size()})
+		o.size += info.Size()
+	}
+
+	sort.Slice(o.segments, func(i, j int) bool { return o.segments[i].seq < o.segments[j].seq })
+	if n := len(o.segments); n > 0 {
+		o.nextSeq = o.segments[n-1].seq + 1
+	}
+
+	o.mu.Lock()
+	o.evict()
+	o.mu.Unlock()
+
+	return o, nil
+}
+
+// Len returns the number of queued batches.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.segments)
+}
+
+// Size returns the total size of queued segments in bytes.
+func (o *Outbox) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size
+}
+
+// Push appends a batch to the queue and evicts the oldest batches if the size limit is exceeded.
+func (o *Outbox) Push(payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	seq := o.nextSeq
+	path := o.path(seq)
+	tmp := path + segmentTmpExt
+
+	buf := make([]byte, segmentHeader+len(payload))
+	copy(buf, segmentMagic[:])
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(payload, crcTable))
+	copy(buf[segmentHeader:], payload)
+
+	if err := writeFileSync(tmp, buf); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write outbox segment: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("commit outbox segment: %w", err)
+	}
+
+	o.nextSeq++
+	o.segments = append(o.segments, segment{seq: seq, size: int64(len(buf))})
+	o.size += int64(len(buf))
+	o.evict()
+	return nil
+}
+
+// Replay sends queued batches oldest first and removes each one once send succeeds.
+// It stops at the first send error, keeping that batch and the rest for the next replay.
+// Corrupt segments are dropped. Concurrent calls return ErrReplayInProgress while a
+// replay is running, so that callers queue new batches behind the older ones.
+func (o *Outbox) Replay(ctx context.Context, send func(ctx context.Context, payload []byte) error) error {
+	if !o.replayMu.TryLock() {
+		return ErrReplayInProgress
+	}
+	defer o.replayMu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		o.mu.Lock()
+		if len(o.segments) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		seg := o.segments[0]
+		o.mu.Unlock()
+
+		payload, err := readSegment(o.path(seg.seq))
+		if err == nil {
+			if err := send(ctx, payload); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("outbox: drop segment %d: %v", seg.seq, err)
+		}
+
+		o.mu.Lock()
+		o.remove(seg.seq)
+		o.mu.Unlock()
+	}
+}
+
+// evict removes the oldest segments until the size limit is met.
+// Callers must hold o.mu.
+func (o *Outbox) evict() {
+	if o.maxBytes <= 0 {
+		return
+	}
+	for o.size > o.maxBytes && len(o.segments) > 0 {
+		seg := o.segments[0]
+		log.Printf("outbox: size limit %d exceeded, evict segment %d", o.maxBytes, seg.seq)
+		o.remove(seg.seq)
+	}
+}
+
+// remove deletes the segment if it is still queued. Callers must hold o.mu.
+func (o *Outbox) remove(seq uint64) {
+	for i, seg := range o.segments {
+		if seg.seq != seq {
+			continue
+		}
+		if err := os.Remove(o.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("outbox: remove segment %d: %v", seq, err)
+		}
+		o.size -= seg.size
+		o.segments = append(o.segments[:i], o.segments[i+1:]...)
+		return
+	}
+}
+
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%016x%s", seq, segmentExt))
+}
+
+// readSegment reads a segment file and verifies its checksum.
+func readSegment(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < segmentHeader || [4]byte(b[:4]) != segmentMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrCorruptSegment)
+	}
+	n := binary.BigEndian.Uint32(b[4:])
+	payload := b[segmentHeader:]
+	if uint32(len(payload)) != n {
+		return nil, fmt.Errorf("%w: length %d, want %d", ErrCorruptSegment, len(payload), n)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(b[8:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSegment)
+	}
+	return payload, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
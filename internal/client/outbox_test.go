@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collect(t *testing.T, o *Outbox) []string {
+	t.Helper()
+	var got []string
+	require.NoError(t, o.Replay(context.Background(), func(_ context.Context, p []byte) error {
+		got = append(got, string(p))
+		return nil
+	}))
+	return got
+}
+
+func TestOutbox_PushReplayInOrder(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	for _, p := range []string{"a", "b", "c"} {
+		require.NoError(t, o.Push([]byte(p)))
+	}
+	require.Equal(t, 3, o.Len())
+	require.Equal(t, int64(3*(segmentHeader+1)), o.Size())
+
+	require.Equal(t, []string{"a", "b", "c"}, collect(t, o))
+	require.Zero(t, o.Len())
+	require.Zero(t, o.Size())
+}
+
+func TestOutbox_ReplayStopsOnError(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push([]byte("a")))
+	require.NoError(t, o.Push([]byte("b")))
+
+	errDown := errors.New("down")
+	var sent []string
+	err = o.Replay(context.Background(), func(_ context.Context, p []byte) error {
+		if string(p) == "b" {
+			return errDown
+		}
+		sent = append(sent, string(p))
+		return nil
+	})
+	require.ErrorIs(t, err, errDown)
+	require.Equal(t, []string{"a"}, sent)
+	require.Equal(t, 1, o.Len())
+
+	require.NoError(t, o.Push([]byte("c")))
+	require.Equal(t, []string{"b", "c"}, collect(t, o))
+}
+
+func TestOutbox_ConcurrentReplay(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push([]byte("a")))
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- o.Replay(context.Background(), func(_ context.Context, p []byte) error {
+			close(sending)
+			<-release
+			return nil
+		})
+	}()
+
+	<-sending
+	err = o.Replay(context.Background(), func(context.Context, []byte) error { return nil })
+	require.ErrorIs(t, err, ErrReplayInProgress)
+	close(release)
+	require.NoError(t, <-done)
+	require.Zero(t, o.Len())
+}
+
+func TestOutbox_PersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	o, err := OpenOutbox(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push([]byte("a")))
+	require.NoError(t, o.Push([]byte("b")))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0000000000000002.seg.tmp"), []byte("partial"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o644))
+
+	o, err = OpenOutbox(dir, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, o.Len())
+	require.NoError(t, o.Push([]byte("c")))
+	require.Equal(t, []string{"a", "b", "c"}, collect(t, o))
+
+	_, err = os.Stat(filepath.Join(dir, "0000000000000002.seg.tmp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOutbox_DropsCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	o, err := OpenOutbox(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, o.Push([]byte("good")))
+	require.NoError(t, o.Push([]byte("bad!")))
+	require.NoError(t, o.Push([]byte("tail")))
+
+	path := o.path(1)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0o644))
+
+	_, err = readSegment(path)
+	require.ErrorIs(t, err, ErrCorruptSegment)
+
+	require.Equal(t, []string{"good", "tail"}, collect(t, o))
+	require.Zero(t, o.Len())
+}
+
+func TestOutbox_EvictsOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	segSize := int64(segmentHeader + 4)
+	o, err := OpenOutbox(dir, 2*segSize)
+	require.NoError(t, err)
+
+	for _, p := range []string{"aaaa", "bbbb", "cccc"} {
+		require.NoError(t, o.Push([]byte(p)))
+	}
+	require.Equal(t, 2, o.Len())
+	require.Equal(t, 2*segSize, o.Size())
+
+	o, err = OpenOutbox(dir, segSize)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cccc"}, collect(t, o))
+}
@@ -0,0 +1,266 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	// StatsDErrorsMetric counts StatsD lines that could not be parsed.
+	StatsDErrorsMetric = "StatsDErrors"
+
+	statsdMaxPacket = 64 << 10
+	timerStatLabel  = "stat"
+)
+
+// statsdSample is a single parsed StatsD line.
+type statsdSample struct {
+	name     string
+	kind     string // "c", "g", "ms" or "h"
+	value    float64
+	relative bool // gauge value with an explicit sign adjusts the current value
+	rate     float64
+	labels   map[string]string
+}
+
+// timerStats aggregates timer samples between flushes.
+type timerStats struct {
+	name     string
+	labels   map[string]string
+	count    int64
+	sum      float64
+	min, max float64
+}
+
+// StatsDListener receives metrics in the StatsD line protocol over UDP and saves them
+// to the agent storage. Counters and gauges are saved on receipt; counter deltas
+// accumulate in the storage until they are reported. Timers are aggregated and
+// saved every flush interval as min, max and mean gauges and a count counter,
+// labeled with stat. DogStatsD tags (|#key:value,...) become labels.
+type StatsDListener struct {
+	storage       storage
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	gauges map[string]float64     // last value by series key, for relative gauges
+	timers map[string]*timerStats // by series key
+}
+
+// NewStatsDListener creates a listener saving to s and flushing timers every flushInterval.
+func NewStatsDListener(s storage, flushInterval time.Duration) *StatsDListener {
+	return &StatsDListener{
+		storage:       s,
+		flushInterval: flushInterval,
+		gauges:        make(map[string]float64),
+		timers:        make(map[string]*timerStats),
+	}
+}
+
+// ListenAndServe listens on the UDP address and serves until the context is canceled.
+func (l *StatsDListener) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("statsd listen: %w", err)
+	}
+	return l.Serve(ctx, conn)
+}
+
+// Serve reads packets from conn until the context is canceled, then closes conn
+// and flushes pending timers.
+func (l *StatsDListener) Serve(ctx context.Context, conn net.PacketConn) error {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.flushLoop(ctx)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("statsd read: %w", err)
+		}
+		l.handlePacket(ctx, string(buf[:n]))
+	}
+}
+
+// flushLoop flushes timers every flush interval and once more when the context is canceled.
+func (l *StatsDListener) flushLoop(ctx context.Context) {
+	defer l.flush(context.WithoutCancel(ctx))
+
+	if l.flushInterval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	t := time.NewTicker(l.flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.flush(ctx)
+		}
+	}
+}
+
+// handlePacket processes newline-separated StatsD lines.
+func (l *StatsDListener) handlePacket(ctx context.Context, packet string) {
+	var failed int64
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseStatsD(line)
+		if err != nil {
+			failed++
+			log.Printf("statsd: %v", err)
+			continue
+		}
+		l.apply(ctx, s)
+	}
+	if failed > 0 {
+		l.save(ctx, model.Metric{ID: StatsDErrorsMetric, Type: model.Counter, Delta: utils.I64Ptr(failed)})
+	}
+}
+
+func (l *StatsDListener) apply(ctx context.Context, s statsdSample) {
+	switch s.kind {
+	case "c":
+		delta := int64(math.Round(s.value / s.rate))
+		l.save(ctx, model.Metric{ID: s.name, Type: model.Counter, Delta: &delta, Labels: s.labels})
+	case "g":
+		key := model.SeriesKey(s.name, s.labels)
+		l.mu.Lock()
+		v := s.value
+		if s.relative {
+			v += l.gauges[key]
+		}
+		l.gauges[key] = v
+		l.mu.Unlock()
+		l.save(ctx, model.Metric{ID: s.name, Type: model.Gauge, Value: &v, Labels: s.labels})
+	default: // timers and histograms
+		key := model.SeriesKey(s.name, s.labels)
+		l.mu.Lock()
+		ts, ok := l.timers[key]
+		if !ok {
+			ts = &timerStats{name: s.name, labels: s.labels, min: s.value, max: s.value}
+			l.timers[key] = ts
+		}
+		ts.count++
+		ts.sum += s.value
+		ts.min = math.Min(ts.min, s.value)
+		ts.max = math.Max(ts.max, s.value)
+		l.mu.Unlock()
+	}
+}
+
+// flush saves aggregated timers and starts new aggregation periods.
+func (l *StatsDListener) flush(ctx context.Context) {
+	l.mu.Lock()
+	timers := l.timers
+	l.timers = make(map[string]*timerStats)
+	l.mu.Unlock()
+
+	for _, ts := range timers {
+		name := ts.name
+		for stat, v := range map[string]float64{"min": ts.min, "max": ts.max, "mean": ts.sum / float64(ts.count)} {
+			l.save(ctx, model.Metric{ID: name, Type: model.Gauge, Value: utils.F64Ptr(v), Labels: withStat(ts.labels, stat)})
+		}
+		l.save(ctx, model.Metric{ID: name, Type: model.Counter, Delta: utils.I64Ptr(ts.count), Labels: withStat(ts.labels, "count")})
+	}
+}
+
+func (l *StatsDListener) save(ctx context.Context, m model.Metric) {
+	if err := l.storage.Save(ctx, &m); err != nil {
+		log.Printf("failed to save metric [statsd][%s]: %v", m.ID, err)
+	}
+}
+
+func withStat(labels map[string]string, stat string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[timerStatLabel] = stat
+	return res
+}
+
+// parseStatsD parses a line of the form name:value|type[|@rate][|#tag:value,...].
+func parseStatsD(line string) (statsdSample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return statsdSample{}, fmt.Errorf("invalid line %q: missing name", line)
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return statsdSample{}, fmt.Errorf("invalid line %q: missing type", line)
+	}
+
+	s := statsdSample{name: name, kind: parts[1], rate: 1}
+	switch s.kind {
+	case "c", "g", "ms", "h":
+	default:
+		return statsdSample{}, fmt.Errorf("invalid line %q: unsupported type %q", line, s.kind)
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return statsdSample{}, fmt.Errorf("invalid line %q: bad value", line)
+	}
+	s.value = value
+	s.relative = s.kind == "g" && (strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-"))
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return statsdSample{}, fmt.Errorf("invalid line %q: bad sample rate", line)
+			}
+			s.rate = rate
+		case strings.HasPrefix(p, "#"):
+			s.labels = parseStatsDTags(p[1:])
+		}
+	}
+	return s, nil
+}
+
+// parseStatsDTags parses "#name:value,..." tags into labels. Tags without a name are
+// dropped, since the server rejects empty label names and would reject the whole batch.
+func parseStatsDTags(tags string) map[string]string {
+	res := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		k, v, _ := strings.Cut(tag, ":")
+		if k == "" {
+			continue
+		}
+		res[k] = v
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatsD(t *testing.T) {
+	s, err := parseStatsD("requests:3|c|@0.5|#route:/api,code:200")
+	require.NoError(t, err)
+	require.Equal(t, "requests", s.name)
+	require.Equal(t, "c", s.kind)
+	require.Equal(t, 3.0, s.value)
+	require.Equal(t, 0.5, s.rate)
+	require.Equal(t, map[string]string{"route": "/api", "code": "200"}, s.labels)
+
+	s, err = parseStatsD("requests:1|c|#:v,,route:/api,:")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"route": "/api"}, s.labels, "tags without a name are dropped")
+
+	s, err = parseStatsD("requests:1|c|#:v")
+	require.NoError(t, err)
+	require.Nil(t, s.labels)
+
+	s, err = parseStatsD("temp:-1.5|g")
+	require.NoError(t, err)
+	require.True(t, s.relative)
+
+	s, err = parseStatsD("latency:320|ms")
+	require.NoError(t, err)
+	require.Equal(t, "ms", s.kind)
+
+	for _, line := range []string{"noval", ":1|c", "x:1", "x:1|s", "x:abc|g", "x:1|c|@0", "x:NaN|g"} {
+		_, err := parseStatsD(line)
+		require.Error(t, err, line)
+	}
+}
+
+func TestStatsDListener_Apply(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	l := NewStatsDListener(st, 0)
+
+	l.handlePacket(ctx, "hits:1|c\nhits:2|c\nhits:1|c|@0.25\ntemp:10|g\ntemp:+5|g\ntemp:-3|g\nbroken\n")
+	l.handlePacket(ctx, "latency:100|ms\nlatency:300|ms\nlatency:200|ms")
+
+	all, err := st.GetAll(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, *all["hits"].Delta)
+	require.Equal(t, 12.0, *all["temp"].Value)
+	require.EqualValues(t, 1, *all[StatsDErrorsMetric].Delta)
+	require.NotContains(t, all, model.SeriesKey("latency", map[string]string{"stat": "mean"}), "timers wait for the flush")
+
+	l.flush(ctx)
+	all, err = st.GetAll(ctx)
+	require.NoError(t, err)
+	stat := func(s string) *model.Metric {
+		return all[model.SeriesKey("latency", map[string]string{"stat": s})]
+	}
+	require.Equal(t, 100.0, *stat("min").Value)
+	require.Equal(t, 300.0, *stat("max").Value)
+	require.Equal(t, 200.0, *stat("mean").Value)
+	require.EqualValues(t, 3, *stat("count").Delta)
+}
+
+func TestStatsDListener_Serve(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	st := inmemory.NewMemStorage(ctx)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	l := NewStatsDListener(st, time.Hour)
+	done := make(chan error, 1)
+	go func() { done <- l.Serve(ctx, conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("jobs:4|c|#queue:q1\nwait:50|ms"))
+	require.NoError(t, err)
+
+	key := model.SeriesKey("jobs", map[string]string{"queue": "q1"})
+	require.Eventually(t, func() bool {
+		all, _ := st.GetAll(ctx)
+		return all[key] != nil && *all[key].Delta == 4
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	all, err := st.GetAll(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, all, model.SeriesKey("wait", map[string]string{"stat": "count"}), "pending timers are flushed on shutdown")
+}
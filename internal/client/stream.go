@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errStreamClosed is reported for batches left unacknowledged when the server ends the stream.
+var errStreamClosed = errors.New("stream closed by server")
+
+// metricStream sends metric batches over one long-lived StreamMetrics stream.
+// At most window batches wait for an ack at a time; send blocks until the
+// server acknowledges an earlier batch. A broken stream is reopened by the next send.
+type metricStream struct {
+	client   pb.MetricsClient
+	metadata func(ctx context.Context) context.Context
+	window   chan struct{}
+
+	sendMu sync.Mutex // serializes Send on the stream
+
+	mu      sync.Mutex
+	stream  pb.Metrics_StreamMetricsClient // nil until opened and after it breaks
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when the receive loop of stream returns
+	seq     uint64
+	pending map[uint64]chan error
+}
+
+func newMetricStream(client pb.MetricsClient, window int, md func(ctx context.Context) context.Context) *metricStream {
+	if window <= 0 {
+		window = 1
+	}
+	return &metricStream{
+		client:   client,
+		metadata: md,
+		window:   make(chan struct{}, window),
+		pending:  make(map[uint64]chan error),
+	}
+}
+
+// send sends a batch and returns a channel receiving the result once the server
+// acknowledges it: nil if the batch was saved, otherwise a status error.
+func (s *metricStream) send(ctx context.Context, metrics []*pb.Metric) (<-chan error, error) {
+	select {
+	case s.window <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	if s.stream == nil {
+		if err := s.openLocked(); err != nil {
+			s.mu.Unlock()
+			<-s.window
+			return nil, err
+		}
+	}
+	stream := s.stream
+	s.seq++
+	seq := s.seq
+	res := make(chan error, 1)
+	s.pending[seq] = res
+	s.mu.Unlock()
+
+	// a failed send breaks the stream, and the receive loop reports its status to the batch
+	_ = stream.Send(&pb.StreamMetricsRequest{Seq: seq, Metrics: metrics})
+	return res, nil
+}
+
+// openLocked opens a new stream and starts its receive loop. s.mu must be held.
+func (s *metricStream) openLocked() error {
+	ctx, cancel := context.WithCancel(s.metadata(context.Background()))
+	stream, err := s.client.StreamMetrics(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("open stream: %w", err)
+	}
+	s.stream, s.cancel, s.done = stream, cancel, make(chan struct{})
+	go s.receive(stream, cancel, s.done)
+	return nil
+}
+
+// receive resolves pending batches with the acks read from the stream. When the
+// stream ends, batches still pending fail with its status.
+func (s *metricStream) receive(stream pb.Metrics_StreamMetricsClient, cancel context.CancelFunc, done chan struct{}) {
+	defer close(done)
+	defer cancel()
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errStreamClosed
+			}
+			s.mu.Lock()
+			if s.stream == stream {
+				s.stream = nil
+			}
+			pending := s.pending
+			s.pending = make(map[uint64]chan error)
+			s.mu.Unlock()
+
+			for _, res := range pending {
+				res <- fmt.Errorf("stream: %w", err)
+				<-s.window
+			}
+			return
+		}
+
+		s.mu.Lock()
+		res, ok := s.pending[ack.GetSeq()]
+		delete(s.pending, ack.GetSeq())
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if code := codes.Code(ack.GetCode()); code != codes.OK {
+			res <- status.Error(code, ack.GetMessage())
+		} else {
+			res <- nil
+		}
+		<-s.window
+	}
+}
+
+// close ends the stream and waits up to the timeout for the remaining acks.
+func (s *metricStream) close(timeout time.Duration) {
+	s.sendMu.Lock()
+	s.mu.Lock()
+	stream, cancel, done := s.stream, s.cancel, s.done
+	s.mu.Unlock()
+	if stream != nil {
+		_ = stream.CloseSend()
+	}
+	s.sendMu.Unlock()
+	if stream == nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		cancel()
+		<-done
+	}
+}
+
+// streamToServer sends all stored metrics in batches limited by MaxBatchSize and
+// MaxBatchBytes over the metric stream, without waiting for each ack before sending
+// the next batch. Counter deltas of acknowledged batches are reset. If the outbox is
+// enabled, batches that failed to send are queued there.
+func (clnt *Client) streamToServer(ctx context.Context) error {
+	stored, batches, err := clnt.storedBatches(ctx)
+	if err != nil || len(batches) == 0 {
+		return err
+	}
+
+	if clnt.outbox != nil {
+		if err := clnt.replayOutbox(ctx); err != nil {
+			log.Printf("outbox replay: %v, queueing %d batches", err, len(batches))
+			if err := clnt.enqueue(batches); err != nil {
+				return err
+			}
+			clnt.ackCounters(ctx, stored)
+			return nil
+		}
+	}
+
+	results := make([]<-chan error, len(batches))
+	for i, b := range batches {
+		metrics, err := decodePayload(b.body)
+		if err != nil {
+			return err
+		}
+		req := make([]*pb.Metric, 0, len(metrics))
+		for _, m := range metrics {
+			req = append(req, pb.FromModel(m))
+		}
+		res, err := clnt.stream.send(ctx, req)
+		if err != nil {
+			failed := make(chan error, 1)
+			failed <- err
+			res = failed
+		}
+		results[i] = res
+	}
+
+	var (
+		acked, queuedMetrics []model.Metric
+		queued               []batch
+		failed               []error
+	)
+	offset := 0
+	for i, b := range batches {
+		var err error
+		select {
+		case err = <-results[i]:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		part := stored[offset : offset+b.n]
+		offset += b.n
+
+		switch {
+		case err == nil:
+			acked = append(acked, part...)
+		case clnt.outbox != nil && !isPermanent(err):
+			queued = append(queued, b)
+			queuedMetrics = append(queuedMetrics, part...)
+		default:
+			failed = append(failed, err)
+		}
+	}
+
+	if len(queued) > 0 {
+		log.Printf("stream: %d batches failed, queueing", len(queued))
+		if err := clnt.enqueue(queued); err != nil {
+			failed = append(failed, err)
+		} else {
+			acked = append(acked, queuedMetrics...)
+		}
+	}
+	clnt.ackCounters(ctx, acked)
+	return errors.Join(failed...)
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func (s *fakeMetricsServer) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.mu.Lock()
+	s.md = append(s.md, md)
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, req)
+		nack := s.nack[req.GetSeq()]
+		s.mu.Unlock()
+
+		if s.release != nil {
+			<-s.release
+		}
+		resp := &pb.StreamMetricsResponse{Seq: req.GetSeq()}
+		if nack != nil {
+			st := status.Convert(nack)
+			resp.Code, resp.Message = int32(st.Code()), st.Message()
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeMetricsServer) batchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.batches)
+}
+
+// storeCounters saves counters c0..c(n-1) with deltas 1..n.
+func storeCounters(t *testing.T, st storage, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		m := &model.Metric{ID: "c" + string(rune('0'+i)), Type: model.Counter, Delta: utils.I64Ptr(int64(i + 1))}
+		require.NoError(t, st.Save(context.Background(), m))
+	}
+}
+
+func counterDelta(t *testing.T, st *inmemory.MemStorage, id string) int64 {
+	t.Helper()
+	m, err := st.Get(context.Background(), &model.Metric{ID: id, Type: model.Counter})
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func TestStreamToServer(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClientConfig{AgentID: "agent-7", Key: "secret", MaxBatchSize: 1, RateLimit: 4, ClientTimeout: 5}
+	fake := &fakeMetricsServer{nack: map[uint64]error{2: status.Error(codes.InvalidArgument, "bad metric")}}
+
+	st := inmemory.NewMemStorage(ctx)
+	storeCounters(t, st, 3)
+	c := NewClientWithGRPC(st, cfg, dialBufconn(t, cfg, fake))
+
+	err := c.streamToServer(ctx)
+	require.Error(t, err, "a rejected batch is reported")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require.Len(t, fake.batches, 3, "batches share one stream")
+	require.Len(t, fake.md, 1)
+	require.Equal(t, []string{"agent-7"}, fake.md[0].Get("x-agent-id"))
+	for i, b := range fake.batches {
+		require.EqualValues(t, i+1, b.GetSeq())
+		require.NotEmpty(t, b.GetHash())
+	}
+
+	require.Zero(t, counterDelta(t, st, "c0"))
+	require.EqualValues(t, 2, counterDelta(t, st, "c1"), "rejected counter is kept")
+	require.Zero(t, counterDelta(t, st, "c2"))
+
+	// the next report reuses the stream
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "c0", Type: model.Counter, Delta: utils.I64Ptr(5)}))
+	fake.mu.Lock()
+	fake.nack = nil
+	fake.mu.Unlock()
+	require.NoError(t, c.streamToServer(ctx))
+	require.Len(t, fake.md, 1)
+	require.Len(t, fake.batches, 6)
+	require.Zero(t, counterDelta(t, st, "c1"))
+
+	c.stream.close(time.Second)
+}
+
+func TestStreamToServer_Window(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClientConfig{MaxBatchSize: 1, RateLimit: 2}
+	fake := &fakeMetricsServer{release: make(chan struct{})}
+
+	st := inmemory.NewMemStorage(ctx)
+	storeCounters(t, st, 4)
+	c := NewClientWithGRPC(st, cfg, dialBufconn(t, cfg, fake))
+
+	done := make(chan error, 1)
+	go func() { done <- c.streamToServer(ctx) }()
+
+	// the server holds the first ack: one batch is being saved and one waits, the rest aren't sent
+	require.Eventually(t, func() bool { return fake.batchCount() == 1 }, time.Second, 5*time.Millisecond)
+	require.Never(t, func() bool { return fake.batchCount() > 2 }, 100*time.Millisecond, 5*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		fake.release <- struct{}{}
+	}
+	require.NoError(t, <-done)
+	require.Equal(t, 4, fake.batchCount())
+	require.Zero(t, counterDelta(t, st, "c3"))
+
+	c.stream.close(time.Second)
+}
+
+func TestStreamToServer_BrokenStream(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClientConfig{MaxBatchSize: 2, RateLimit: 1}
+	fake := &fakeMetricsServer{err: status.Error(codes.Unavailable, "restarting")}
+
+	st := inmemory.NewMemStorage(ctx)
+	storeCounters(t, st, 3)
+	c := NewClientWithGRPC(st, cfg, dialBufconn(t, cfg, fake))
+
+	err := c.streamToServer(ctx)
+	require.Error(t, err)
+	require.False(t, isPermanent(err))
+	require.EqualValues(t, 1, counterDelta(t, st, "c0"), "unsent counters are kept")
+
+	// with the outbox, failed batches are queued and their counters reset
+	ob, err := OpenOutbox(t.TempDir(), 0)
+	require.NoError(t, err)
+	c.outbox = ob
+	require.NoError(t, c.streamToServer(ctx))
+	require.Equal(t, 2, ob.Len())
+	require.Zero(t, counterDelta(t, st, "c0"))
+
+	// once the server is back the stream is reopened and the outbox replayed
+	fake.mu.Lock()
+	fake.err = nil
+	fake.mu.Unlock()
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "c0", Type: model.Counter, Delta: utils.I64Ptr(1)}))
+	require.NoError(t, c.streamToServer(ctx))
+	require.Zero(t, ob.Len())
+	require.Len(t, fake.requests, 2, "outbox replayed with UpdateMetrics")
+	require.Equal(t, 2, fake.batchCount())
+
+	c.stream.close(time.Second)
+}
+
+func TestClientRun_GRPCStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &config.ClientConfig{Transport: config.TransportGRPC, RateLimit: 2, ClientTimeout: 1}
+	fake := &fakeMetricsServer{}
+
+	st := inmemory.NewMemStorage(ctx)
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	require.NoError(t, st.Save(ctx, &model.Metric{ID: "b", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	c := NewClientWithGRPC(st, cfg, dialBufconn(t, cfg, fake))
+
+	cancel()
+	require.ErrorIs(t, c.Run(ctx), context.Canceled)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Empty(t, fake.requests, "no unary calls")
+	require.Len(t, fake.batches, 1, "final flush streams a single batch")
+	require.Len(t, fake.batches[0].GetMetrics(), 2)
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// HashInterceptor signs unary requests with the key: the hashsha256 metadata holds
+// the hash of the deterministic protobuf encoding of the request. An empty key disables signing.
+func HashInterceptor(key string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if key == "" {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return fmt.Errorf("unexpected request type %T", req)
+		}
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "hashsha256", utils.CalculateHash(b, key))
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// EncryptInterceptor encrypts requests with the server public key like EncryptRoundTripper.
+// A request with an encrypted bytes field is sent with only that field set to the
+// encrypted protobuf encoding of the request and the x-encrypted metadata v1.
+// Other requests, and all requests when the key is nil, are sent as is.
+func EncryptInterceptor(pub *rsa.PublicKey) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if pub == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		sealed, err := encryptMessage(pub, req)
+		if err != nil {
+			return err
+		}
+		if sealed != nil {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-encrypted", "v1")
+			req = sealed
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// HashStreamInterceptor signs every message sent on a stream with the key: the hash
+// field of the message is set to the hash of its deterministic protobuf encoding.
+// Messages without a hash field and all messages when the key is empty are sent as is.
+func HashStreamInterceptor(key string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil || key == "" {
+			return cs, err
+		}
+		return &sendStream{ClientStream: cs, before: func(m any) (any, error) {
+			return m, signMessage(m, key)
+		}}, nil
+	}
+}
+
+// EncryptStreamInterceptor opens streams with the x-encrypted metadata v1 and sends
+// every message with only the encrypted field set, like EncryptInterceptor.
+// Messages without an encrypted field can't be sent on such a stream.
+// When the key is nil streams are sent as is.
+func EncryptStreamInterceptor(pub *rsa.PublicKey) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if pub == nil || !desc.ClientStreams {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		cs, err := streamer(metadata.AppendToOutgoingContext(ctx, "x-encrypted", "v1"), desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &sendStream{ClientStream: cs, before: func(m any) (any, error) {
+			sealed, err := encryptMessage(pub, m)
+			if err != nil {
+				return nil, err
+			}
+			if sealed == nil {
+				return nil, fmt.Errorf("message %T can't be encrypted", m)
+			}
+			return sealed, nil
+		}}, nil
+	}
+}
+
+// sendStream transforms every message before sending it.
+type sendStream struct {
+	grpc.ClientStream
+	before func(m any) (any, error)
+}
+
+func (s *sendStream) SendMsg(m any) error {
+	m, err := s.before(m)
+	if err != nil {
+		return err
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+// signMessage sets the hash field of a message to the keyed hash of the message.
+func signMessage(m any, key string) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", m)
+	}
+	field := msg.ProtoReflect().Descriptor().Fields().ByName("hash")
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return nil
+	}
+	msg.ProtoReflect().Clear(field)
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	msg.ProtoReflect().Set(field, protoreflect.ValueOfString(utils.CalculateHash(b, key)))
+	return nil
+}
+
+// encryptMessage returns a message of the request type carrying the encrypted request,
+// or nil if the request can't be encrypted.
+func encryptMessage(pub *rsa.PublicKey, req any) (proto.Message, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, nil
+	}
+	field := msg.ProtoReflect().Descriptor().Fields().ByName("encrypted")
+	if field == nil || field.Kind() != protoreflect.BytesKind {
+		return nil, nil
+	}
+
+	plain, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	envBytes, err := crypto.EncryptEnvelope(pub, plain)
+	if err != nil {
+		return nil, err
+	}
+	sealed := msg.ProtoReflect().New()
+	sealed.Set(field, protoreflect.ValueOfBytes(envBytes))
+	return sealed.Interface(), nil
+}
@@ -10,6 +10,18 @@ import (
 	"strings"
 )
 
+// Agent send modes.
+const (
+	SendModeMetric = "metric" // One /update/ request per metric.
+	SendModeBatch  = "batch"  // /updates/ batches limited by MaxBatchSize and MaxBatchBytes.
+)
+
+// Agent transports.
+const (
+	TransportHTTP = "http" // HTTP API at ServerAddr.
+	TransportGRPC = "grpc" // gRPC service at GRPCAddr, batches are streamed whatever the SendMode.
+)
+
 // ClientConfig holds the configuration settings for the agent.
 type ClientConfig struct {
 	ServerAddr     string // Server address
@@ -17,8 +29,58 @@ type ClientConfig struct {
 	PollInterval   int    // Interval for collecting metrics (in seconds)
 	ClientTimeout  int    // HTTP client timeout (in seconds)
 	Key            string // Key for hash generation
-	RateLimit      int    // Limit on simultaneous outgoing requests
+	RateLimit      int    // Limit on simultaneous outgoing requests, or unacknowledged batches on the gRPC stream
 	CryptoKeyPath  string // Path to public key
+	AgentID        string // Agent identity sent to the server (defaults to hostname)
+	SendMode       string // SendModeMetric or SendModeBatch
+	MaxBatchSize   int    // Max metrics per batch, 0 for no limit
+	MaxBatchBytes  int    // Max uncompressed batch size in bytes, 0 for no limit
+	OutboxDir      string // Directory for unsent batches, empty to disable
+	OutboxMaxBytes int    // Max outbox size in bytes, oldest batches are evicted first
+	ExecLimit      int    // Max exec collector commands running at once, 0 for no limit
+	StatsDAddr     string // UDP address of the local StatsD listener, empty to disable
+	Transport      string // TransportHTTP or TransportGRPC
+	GRPCAddr       string // gRPC server address used by TransportGRPC
+
+	Collectors map[string]CollectorConfig // Collector settings by collector name
+}
+
+// CollectorConfig holds the settings of a single agent collector.
+type CollectorConfig struct {
+	Enabled  bool
+	Interval int      // Collection interval (in seconds), 0 means PollInterval
+	Timeout  int      // Collection timeout (in seconds), 0 means the interval
+	Command  []string // Command run by an exec collector; set for custom collectors only
+
+	// Prometheus scrape collector settings.
+	URL     string          // Scraped target, e.g. http://localhost:9100/metrics
+	Allow   []string        // Patterns of metric names to keep, empty keeps all
+	Relabel []RelabelConfig // Rules applied to scraped metrics in order
+
+	// Blackbox probe collector settings.
+	Probe  string // Probe kind: http or tcp
+	Target string // Probed URL for http, host:port for tcp
+}
+
+// RelabelConfig is a rule rewriting or filtering scraped metrics.
+type RelabelConfig struct {
+	Action      string // replace (default), keep, drop or labeldrop
+	SourceLabel string // Label matched by Regex, __name__ is the metric name
+	Regex       string // Anchored pattern, empty matches everything
+	TargetLabel string // Label set by replace, __name__ renames the metric
+	Replacement string // Value set by replace, may reference Regex groups as $1
+}
+
+// collectorEnv maps environment variables enabling collectors to collector names.
+var collectorEnv = map[string]string{
+	"COLLECT_RUNTIME":   "runtime",
+	"COLLECT_GOPSUTIL":  "gopsutil",
+	"COLLECT_DISK":      "disk",
+	"COLLECT_DISK_IO":   "diskio",
+	"COLLECT_NET":       "net",
+	"COLLECT_LOAD":      "load",
+	"COLLECT_SWAP":      "swap",
+	"COLLECT_PROCESSES": "processes",
 }
 
 // NewClientConfig creates and returns a new ClientConfig by parsing flags and environment variables.
@@ -29,10 +91,21 @@ func NewClientConfig() *ClientConfig {
 		PollInterval:   2,
 		ClientTimeout:  10,
 		RateLimit:      runtime.NumCPU(),
+		SendMode:       SendModeMetric,
+		MaxBatchSize:   500,
+		MaxBatchBytes:  1 << 20,
+		OutboxMaxBytes: 64 << 20,
+		ExecLimit:      4,
+		Transport:      TransportHTTP,
+		GRPCAddr:       "localhost:3200",
+		Collectors: map[string]CollectorConfig{
+			"runtime":  {Enabled: true},
+			"gopsutil": {Enabled: true},
+		},
 	}
 
-	var fAddr, fKey, fCrypto, fConf strFlag
-	var fRep, fPoll, fTO, fRate intFlag
+	var fAddr, fKey, fCrypto, fConf, fID, fMode, fOutbox, fStatsD, fTransport, fGRPC strFlag
+	var fRep, fPoll, fTO, fRate, fBatchSize, fBatchBytes, fOutboxMax, fExecLimit intFlag
 	flag.Var(&fAddr, "a", "HTTP server address (must include http(s)://)")
 	flag.Var(&fRep, "r", "report interval (seconds)")
 	flag.Var(&fPoll, "p", "poll interval (seconds)")
@@ -40,6 +113,16 @@ func NewClientConfig() *ClientConfig {
 	flag.Var(&fKey, "k", "Hash key string")
 	flag.Var(&fRate, "l", "rate limit")
 	flag.Var(&fCrypto, "crypto-key", "Path to public key")
+	flag.Var(&fID, "id", "Agent identity (defaults to hostname)")
+	flag.Var(&fMode, "send-mode", "send mode: metric or batch")
+	flag.Var(&fBatchSize, "batch-size", "max metrics per batch (0 for no limit)")
+	flag.Var(&fBatchBytes, "batch-bytes", "max batch size in bytes (0 for no limit)")
+	flag.Var(&fOutbox, "outbox-dir", "directory for unsent batches (empty to disable)")
+	flag.Var(&fOutboxMax, "outbox-max-bytes", "max outbox size in bytes")
+	flag.Var(&fExecLimit, "exec-limit", "max exec collector commands running at once (0 for no limit)")
+	flag.Var(&fStatsD, "statsd", "UDP address of the StatsD listener, e.g. 127.0.0.1:8125 (empty to disable)")
+	flag.Var(&fTransport, "transport", "transport: http or grpc")
+	flag.Var(&fGRPC, "grpc-address", "gRPC server address used by the grpc transport")
 	flag.Var(&fConf, "c", "Path to JSON config file")
 	flag.Var(&fConf, "config", "Path to JSON config file (alias)")
 	flag.Parse()
@@ -65,6 +148,36 @@ func NewClientConfig() *ClientConfig {
 	if fCrypto.set {
 		cfg.CryptoKeyPath = fCrypto.v
 	}
+	if fID.set {
+		cfg.AgentID = fID.v
+	}
+	if fMode.set {
+		cfg.SendMode = fMode.v
+	}
+	if fBatchSize.set {
+		cfg.MaxBatchSize = fBatchSize.v
+	}
+	if fBatchBytes.set {
+		cfg.MaxBatchBytes = fBatchBytes.v
+	}
+	if fOutbox.set {
+		cfg.OutboxDir = fOutbox.v
+	}
+	if fOutboxMax.set {
+		cfg.OutboxMaxBytes = fOutboxMax.v
+	}
+	if fExecLimit.set {
+		cfg.ExecLimit = fExecLimit.v
+	}
+	if fStatsD.set {
+		cfg.StatsDAddr = fStatsD.v
+	}
+	if fTransport.set {
+		cfg.Transport = fTransport.v
+	}
+	if fGRPC.set {
+		cfg.GRPCAddr = fGRPC.v
+	}
 
 	if fConf.v == "" {
 		if v := os.Getenv("CONFIG"); v != "" {
@@ -89,11 +202,73 @@ func NewClientConfig() *ClientConfig {
 			if js.CryptoKey != nil && !fCrypto.set {
 				cfg.CryptoKeyPath = *js.CryptoKey
 			}
+			if js.AgentID != nil && !fID.set {
+				cfg.AgentID = *js.AgentID
+			}
+			if js.SendMode != nil && !fMode.set {
+				cfg.SendMode = *js.SendMode
+			}
+			if js.BatchSize != nil && !fBatchSize.set {
+				cfg.MaxBatchSize = *js.BatchSize
+			}
+			if js.BatchBytes != nil && !fBatchBytes.set {
+				cfg.MaxBatchBytes = *js.BatchBytes
+			}
+			if js.OutboxDir != nil && !fOutbox.set {
+				cfg.OutboxDir = *js.OutboxDir
+			}
+			if js.OutboxMaxBytes != nil && !fOutboxMax.set {
+				cfg.OutboxMaxBytes = *js.OutboxMaxBytes
+			}
+			if js.ExecLimit != nil && !fExecLimit.set {
+				cfg.ExecLimit = *js.ExecLimit
+			}
+			if js.StatsDAddr != nil && !fStatsD.set {
+				cfg.StatsDAddr = *js.StatsDAddr
+			}
+			if js.Transport != nil && !fTransport.set {
+				cfg.Transport = *js.Transport
+			}
+			if js.GRPCAddr != nil && !fGRPC.set {
+				cfg.GRPCAddr = *js.GRPCAddr
+			}
+			for name, enabled := range map[string]*bool{
+				"disk":      js.CollectDisk,
+				"diskio":    js.CollectDiskIO,
+				"net":       js.CollectNet,
+				"load":      js.CollectLoad,
+				"swap":      js.CollectSwap,
+				"processes": js.CollectProcesses,
+			} {
+				if enabled != nil {
+					cfg.setCollectorEnabled(name, *enabled)
+				}
+			}
+			for name, c := range js.Collectors {
+				cfg.applyCollectorJSON(name, c)
+			}
 		}
 	}
 
 	readClientEnvironment(cfg)
 
+	if cfg.SendMode != SendModeMetric && cfg.SendMode != SendModeBatch {
+		log.Printf("unknown send mode %q, using %q", cfg.SendMode, SendModeMetric)
+		cfg.SendMode = SendModeMetric
+	}
+	if cfg.Transport != TransportHTTP && cfg.Transport != TransportGRPC {
+		log.Printf("unknown transport %q, using %q", cfg.Transport, TransportHTTP)
+		cfg.Transport = TransportHTTP
+	}
+
+	if cfg.AgentID == "" {
+		if host, err := os.Hostname(); err == nil {
+			cfg.AgentID = host
+		} else {
+			log.Printf("failed to get hostname: %v", err)
+		}
+	}
+
 	// normalize address
 	if !strings.HasPrefix(cfg.ServerAddr, "http://") && !strings.HasPrefix(cfg.ServerAddr, "https://") {
 		cfg.ServerAddr = "http://" + cfg.ServerAddr
@@ -139,4 +314,122 @@ func readClientEnvironment(cfg *ClientConfig) {
 	if cryptokey := os.Getenv("CRYPTO_KEY"); cryptokey != "" {
 		cfg.CryptoKeyPath = cryptokey
 	}
+
+	if id := os.Getenv("AGENT_ID"); id != "" {
+		cfg.AgentID = id
+	}
+
+	if mode := os.Getenv("SEND_MODE"); mode != "" {
+		cfg.SendMode = mode
+	}
+
+	if size := os.Getenv("BATCH_SIZE"); size != "" {
+		if i, err := strconv.Atoi(size); err == nil {
+			cfg.MaxBatchSize = i
+		} else {
+			log.Printf("invalid BATCH_SIZE env var: %v", err)
+		}
+	}
+
+	if bytes := os.Getenv("BATCH_BYTES"); bytes != "" {
+		if i, err := strconv.Atoi(bytes); err == nil {
+			cfg.MaxBatchBytes = i
+		} else {
+			log.Printf("invalid BATCH_BYTES env var: %v", err)
+		}
+	}
+
+	if dir := os.Getenv("OUTBOX_DIR"); dir != "" {
+		cfg.OutboxDir = dir
+	}
+
+	if size := os.Getenv("OUTBOX_MAX_BYTES"); size != "" {
+		if i, err := strconv.Atoi(size); err == nil {
+			cfg.OutboxMaxBytes = i
+		} else {
+			log.Printf("invalid OUTBOX_MAX_BYTES env var: %v", err)
+		}
+	}
+
+	if limit := os.Getenv("EXEC_LIMIT"); limit != "" {
+		if i, err := strconv.Atoi(limit); err == nil {
+			cfg.ExecLimit = i
+		} else {
+			log.Printf("invalid EXEC_LIMIT env var: %v", err)
+		}
+	}
+
+	if addr := os.Getenv("STATSD_ADDRESS"); addr != "" {
+		cfg.StatsDAddr = addr
+	}
+
+	if transport := os.Getenv("TRANSPORT"); transport != "" {
+		cfg.Transport = transport
+	}
+
+	if addr := os.Getenv("GRPC_ADDRESS"); addr != "" {
+		cfg.GRPCAddr = addr
+	}
+
+	for env, name := range collectorEnv {
+		if v := os.Getenv(env); v != "" {
+			if b, err := strconv.ParseBool(v); err == nil {
+				cfg.setCollectorEnabled(name, b)
+			} else {
+				log.Printf("invalid %s env var: %v", env, err)
+			}
+		}
+	}
+}
+
+func (cfg *ClientConfig) setCollectorEnabled(name string, enabled bool) {
+	if cfg.Collectors == nil {
+		cfg.Collectors = make(map[string]CollectorConfig)
+	}
+	c := cfg.Collectors[name]
+	c.Enabled = enabled
+	cfg.Collectors[name] = c
+}
+
+// applyCollectorJSON merges JSON settings into the collector config.
+// A collector listed in JSON is enabled unless "enabled" is false.
+func (cfg *ClientConfig) applyCollectorJSON(name string, js collectorJSON) {
+	if cfg.Collectors == nil {
+		cfg.Collectors = make(map[string]CollectorConfig)
+	}
+	c := cfg.Collectors[name]
+	c.Enabled = js.Enabled == nil || *js.Enabled
+	if js.Interval != nil {
+		if sec, err := parseDurationSeconds(*js.Interval); err == nil {
+			c.Interval = sec
+		} else {
+			log.Printf("invalid interval of collector %s: %v", name, err)
+		}
+	}
+	if js.Timeout != nil {
+		if sec, err := parseDurationSeconds(*js.Timeout); err == nil {
+			c.Timeout = sec
+		} else {
+			log.Printf("invalid timeout of collector %s: %v", name, err)
+		}
+	}
+	if len(js.Command) > 0 {
+		c.Command = js.Command
+	}
+	if js.URL != nil {
+		c.URL = *js.URL
+	}
+	if js.Allow != nil {
+		c.Allow = js.Allow
+	}
+	if js.Probe != nil {
+		c.Probe = *js.Probe
+	}
+	if js.Target != nil {
+		c.Target = *js.Target
+	}
+	for _, r := range js.Relabel {
+		c.Relabel = append(c.Relabel, RelabelConfig(r))
+	}
+	cfg.Collectors[name] = c
 }
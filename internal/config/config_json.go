@@ -8,12 +8,22 @@ import (
 )
 
 type serverJSON struct {
-	Address       *string `json:"address"`
-	Restore       *bool   `json:"restore"`
-	StoreInterval *string `json:"store_interval"` // "1s"
-	StoreFile     *string `json:"store_file"`
-	DatabaseDSN   *string `json:"database_dsn"`
-	CryptoKey     *string `json:"crypto_key"`
+	Address         *string  `json:"address"`
+	Restore         *bool    `json:"restore"`
+	StoreInterval   *string  `json:"store_interval"` // "1s"
+	StoreFile       *string  `json:"store_file"`
+	DatabaseDSN     *string  `json:"database_dsn"`
+	CryptoKey       *string  `json:"crypto_key"`
+	AlertRules      *string  `json:"alert_rules"`
+	AlertInterval   *string  `json:"alert_interval"` // "10s"
+	Webhooks        []string `json:"webhooks"`
+	WebhookKey      *string  `json:"webhook_key"`
+	AgentDownFactor *int     `json:"agent_down_factor"`
+	InfluxCounters  []string `json:"influx_counters"`
+	GraphiteAddr    *string  `json:"graphite_address"`
+	GRPCAddr        *string  `json:"grpc_address"`
+	HistoryLimit    *int     `json:"history_limit"`
+	Retention       *string  `json:"history_retention"` // "168h"
 }
 
 type clientJSON struct {
@@ -21,6 +31,47 @@ type clientJSON struct {
 	ReportInterval *string `json:"report_interval"`
 	PollInterval   *string `json:"poll_interval"`
 	CryptoKey      *string `json:"crypto_key"`
+	AgentID        *string `json:"agent_id"`
+	SendMode       *string `json:"send_mode"`
+	BatchSize      *int    `json:"batch_size"`
+	BatchBytes     *int    `json:"batch_bytes"`
+	OutboxDir      *string `json:"outbox_dir"`
+	OutboxMaxBytes *int    `json:"outbox_max_bytes"`
+	ExecLimit      *int    `json:"exec_limit"`
+	StatsDAddr     *string `json:"statsd_address"`
+	Transport      *string `json:"transport"`
+	GRPCAddr       *string `json:"grpc_address"`
+
+	CollectDisk      *bool `json:"collect_disk"`
+	CollectDiskIO    *bool `json:"collect_disk_io"`
+	CollectNet       *bool `json:"collect_net"`
+	CollectLoad      *bool `json:"collect_load"`
+	CollectSwap      *bool `json:"collect_swap"`
+	CollectProcesses *bool `json:"collect_processes"`
+
+	Collectors map[string]collectorJSON `json:"collectors"`
+}
+
+type collectorJSON struct {
+	Enabled  *bool    `json:"enabled"`
+	Interval *string  `json:"interval"` // "10s"
+	Timeout  *string  `json:"timeout"`  // "2s"
+	Command  []string `json:"command"`  // ["/usr/local/bin/check.sh", "--fast"]
+
+	URL     *string       `json:"url"`
+	Allow   []string      `json:"allow"`
+	Relabel []relabelJSON `json:"relabel"`
+
+	Probe  *string `json:"probe"`  // "http" or "tcp"
+	Target *string `json:"target"` // "https://example.com/health" or "db:5432"
+}
+
+type relabelJSON struct {
+	Action      string `json:"action"`
+	SourceLabel string `json:"source_label"`
+	Regex       string `json:"regex"`
+	TargetLabel string `json:"target_label"`
+	Replacement string `json:"replacement"`
 }
 
 func loadServerJSON(path string) (*serverJSON, error) {
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 )
@@ -14,12 +15,22 @@ import (
 type ServerConfig struct {
 	Addr            string // Server address
 	Logger          *zap.SugaredLogger
-	StoreInterval   int    // Interval for storing metrics to file (in seconds)
-	FileStoragePath string // Path to the file for metric storage
-	Restore         bool   // Whether to restore metrics from file on startup
-	DatabaseDsn     string // Data Source Name for PostgreSQL
-	Key             string // Key for hash verification
-	CryptoKeyPath   string // Path to private key
+	StoreInterval   int      // Interval for storing metrics to file (in seconds)
+	FileStoragePath string   // Path to the file for metric storage
+	Restore         bool     // Whether to restore metrics from file on startup
+	DatabaseDsn     string   // Data Source Name for PostgreSQL
+	Key             string   // Key for hash verification
+	CryptoKeyPath   string   // Path to private key
+	AlertRulesPath  string   // Path to JSON file with alert rules
+	AlertInterval   int      // Interval for evaluating alert rules (in seconds)
+	WebhookURLs     []string // URLs notified on firing and resolved alerts
+	WebhookKey      string   // Key for webhook payload signing
+	AgentDownFactor int      // Agent is down after this many report intervals without reports
+	InfluxCounters  []string // Patterns of metric IDs whose line protocol integer fields are cumulative counters
+	GraphiteAddr    string   // TCP and UDP address of the Graphite plaintext listener, empty to disable
+	GRPCAddr        string   // Address of the gRPC server, empty to disable
+	HistoryLimit    int      // Samples kept per series, 0 to disable history
+	Retention       int      // Age of samples and series without writes to delete (in seconds), 0 to keep them
 }
 
 // NewServerConfig creates and returns a new ServerConfig by parsing flags and environment variables.
@@ -34,6 +45,9 @@ func NewServerConfig() *ServerConfig {
 		StoreInterval:   300,
 		FileStoragePath: "./tmp/metrics-db.json",
 		Restore:         true,
+		AlertInterval:   10,
+		AgentDownFactor: 3,
+		HistoryLimit:    10000,
 	}
 
 	// 1) flags
@@ -48,6 +62,19 @@ func NewServerConfig() *ServerConfig {
 	var fDSN strFlag
 	var fKey strFlag
 	var fCrypto strFlag
+	var fRules strFlag
+	var fAlertI intFlag
+	fAlertI.v = cfg.AlertInterval
+	var fWebhooks strFlag
+	var fWebhookKey strFlag
+	var fDownFactor intFlag
+	fDownFactor.v = cfg.AgentDownFactor
+	var fInfluxCounters strFlag
+	var fGraphite strFlag
+	var fGRPC strFlag
+	var fHistoryLimit intFlag
+	fHistoryLimit.v = cfg.HistoryLimit
+	var fRetention intFlag
 	var fConf strFlag // -c / -config
 
 	flag.Var(&fAddr, "a", "HTTP server address")
@@ -57,6 +84,16 @@ func NewServerConfig() *ServerConfig {
 	flag.Var(&fDSN, "d", "DB connection string")
 	flag.Var(&fKey, "k", "Hash key string")
 	flag.Var(&fCrypto, "crypto-key", "Path to private key")
+	flag.Var(&fRules, "alert-rules", "Path to JSON file with alert rules")
+	flag.Var(&fAlertI, "alert-interval", "alert rules evaluation interval (seconds)")
+	flag.Var(&fWebhooks, "webhooks", "Comma-separated webhook URLs for alert notifications")
+	flag.Var(&fWebhookKey, "webhook-key", "Hash key string for webhook payloads")
+	flag.Var(&fDownFactor, "agent-down-factor", "report intervals without reports before an agent is down")
+	flag.Var(&fInfluxCounters, "influx-counters", "Comma-separated patterns of metric IDs whose line protocol integer fields are cumulative counters")
+	flag.Var(&fGraphite, "graphite", "TCP and UDP address of the Graphite listener, e.g. :2003 (empty to disable)")
+	flag.Var(&fGRPC, "grpc", "gRPC server address, e.g. :3200 (empty to disable)")
+	flag.Var(&fHistoryLimit, "history-limit", "samples kept per series (0 disables history)")
+	flag.Var(&fRetention, "history-retention", "age of samples and series without writes to delete (seconds, 0 keeps them)")
 	flag.Var(&fConf, "c", "Path to JSON config file")
 	flag.Var(&fConf, "config", "Path to JSON config file (alias)")
 	flag.Parse()
@@ -68,6 +105,16 @@ func NewServerConfig() *ServerConfig {
 	cfg.DatabaseDsn = fDSN.v
 	cfg.Key = fKey.v
 	cfg.CryptoKeyPath = fCrypto.v
+	cfg.AlertRulesPath = fRules.v
+	cfg.AlertInterval = fAlertI.v
+	cfg.WebhookURLs = splitList(fWebhooks.v)
+	cfg.WebhookKey = fWebhookKey.v
+	cfg.AgentDownFactor = fDownFactor.v
+	cfg.InfluxCounters = splitList(fInfluxCounters.v)
+	cfg.GraphiteAddr = fGraphite.v
+	cfg.GRPCAddr = fGRPC.v
+	cfg.HistoryLimit = fHistoryLimit.v
+	cfg.Retention = fRetention.v
 
 	// 3) JSON (lowest priority)
 	if fConf.v == "" {
@@ -98,6 +145,40 @@ func NewServerConfig() *ServerConfig {
 			if js.CryptoKey != nil && !fCrypto.set {
 				cfg.CryptoKeyPath = *js.CryptoKey
 			}
+			if js.AlertRules != nil && !fRules.set {
+				cfg.AlertRulesPath = *js.AlertRules
+			}
+			if js.AlertInterval != nil && !fAlertI.set {
+				if sec, err := parseDurationSeconds(*js.AlertInterval); err == nil {
+					cfg.AlertInterval = sec
+				}
+			}
+			if js.Webhooks != nil && !fWebhooks.set {
+				cfg.WebhookURLs = js.Webhooks
+			}
+			if js.WebhookKey != nil && !fWebhookKey.set {
+				cfg.WebhookKey = *js.WebhookKey
+			}
+			if js.AgentDownFactor != nil && !fDownFactor.set {
+				cfg.AgentDownFactor = *js.AgentDownFactor
+			}
+			if js.InfluxCounters != nil && !fInfluxCounters.set {
+				cfg.InfluxCounters = js.InfluxCounters
+			}
+			if js.GraphiteAddr != nil && !fGraphite.set {
+				cfg.GraphiteAddr = *js.GraphiteAddr
+			}
+			if js.GRPCAddr != nil && !fGRPC.set {
+				cfg.GRPCAddr = *js.GRPCAddr
+			}
+			if js.HistoryLimit != nil && !fHistoryLimit.set {
+				cfg.HistoryLimit = *js.HistoryLimit
+			}
+			if js.Retention != nil && !fRetention.set {
+				if sec, err := parseDurationSeconds(*js.Retention); err == nil {
+					cfg.Retention = sec
+				}
+			}
 		}
 	}
 
@@ -149,4 +230,79 @@ func readServerEnvironment(cfg *ServerConfig) {
 	if cryptokey := os.Getenv("CRYPTO_KEY"); cryptokey != "" {
 		cfg.CryptoKeyPath = cryptokey
 	}
+
+	if rules := os.Getenv("ALERT_RULES"); rules != "" {
+		cfg.AlertRulesPath = rules
+	}
+
+	alertIntervalEnv := os.Getenv("ALERT_INTERVAL")
+	if alertIntervalEnv != "" {
+		v, err := strconv.Atoi(alertIntervalEnv)
+		if err == nil {
+			cfg.AlertInterval = v
+		} else {
+			log.Printf("invalid ALERT_INTERVAL env var: %v", err)
+		}
+	}
+
+	if webhooks := os.Getenv("WEBHOOK_URLS"); webhooks != "" {
+		cfg.WebhookURLs = splitList(webhooks)
+	}
+
+	if key := os.Getenv("WEBHOOK_KEY"); key != "" {
+		cfg.WebhookKey = key
+	}
+
+	downFactorEnv := os.Getenv("AGENT_DOWN_FACTOR")
+	if downFactorEnv != "" {
+		v, err := strconv.Atoi(downFactorEnv)
+		if err == nil {
+			cfg.AgentDownFactor = v
+		} else {
+			log.Printf("invalid AGENT_DOWN_FACTOR env var: %v", err)
+		}
+	}
+
+	if counters := os.Getenv("INFLUX_COUNTERS"); counters != "" {
+		cfg.InfluxCounters = splitList(counters)
+	}
+
+	if addr := os.Getenv("GRAPHITE_ADDRESS"); addr != "" {
+		cfg.GraphiteAddr = addr
+	}
+
+	if addr := os.Getenv("GRPC_ADDRESS"); addr != "" {
+		cfg.GRPCAddr = addr
+	}
+
+	historyLimitEnv := os.Getenv("HISTORY_LIMIT")
+	if historyLimitEnv != "" {
+		v, err := strconv.Atoi(historyLimitEnv)
+		if err == nil {
+			cfg.HistoryLimit = v
+		} else {
+			log.Printf("invalid HISTORY_LIMIT env var: %v", err)
+		}
+	}
+
+	retentionEnv := os.Getenv("HISTORY_RETENTION")
+	if retentionEnv != "" {
+		v, err := strconv.Atoi(retentionEnv)
+		if err == nil {
+			cfg.Retention = v
+		} else {
+			log.Printf("invalid HISTORY_RETENTION env var: %v", err)
+		}
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
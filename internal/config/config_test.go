@@ -266,6 +266,227 @@ func TestServer_InvalidJSONDuration_Ignored(t *testing.T) {
 	})
 }
 
+func TestServer_AlertSettings_JSONAndENV(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{
+		"alert_rules":    "/json-rules.json",
+		"alert_interval": "30s",
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, "/json-rules.json", cfg.AlertRulesPath)
+				require.Equal(t, 30, cfg.AlertInterval)
+			})
+		})
+	})
+
+	env := map[string]string{"ALERT_RULES": "/env-rules.json", "ALERT_INTERVAL": "5"}
+	setEnvAndRun(t, env, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-alert-rules", "/flag-rules.json", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, "/env-rules.json", cfg.AlertRulesPath)
+				require.Equal(t, 5, cfg.AlertInterval)
+			})
+		})
+	})
+}
+
+func TestServer_HistorySettings(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{
+		"history_limit":     500,
+		"history_retention": "168h",
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, 10000, cfg.HistoryLimit)
+				require.Zero(t, cfg.Retention)
+			})
+		})
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-history-limit", "50", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, 50, cfg.HistoryLimit)
+				require.Equal(t, 168*3600, cfg.Retention)
+			})
+		})
+	})
+
+	env := map[string]string{"HISTORY_LIMIT": "0", "HISTORY_RETENTION": "3600"}
+	setEnvAndRun(t, env, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-history-retention", "60", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Zero(t, cfg.HistoryLimit)
+				require.Equal(t, 3600, cfg.Retention)
+			})
+		})
+	})
+}
+
+func TestServer_WebhookSettings(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{
+		"webhooks":    []string{"http://json-a", "http://json-b"},
+		"webhook_key": "json-key",
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, []string{"http://json-a", "http://json-b"}, cfg.WebhookURLs)
+				require.Equal(t, "json-key", cfg.WebhookKey)
+			})
+		})
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-webhooks", "http://a, ,http://b", "-webhook-key", "k", "-c", cfgPath}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, []string{"http://a", "http://b"}, cfg.WebhookURLs)
+				require.Equal(t, "k", cfg.WebhookKey)
+			})
+		})
+	})
+
+	env := map[string]string{"WEBHOOK_URLS": "http://env", "WEBHOOK_KEY": "env-key"}
+	setEnvAndRun(t, env, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				cfg := NewServerConfig()
+				require.Equal(t, []string{"http://env"}, cfg.WebhookURLs)
+				require.Equal(t, "env-key", cfg.WebhookKey)
+			})
+		})
+	})
+}
+
+func TestServer_AgentDownFactor(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{"agent_down_factor": 5})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				require.Equal(t, 3, NewServerConfig().AgentDownFactor)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				require.Equal(t, 5, NewServerConfig().AgentDownFactor)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-agent-down-factor", "4", "-c", cfgPath}, func() {
+				require.Equal(t, 4, NewServerConfig().AgentDownFactor)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"AGENT_DOWN_FACTOR": "7"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-agent-down-factor", "4"}, func() {
+				require.Equal(t, 7, NewServerConfig().AgentDownFactor)
+			})
+		})
+	})
+}
+
+func TestServer_InfluxCounters(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{"influx_counters": []string{"net_.*", "diskio_.*"}})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				require.Equal(t, []string{"net_.*", "diskio_.*"}, NewServerConfig().InfluxCounters)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-influx-counters", "a_.*, b", "-c", cfgPath}, func() {
+				require.Equal(t, []string{"a_.*", "b"}, NewServerConfig().InfluxCounters)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"INFLUX_COUNTERS": "env_.*"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-influx-counters", "a_.*"}, func() {
+				require.Equal(t, []string{"env_.*"}, NewServerConfig().InfluxCounters)
+			})
+		})
+	})
+}
+
+func TestServer_GraphiteAddr(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{"graphite_address": ":2003"})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				require.Empty(t, NewServerConfig().GraphiteAddr)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				require.Equal(t, ":2003", NewServerConfig().GraphiteAddr)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-graphite", ":2004", "-c", cfgPath}, func() {
+				require.Equal(t, ":2004", NewServerConfig().GraphiteAddr)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"GRAPHITE_ADDRESS": ":2005"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-graphite", ":2004"}, func() {
+				require.Equal(t, ":2005", NewServerConfig().GraphiteAddr)
+			})
+		})
+	})
+}
+
+func TestServer_GRPCAddr(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "srv.json", map[string]any{"grpc_address": ":3200"})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				require.Empty(t, NewServerConfig().GRPCAddr)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-grpc", ":3201", "-c", cfgPath}, func() {
+				require.Equal(t, ":3201", NewServerConfig().GRPCAddr)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"GRPC_ADDRESS": ":3202"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				require.Equal(t, ":3202", NewServerConfig().GRPCAddr)
+			})
+		})
+	})
+}
+
 // -------- CLIENT --------
 
 func TestClient_JSONLowPriority_FlagsWin(t *testing.T) {
@@ -340,6 +561,257 @@ func TestClient_ConfigPathFromENV_CONFIG(t *testing.T) {
 	})
 }
 
+func TestClient_AgentID(t *testing.T) {
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{"agent_id": "json-agent"})
+
+	setEnvAndRun(t, map[string]string{"AGENT_ID": ""}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				require.Equal(t, host, NewClientConfig().AgentID)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				require.Equal(t, "json-agent", NewClientConfig().AgentID)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath, "-id", "flag-agent"}, func() {
+				require.Equal(t, "flag-agent", NewClientConfig().AgentID)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"AGENT_ID": "env-agent"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-id", "flag-agent"}, func() {
+				require.Equal(t, "env-agent", NewClientConfig().AgentID)
+			})
+		})
+	})
+}
+
+func TestClient_SendMode(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{
+		"send_mode":   "batch",
+		"batch_size":  50,
+		"batch_bytes": 4096,
+		"outbox_dir":  "/json/outbox",
+	})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, SendModeMetric, cfg.SendMode)
+				require.Equal(t, 500, cfg.MaxBatchSize)
+				require.Equal(t, 1<<20, cfg.MaxBatchBytes)
+				require.Empty(t, cfg.OutboxDir)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath, "-batch-size", "10"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, SendModeBatch, cfg.SendMode)
+				require.Equal(t, 10, cfg.MaxBatchSize)
+				require.Equal(t, 4096, cfg.MaxBatchBytes)
+				require.Equal(t, "/json/outbox", cfg.OutboxDir)
+				require.Equal(t, 64<<20, cfg.OutboxMaxBytes)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-send-mode", "bulk"}, func() {
+				require.Equal(t, SendModeMetric, NewClientConfig().SendMode)
+			})
+		})
+	})
+
+	env := map[string]string{"SEND_MODE": "batch", "BATCH_SIZE": "7", "BATCH_BYTES": "100", "OUTBOX_DIR": "/env/outbox", "OUTBOX_MAX_BYTES": "2048"}
+	setEnvAndRun(t, env, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-send-mode", "metric", "-batch-size", "1"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, SendModeBatch, cfg.SendMode)
+				require.Equal(t, 7, cfg.MaxBatchSize)
+				require.Equal(t, 100, cfg.MaxBatchBytes)
+				require.Equal(t, "/env/outbox", cfg.OutboxDir)
+				require.Equal(t, 2048, cfg.OutboxMaxBytes)
+			})
+		})
+	})
+}
+
+func TestClient_SystemCollectors(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{
+		"collect_disk":      true,
+		"collect_net":       true,
+		"collect_processes": false,
+		"collectors": map[string]any{
+			"swap":     map[string]any{"interval": "30s", "timeout": "2s"},
+			"gopsutil": map[string]any{"enabled": false},
+		},
+	})
+
+	setEnvAndRun(t, map[string]string{"COLLECT_LOAD": "true", "COLLECT_NET": "false"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, map[string]CollectorConfig{
+					"runtime":   {Enabled: true},
+					"gopsutil":  {Enabled: false},
+					"disk":      {Enabled: true},
+					"net":       {Enabled: false}, // env overrides JSON
+					"load":      {Enabled: true},
+					"swap":      {Enabled: true, Interval: 30, Timeout: 2},
+					"processes": {Enabled: false},
+				}, cfg.Collectors)
+			})
+		})
+	})
+}
+
+func TestClient_ExecCollectors(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{
+		"exec_limit": 2,
+		"collectors": map[string]any{
+			"queue": map[string]any{"command": []string{"/bin/check", "-q"}, "interval": "1m", "timeout": "5s"},
+		},
+	})
+
+	withFreshFlagSet(t, func() {
+		withArgs([]string{"cmd", "-c", cfgPath}, func() {
+			cfg := NewClientConfig()
+			require.Equal(t, 2, cfg.ExecLimit)
+			require.Equal(t, CollectorConfig{Enabled: true, Interval: 60, Timeout: 5, Command: []string{"/bin/check", "-q"}}, cfg.Collectors["queue"])
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"EXEC_LIMIT": "8"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-exec-limit", "1"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, 8, cfg.ExecLimit)
+			})
+		})
+	})
+}
+
+func TestClient_ScrapeCollectors(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{
+		"collectors": map[string]any{
+			"node": map[string]any{
+				"url":      "http://localhost:9100/metrics",
+				"interval": "15s",
+				"allow":    []string{"node_.*"},
+				"relabel": []map[string]string{
+					{"action": "drop", "source_label": "__name__", "regex": "node_scrape_.*"},
+				},
+			},
+		},
+	})
+
+	withFreshFlagSet(t, func() {
+		withArgs([]string{"cmd", "-c", cfgPath}, func() {
+			cfg := NewClientConfig()
+			require.Equal(t, CollectorConfig{
+				Enabled:  true,
+				Interval: 15,
+				URL:      "http://localhost:9100/metrics",
+				Allow:    []string{"node_.*"},
+				Relabel:  []RelabelConfig{{Action: "drop", SourceLabel: "__name__", Regex: "node_scrape_.*"}},
+			}, cfg.Collectors["node"])
+		})
+	})
+}
+
+func TestClient_ProbeCollectors(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{
+		"collectors": map[string]any{
+			"site": map[string]any{"probe": "http", "target": "https://example.com/health", "timeout": "3s"},
+			"db":   map[string]any{"probe": "tcp", "target": "db:5432"},
+		},
+	})
+
+	withFreshFlagSet(t, func() {
+		withArgs([]string{"cmd", "-c", cfgPath}, func() {
+			cfg := NewClientConfig()
+			require.Equal(t, CollectorConfig{Enabled: true, Timeout: 3, Probe: "http", Target: "https://example.com/health"}, cfg.Collectors["site"])
+			require.Equal(t, CollectorConfig{Enabled: true, Probe: "tcp", Target: "db:5432"}, cfg.Collectors["db"])
+		})
+	})
+}
+
+func TestClient_StatsDAddr(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{"statsd_address": "127.0.0.1:8125"})
+
+	withFreshFlagSet(t, func() {
+		withArgs([]string{"cmd"}, func() {
+			require.Empty(t, NewClientConfig().StatsDAddr)
+		})
+	})
+
+	withFreshFlagSet(t, func() {
+		withArgs([]string{"cmd", "-c", cfgPath}, func() {
+			require.Equal(t, "127.0.0.1:8125", NewClientConfig().StatsDAddr)
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"STATSD_ADDRESS": ":9125"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath, "-statsd", ":7125"}, func() {
+				require.Equal(t, ":9125", NewClientConfig().StatsDAddr)
+			})
+		})
+	})
+}
+
+func TestClient_Transport(t *testing.T) {
+	td := t.TempDir()
+	cfgPath := writeJSON(t, td, "agent.json", map[string]any{"transport": "grpc", "grpc_address": "json:3200"})
+
+	setEnvAndRun(t, nil, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, TransportHTTP, cfg.Transport)
+				require.Equal(t, "localhost:3200", cfg.GRPCAddr)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath, "-grpc-address", "flag:3200"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, TransportGRPC, cfg.Transport)
+				require.Equal(t, "flag:3200", cfg.GRPCAddr)
+			})
+		})
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-transport", "quic"}, func() {
+				require.Equal(t, TransportHTTP, NewClientConfig().Transport)
+			})
+		})
+	})
+
+	setEnvAndRun(t, map[string]string{"TRANSPORT": "http", "GRPC_ADDRESS": "env:3200"}, func() {
+		withFreshFlagSet(t, func() {
+			withArgs([]string{"cmd", "-c", cfgPath, "-transport", "grpc"}, func() {
+				cfg := NewClientConfig()
+				require.Equal(t, TransportHTTP, cfg.Transport)
+				require.Equal(t, "env:3200", cfg.GRPCAddr)
+			})
+		})
+	})
+}
+
 func TestClient_AddsHTTPPrefix_OnlyWhenMissing(t *testing.T) {
 	setEnvAndRun(t, map[string]string{"ADDRESS": "https://already"}, func() {
 		withFreshFlagSet(t, func() {
@@ -0,0 +1,101 @@
+// Package notifier delivers alert notifications to external systems.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// Payload is the JSON body POSTed to a webhook.
+type Payload struct {
+	Check      string            `json:"check"`            // Alert rule name.
+	MetricID   string            `json:"metric_id"`        // Metric name.
+	Labels     map[string]string `json:"labels,omitempty"` // Labels of the alerting series.
+	Type       model.MetricType  `json:"type"`             // Metric type: gauge or counter.
+	Value      float64           `json:"value"`            // Metric value at the transition.
+	State      alerting.State    `json:"state"`            // firing or resolved.
+	ActiveAt   time.Time         `json:"active_at"`
+	FiredAt    *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"` // Time the notification was sent.
+}
+
+// Webhook POSTs alert notifications to a URL.
+type Webhook struct {
+	url        string
+	key        string
+	httpClient *http.Client
+}
+
+// NewWebhook creates a webhook notifier. If key is not empty, the request body
+// is signed into the HashSHA256 header the same way the agent signs metrics.
+func NewWebhook(url, key string, timeout time.Duration) *Webhook {
+	return &Webhook{
+		url:        url,
+		key:        key,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Notify sends the alert to the webhook URL, retrying on network errors.
+func (wh *Webhook) Notify(ctx context.Context, a alerting.Alert) error {
+	body, err := json.Marshal(Payload{
+		Check:      a.Rule,
+		MetricID:   a.MetricID,
+		Labels:     a.Labels,
+		Type:       a.Type,
+		Value:      a.Value,
+		State:      a.State,
+		ActiveAt:   a.ActiveAt,
+		FiredAt:    a.FiredAt,
+		ResolvedAt: a.ResolvedAt,
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	var statusCode int
+	err = utils.WithRetry(ctx, func() error {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if wh.key != "" {
+			req.Header.Set("HashSHA256", utils.CalculateHash(body, wh.key))
+		}
+
+		resp, reqErr := wh.httpClient.Do(req)
+		if reqErr != nil {
+			return reqErr
+		}
+		defer resp.Body.Close()
+
+		if _, reqErr = io.Copy(io.Discard, resp.Body); reqErr != nil {
+			return reqErr
+		}
+
+		statusCode = resp.StatusCode
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("send webhook %s: %w", wh.url, err)
+	}
+
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("webhook %s: unexpected status: %d", wh.url, statusCode)
+	}
+
+	return nil
+}
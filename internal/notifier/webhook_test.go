@@ -0,0 +1,112 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func testAlert() alerting.Alert {
+	fired := time.Date(2025, 1, 1, 0, 2, 0, 0, time.UTC)
+	return alerting.Alert{
+		Rule:     "HighHeap",
+		MetricID: "HeapAlloc",
+		Type:     model.Gauge,
+		Value:    600e6,
+		State:    alerting.StateFiring,
+		ActiveAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		FiredAt:  &fired,
+	}
+}
+
+func TestWebhook_Notify_PayloadAndSignature(t *testing.T) {
+	var (
+		got  Payload
+		hash string
+		body []byte
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		hash = r.Header.Get("HashSHA256")
+		body, _ = io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &got))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	wh := NewWebhook(ts.URL, "secret", time.Second)
+	require.NoError(t, wh.Notify(context.Background(), testAlert()))
+
+	require.Equal(t, "HighHeap", got.Check)
+	require.Equal(t, "HeapAlloc", got.MetricID)
+	require.Equal(t, model.Gauge, got.Type)
+	require.Equal(t, 600e6, got.Value)
+	require.Equal(t, alerting.StateFiring, got.State)
+	require.NotNil(t, got.FiredAt)
+	require.Nil(t, got.ResolvedAt)
+	require.False(t, got.Timestamp.IsZero())
+	require.Equal(t, utils.CalculateHash(body, "secret"), hash)
+}
+
+func TestWebhook_Notify_NoKeyNoSignature(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.Header.Get("HashSHA256"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	require.NoError(t, NewWebhook(ts.URL, "", time.Second).Notify(context.Background(), testAlert()))
+}
+
+func TestWebhook_Notify_ErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	err := NewWebhook(ts.URL, "", time.Second).Notify(context.Background(), testAlert())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unexpected status")
+}
+
+func TestWebhook_EngineTransitions(t *testing.T) {
+	states := make(chan alerting.State, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		states <- p.State
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	src := &staticSource{m: &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(600e6)}}
+	rule, err := alerting.ParseRule("HighHeap", "gauge HeapAlloc > 500e6")
+	require.NoError(t, err)
+	e := alerting.NewEngine(src, []alerting.Rule{rule}, nil)
+	e.AddNotifier(NewWebhook(ts.URL, "", time.Second))
+
+	require.NoError(t, e.Evaluate(ctx))
+	src.m.Value = utils.F64Ptr(1)
+	require.NoError(t, e.Evaluate(ctx))
+
+	require.Equal(t, alerting.StateFiring, <-states)
+	require.Equal(t, alerting.StateResolved, <-states)
+}
+
+type staticSource struct {
+	m *model.Metric
+}
+
+func (s *staticSource) GetAll(context.Context) (map[string]*model.Metric, error) {
+	return map[string]*model.Metric{s.m.ID: s.m}, nil
+}
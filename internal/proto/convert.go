@@ -0,0 +1,64 @@
+package proto
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// FromModel converts a model metric. A missing value or delta is sent as zero.
+func FromModel(m model.Metric) *Metric {
+	res := &Metric{Id: m.ID, Labels: m.Labels}
+	if m.Timestamp != nil {
+		res.Timestamp = m.Timestamp.UnixMilli()
+	}
+	switch m.Type {
+	case model.Gauge:
+		res.Type = MetricType_METRIC_TYPE_GAUGE
+		if m.Value != nil {
+			res.Value = *m.Value
+		}
+	case model.Counter:
+		res.Type = MetricType_METRIC_TYPE_COUNTER
+		if m.Delta != nil {
+			res.Delta = *m.Delta
+		}
+	}
+	return res
+}
+
+// ModelType converts a metric type.
+func ModelType(t MetricType) (model.MetricType, error) {
+	switch t {
+	case MetricType_METRIC_TYPE_GAUGE:
+		return model.Gauge, nil
+	case MetricType_METRIC_TYPE_COUNTER:
+		return model.Counter, nil
+	}
+	return "", fmt.Errorf("invalid metric type %v", t)
+}
+
+// ToModel converts the metric to a model metric with the value or delta set by its type.
+func (m *Metric) ToModel() (model.Metric, error) {
+	typ, err := ModelType(m.GetType())
+	if err != nil {
+		return model.Metric{}, err
+	}
+	res := model.Metric{ID: m.GetId(), Type: typ, Labels: m.GetLabels()}
+	if len(res.Labels) == 0 {
+		res.Labels = nil
+	}
+	if ts := m.GetTimestamp(); ts != 0 {
+		t := time.UnixMilli(ts)
+		res.Timestamp = &t
+	}
+	if typ == model.Gauge {
+		v := m.GetValue()
+		res.Value = &v
+	} else {
+		d := m.GetDelta()
+		res.Delta = &d
+	}
+	return res, nil
+}
@@ -0,0 +1,4 @@
+// Package proto contains the protobuf messages and the gRPC service of the metrics API.
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
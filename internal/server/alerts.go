@@ -0,0 +1,23 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+)
+
+// AlertsHandler returns the current pending, firing and resolved alerts in JSON format.
+func (srv *Server) AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	alerts := []alerting.Alert{}
+	if srv.Alerting != nil {
+		alerts = srv.Alerting.Alerts()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(alerts); err != nil {
+		log.Printf("failed to write alerts response: %v", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	// GraphiteConnErrorsMetric counts failed accepts and connections closed on read errors.
+	GraphiteConnErrorsMetric = "GraphiteConnectionErrors"
+	// GraphiteLineErrorsMetric counts lines that could not be parsed.
+	GraphiteLineErrorsMetric = "GraphiteLineErrors"
+
+	graphiteMaxLine     = 64 << 10
+	graphiteMaxBatch    = 1000
+	graphiteIdleTimeout = 2 * time.Minute
+	// graphiteDrainTimeout is how long open connections may keep sending after shutdown starts.
+	graphiteDrainTimeout = 100 * time.Millisecond
+)
+
+// GraphiteStats holds the error counters of a GraphiteListener.
+type GraphiteStats struct {
+	ConnErrors int64 `json:"conn_errors"`
+	LineErrors int64 `json:"line_errors"`
+}
+
+// GraphiteListener receives metrics in the Graphite plaintext protocol,
+// "path value timestamp" lines, over TCP and UDP on the same port and stores them as gauges.
+// Tagged paths (path;tag=value;...) become labeled series; timestamps are ignored.
+// Error counters are kept in memory and saved as GraphiteConnErrorsMetric and
+// GraphiteLineErrorsMetric counters.
+type GraphiteListener struct {
+	save func(ctx context.Context, metrics []model.Metric) error
+
+	ln net.Listener
+	pc net.PacketConn
+
+	ctx    context.Context // canceled once shutdown completes
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+
+	connErrors atomic.Int64
+	lineErrors atomic.Int64
+}
+
+// ListenGraphite listens on the TCP and UDP address. An address with port 0 gets
+// a free TCP port, and UDP listens on the same one.
+func ListenGraphite(addr string, save func(ctx context.Context, metrics []model.Metric) error) (*GraphiteListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("graphite tcp listen: %w", err)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("graphite udp listen: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GraphiteListener{
+		save:   save,
+		ln:     ln,
+		pc:     pc,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the TCP address the listener accepts connections on.
+func (g *GraphiteListener) Addr() net.Addr {
+	return g.ln.Addr()
+}
+
+// Stats returns the error counters.
+func (g *GraphiteListener) Stats() GraphiteStats {
+	return GraphiteStats{ConnErrors: g.connErrors.Load(), LineErrors: g.lineErrors.Load()}
+}
+
+// Serve accepts TCP connections and reads UDP packets in the background.
+func (g *GraphiteListener) Serve() {
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		g.acceptLoop()
+	}()
+	go func() {
+		defer g.wg.Done()
+		g.packetLoop()
+	}()
+}
+
+// Shutdown stops accepting connections and packets, lets open connections send
+// for a short drain period and waits for them to finish. When the context is done
+// first, remaining connections are closed.
+func (g *GraphiteListener) Shutdown(ctx context.Context) error {
+	g.ln.Close()
+	g.pc.Close()
+
+	g.mu.Lock()
+	g.draining = true
+	for c := range g.conns {
+		_ = c.SetReadDeadline(time.Now().Add(graphiteDrainTimeout))
+	}
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		g.mu.Lock()
+		for c := range g.conns {
+			c.Close()
+		}
+		g.mu.Unlock()
+		<-done
+	}
+	g.cancel()
+	return err
+}
+
+func (g *GraphiteListener) acceptLoop() {
+	for {
+		conn, err := g.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			g.connError(fmt.Errorf("accept: %w", err))
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		g.mu.Lock()
+		g.conns[conn] = struct{}{}
+		if g.draining {
+			_ = conn.SetReadDeadline(time.Now().Add(graphiteDrainTimeout))
+		}
+		g.wg.Add(1)
+		g.mu.Unlock()
+
+		go func() {
+			defer g.wg.Done()
+			g.handleConn(conn)
+		}()
+	}
+}
+
+func (g *GraphiteListener) handleConn(conn net.Conn) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.conns, conn)
+		g.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, 64<<10)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), graphiteMaxLine)
+
+	var batch []model.Metric
+	var failed int64
+	for {
+		g.mu.Lock()
+		if !g.draining {
+			_ = conn.SetReadDeadline(time.Now().Add(graphiteIdleTimeout))
+		}
+		g.mu.Unlock()
+		if !sc.Scan() {
+			break
+		}
+		if m, ok := g.parseLine(sc.Text(), &failed); ok {
+			batch = append(batch, m)
+		}
+		// flush when no more data is buffered, so slow senders are not delayed
+		if len(batch) >= graphiteMaxBatch || r.Buffered() == 0 {
+			g.flush(batch, failed)
+			batch, failed = nil, 0
+		}
+	}
+	g.flush(batch, failed)
+
+	// connections closed on shutdown, drained or idle for too long are not errors
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		g.connError(fmt.Errorf("read %s: %w", conn.RemoteAddr(), err))
+	}
+}
+
+func (g *GraphiteListener) packetLoop() {
+	buf := make([]byte, graphiteMaxLine)
+	for {
+		n, _, err := g.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			g.connError(fmt.Errorf("udp read: %w", err))
+			continue
+		}
+
+		var batch []model.Metric
+		var failed int64
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if m, ok := g.parseLine(line, &failed); ok {
+				batch = append(batch, m)
+			}
+		}
+		g.flush(batch, failed)
+	}
+}
+
+// parseLine parses a non-empty line, counting invalid lines in failed.
+func (g *GraphiteListener) parseLine(line string, failed *int64) (model.Metric, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return model.Metric{}, false
+	}
+	m, err := parseGraphiteLine(line)
+	if err != nil {
+		*failed++
+		log.Printf("graphite: %v", err)
+		return model.Metric{}, false
+	}
+	return m, true
+}
+
+// flush saves parsed metrics and the line error counter.
+func (g *GraphiteListener) flush(batch []model.Metric, failed int64) {
+	if failed > 0 {
+		g.lineErrors.Add(failed)
+		batch = append(batch, model.Metric{ID: GraphiteLineErrorsMetric, Type: model.Counter, Delta: utils.I64Ptr(failed)})
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := g.save(g.ctx, batch); err != nil {
+		log.Printf("graphite: failed to save metrics: %v", err)
+	}
+}
+
+func (g *GraphiteListener) connError(err error) {
+	g.connErrors.Add(1)
+	log.Printf("graphite: %v", err)
+	m := model.Metric{ID: GraphiteConnErrorsMetric, Type: model.Counter, Delta: utils.I64Ptr(1)}
+	if err := g.save(g.ctx, []model.Metric{m}); err != nil {
+		log.Printf("graphite: failed to save metrics: %v", err)
+	}
+}
+
+// parseGraphiteLine parses "path value [timestamp]". The path may carry tags as
+// path;tag=value;... Non-finite values are rejected.
+func parseGraphiteLine(line string) (model.Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return model.Metric{}, fmt.Errorf("invalid line %q: want \"path value timestamp\"", line)
+	}
+
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return model.Metric{}, fmt.Errorf("invalid line %q: bad value", line)
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return model.Metric{}, fmt.Errorf("invalid line %q: bad timestamp", line)
+		}
+	}
+
+	parts := strings.Split(fields[0], ";")
+	m := model.Metric{ID: parts[0], Type: model.Gauge, Value: &v}
+	if m.ID == "" {
+		return model.Metric{}, fmt.Errorf("invalid line %q: empty path", line)
+	}
+	for _, tag := range parts[1:] {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok || name == "" || value == "" {
+			return model.Metric{}, fmt.Errorf("invalid line %q: bad tag %q", line, tag)
+		}
+		if m.Labels == nil {
+			m.Labels = make(map[string]string, len(parts)-1)
+		}
+		m.Labels[name] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	m, err := parseGraphiteLine("servers.web1.cpu 42.5 1700000000")
+	require.NoError(t, err)
+	require.Equal(t, model.Metric{ID: "servers.web1.cpu", Type: model.Gauge, Value: utils.F64Ptr(42.5)}, m)
+
+	m, err = parseGraphiteLine("cpu;host=web1;core=0 1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"host": "web1", "core": "0"}, m.Labels)
+
+	for _, line := range []string{"cpu", "cpu x 1", "cpu 1 soon", "cpu NaN 1", "cpu;host 1 1", ";a=b 1 1", "a 1 2 3"} {
+		_, err := parseGraphiteLine(line)
+		require.Error(t, err, line)
+	}
+}
+
+func TestGraphiteListener(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	g, err := ListenGraphite("127.0.0.1:0", st.SaveBatch)
+	require.NoError(t, err)
+	g.Serve()
+
+	conn, err := net.Dial("tcp", g.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a.b 1 1700000000\nbroken\nc;env=prod 2 1700000000\n"))
+	require.NoError(t, err)
+
+	udp, err := net.Dial("udp", g.Addr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("u.v 3 1700000000\n"))
+	require.NoError(t, err)
+
+	stored := func(m *model.Metric) bool {
+		_, err := st.Get(ctx, m)
+		return err == nil
+	}
+	require.Eventually(t, func() bool {
+		return stored(&model.Metric{ID: "a.b", Type: model.Gauge}) &&
+			stored(&model.Metric{ID: "c", Type: model.Gauge, Labels: map[string]string{"env": "prod"}}) &&
+			stored(&model.Metric{ID: "u.v", Type: model.Gauge})
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, GraphiteStats{LineErrors: 1}, g.Stats())
+	m, err := st.Get(ctx, &model.Metric{ID: GraphiteLineErrorsMetric, Type: model.Counter})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, *m.Delta)
+
+	// the open connection is drained instead of blocking shutdown
+	start := time.Now()
+	require.NoError(t, g.Shutdown(ctx))
+	require.Less(t, time.Since(start), time.Second)
+
+	_, err = net.Dial("tcp", g.Addr().String())
+	require.Error(t, err)
+}
+
+func TestGraphiteListener_ShutdownTimeout(t *testing.T) {
+	g, err := ListenGraphite("127.0.0.1:0", func(ctx context.Context, metrics []model.Metric) error {
+		time.Sleep(300 * time.Millisecond) // slow storage keeps the connection busy
+		return nil
+	})
+	require.NoError(t, err)
+	g.Serve()
+
+	conn, err := net.Dial("tcp", g.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a 1 1\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, g.Shutdown(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/and161185/metrics-alerting/cmd/server/metrics"
+	"github.com/and161185/metrics-alerting/internal/errs"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/internal/server/middleware"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metricsService implements the gRPC metrics service on top of the server storage.
+type metricsService struct {
+	pb.UnimplementedMetricsServer
+	srv      *Server
+	stopping <-chan struct{} // closed when the server shuts down
+}
+
+// UpdateMetrics validates and saves a batch of metrics like the /updates handler.
+func (s *metricsService) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	source, err := metadataSource(ctx)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.saveMetrics(ctx, source, req.GetMetrics()); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+// StreamMetrics saves batches received on the stream in order and acknowledges each
+// one. A batch that can't be saved is acknowledged with the error status and the
+// stream goes on; the stream ends when the agent closes it or, once the batch being
+// saved is acknowledged, when the server shuts down. Batches received but not saved
+// by then are left unacknowledged for the agent to send again.
+func (s *metricsService) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	ctx := stream.Context()
+	source, err := metadataSource(ctx)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	type received struct {
+		req *pb.StreamMetricsRequest
+		err error
+	}
+	done := make(chan struct{})
+	defer close(done)
+	requests := make(chan received)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case requests <- received{req, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var r received
+		select {
+		case r = <-requests:
+		case <-s.stopping:
+			return nil
+		}
+		if errors.Is(r.err, io.EOF) {
+			return nil
+		}
+		if r.err != nil {
+			return r.err
+		}
+
+		resp := &pb.StreamMetricsResponse{Seq: r.req.GetSeq()}
+		if err := s.saveMetrics(ctx, source, r.req.GetMetrics()); err != nil {
+			st := status.Convert(err)
+			resp.Code = int32(st.Code())
+			resp.Message = st.Message()
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// saveMetrics validates and saves a batch of metrics reported by the source.
+func (s *metricsService) saveMetrics(ctx context.Context, source agentInfo, batch []*pb.Metric) error {
+	if len(batch) == 0 {
+		return status.Error(codes.InvalidArgument, "no metrics")
+	}
+
+	metricsArray := make([]model.Metric, 0, len(batch))
+	for _, pm := range batch {
+		m, err := pm.ToModel()
+		if err == nil {
+			err = metrics.CheckMetric(&m)
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid metric %s: %v", pm.GetId(), err)
+		}
+		s.srv.applySource(source, &m)
+		metricsArray = append(metricsArray, m)
+	}
+
+	err := utils.WithRetry(ctx, func() error {
+		return s.srv.saveBatchToStorage(ctx, metricsArray)
+	})
+	if err != nil {
+		log.Printf("failed to save metrics: %v", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// GetMetric returns a stored metric.
+func (s *metricsService) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	typ, err := pb.ModelType(req.GetType())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	query := &model.Metric{ID: req.GetId(), Type: typ, Labels: req.GetLabels()}
+
+	var stored *model.Metric
+	err = utils.WithRetry(ctx, func() error {
+		var err error
+		stored, err = s.srv.getMetric(ctx, query)
+		return err
+	})
+	if errors.Is(err, errs.ErrMetricNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &pb.GetMetricResponse{Metric: pb.FromModel(*stored)}, nil
+}
+
+// ListMetrics returns all stored metrics ordered by series key.
+func (s *metricsService) ListMetrics(ctx context.Context, _ *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	var all map[string]*model.Metric
+	err := utils.WithRetry(ctx, func() error {
+		var err error
+		all, err = s.srv.Storage.GetAll(ctx)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to get all metrics from storage: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resp := &pb.ListMetricsResponse{Metrics: make([]*pb.Metric, 0, len(keys))}
+	for _, k := range keys {
+		resp.Metrics = append(resp.Metrics, pb.FromModel(*all[k]))
+	}
+	return resp, nil
+}
+
+// buildGRPCServer creates the gRPC server with interceptors in the order of the HTTP middleware.
+// Agent streams end when shutdownGRPC stops the server.
+func (srv *Server) buildGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			middleware.DecryptInterceptor(srv.PrivateKey, false),
+			middleware.LogInterceptor(srv.Config.Logger),
+			middleware.VerifyHashInterceptor(srv.Config),
+		),
+		grpc.ChainStreamInterceptor(
+			middleware.DecryptStreamInterceptor(srv.PrivateKey, false),
+			middleware.LogStreamInterceptor(srv.Config.Logger),
+			middleware.VerifyHashStreamInterceptor(srv.Config),
+		),
+	)
+	srv.grpcStopping = make(chan struct{})
+	pb.RegisterMetricsServer(s, &metricsService{srv: srv, stopping: srv.grpcStopping})
+	return s
+}
+
+// startGRPC starts the gRPC server if an address is configured. The returned
+// channel receives an error if serving fails; both are nil when gRPC is disabled.
+func (srv *Server) startGRPC() (*grpc.Server, <-chan error, error) {
+	if srv.Config.GRPCAddr == "" {
+		return nil, nil, nil
+	}
+	ln, err := net.Listen("tcp", srv.Config.GRPCAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("grpc listen: %w", err)
+	}
+
+	s := srv.buildGRPCServer()
+	errCh := make(chan error, 1)
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			errCh <- err
+		}
+	}()
+	return s, errCh, nil
+}
+
+// shutdownGRPC gracefully stops the gRPC server: agent streams end after acknowledging
+// the batch being saved, and remaining calls are closed after the timeout.
+func (srv *Server) shutdownGRPC(s *grpc.Server, timeout time.Duration) {
+	if s == nil {
+		return
+	}
+	close(srv.grpcStopping)
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.Stop()
+		<-done
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/client/transport"
+	"github.com/and161185/metrics-alerting/internal/config"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startBufconnServer serves the gRPC API of srv in memory and returns a connected client.
+func startBufconnServer(t *testing.T, srv *Server, opts ...grpc.DialOption) pb.MetricsClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	s := srv.buildGRPCServer()
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(s.Stop)
+
+	opts = append(opts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func TestGRPC_UpdateGetList(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	client := startBufconnServer(t, srv)
+
+	callCtx := metadata.AppendToOutgoingContext(ctx, "x-agent-id", "web-1", "x-report-interval", "5")
+	_, err := client.UpdateMetrics(callCtx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 1.5},
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 3, Labels: map[string]string{"host": "a"}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, "web-1", srv.Sources.List()[0].ID)
+
+	resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER,
+		Labels: map[string]string{"host": "a", SourceLabel: "web-1"}})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, resp.GetMetric().GetDelta())
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 2)
+	require.Equal(t, "Alloc", list.GetMetrics()[0].GetId())
+	require.Equal(t, 1.5, list.GetMetrics()[0].GetValue())
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "missing", Type: pb.MetricType_METRIC_TYPE_GAUGE})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "x"}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPC_Hash(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, nil)
+	client := startBufconnServer(t, srv, grpc.WithChainUnaryInterceptor(transport.HashInterceptor("secret")))
+
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "a", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 1,
+		Labels: map[string]string{"x": "1", "y": "2", "z": "3"}}}}
+	var header metadata.MD
+	_, err := client.UpdateMetrics(ctx, req, grpc.Header(&header))
+	require.NoError(t, err)
+	require.NotEmpty(t, header.Get("hashsha256"))
+
+	badCtx := metadata.AppendToOutgoingContext(ctx, "hashsha256", utils.CalculateHash([]byte("other"), "secret"))
+	plain := startBufconnServer(t, srv)
+	_, err = plain.UpdateMetrics(badCtx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPC_Encryption(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, priv)
+	client := startBufconnServer(t, srv, grpc.WithChainUnaryInterceptor(
+		transport.HashInterceptor("secret"), transport.EncryptInterceptor(&priv.PublicKey)))
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Secret", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 42},
+	}})
+	require.NoError(t, err)
+	m, err := st.Get(ctx, &model.Metric{ID: "Secret", Type: model.Gauge})
+	require.NoError(t, err)
+	require.Equal(t, 42.0, *m.Value)
+
+	// requests without an encrypted field pass through the encrypting interceptor
+	_, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+
+	plain := startBufconnServer(t, srv)
+	badCtx := metadata.AppendToOutgoingContext(ctx, "x-encrypted", "v1")
+	_, err = plain.UpdateMetrics(badCtx, &pb.UpdateMetricsRequest{Encrypted: []byte("garbage")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPC_StreamMetrics(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	client := startBufconnServer(t, srv)
+
+	stream, err := client.StreamMetrics(metadata.AppendToOutgoingContext(ctx, "x-agent-id", "web-1"))
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 1, Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2},
+	}}))
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 2, Metrics: []*pb.Metric{{Id: "bad"}}}))
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 3, Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 3},
+	}}))
+	require.NoError(t, stream.CloseSend())
+
+	var acks []*pb.StreamMetricsResponse
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		acks = append(acks, ack)
+	}
+	require.Len(t, acks, 3)
+	require.Equal(t, []uint64{1, 2, 3}, []uint64{acks[0].GetSeq(), acks[1].GetSeq(), acks[2].GetSeq()})
+	require.EqualValues(t, codes.OK, acks[0].GetCode())
+	require.EqualValues(t, codes.InvalidArgument, acks[1].GetCode(), "a rejected batch doesn't end the stream")
+	require.EqualValues(t, codes.OK, acks[2].GetCode())
+
+	m, err := st.Get(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Labels: map[string]string{SourceLabel: "web-1"}})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, *m.Delta)
+}
+
+func TestGRPC_StreamEndsOnShutdown(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	ln := bufconn.Listen(1 << 20)
+	s := srv.buildGRPCServer()
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := pb.NewMetricsClient(conn).StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 1, Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2},
+	}}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	require.EqualValues(t, codes.OK, ack.GetCode())
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.shutdownGRPC(s, 5*time.Second)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("graceful stop waits for the open agent stream")
+	}
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, io.EOF, "stream ends without an error")
+}
+
+func TestGRPC_StreamHashAndEncryption(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, priv)
+	client := startBufconnServer(t, srv, grpc.WithChainStreamInterceptor(
+		transport.HashStreamInterceptor("secret"), transport.EncryptStreamInterceptor(&priv.PublicKey)))
+
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 1, Metrics: []*pb.Metric{
+		{Id: "Secret", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 42, Labels: map[string]string{"a": "1", "b": "2"}},
+	}}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	require.EqualValues(t, codes.OK, ack.GetCode())
+	require.NoError(t, stream.CloseSend())
+
+	m, err := st.Get(ctx, &model.Metric{ID: "Secret", Type: model.Gauge, Labels: map[string]string{"a": "1", "b": "2"}})
+	require.NoError(t, err)
+	require.Equal(t, 42.0, *m.Value)
+
+	// a wrong hash ends the stream
+	plain := startBufconnServer(t, srv)
+	stream, err = plain.StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.StreamMetricsRequest{Seq: 1, Hash: "bad", Metrics: []*pb.Metric{
+		{Id: "a", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 1},
+	}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
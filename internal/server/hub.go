@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// subscriberBuffer is the number of updates a subscriber may fall behind before it is dropped.
+const subscriberBuffer = 256
+
+var (
+	// ErrSlowSubscriber ends a subscription that didn't keep up with the updates.
+	ErrSlowSubscriber = errors.New("subscriber too slow")
+	// ErrHubClosed ends the subscriptions of a closed hub.
+	ErrHubClosed = errors.New("hub closed")
+)
+
+// Update is a change published by the hub: a saved metric or an alert that
+// started firing or got resolved. Exactly one of the fields is set.
+type Update struct {
+	Metric *model.Metric
+	Alert  *alerting.Alert
+}
+
+// Hub publishes updates to subscribers. Publishing never blocks: a subscriber
+// whose buffer is full is dropped.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+// NewHub creates a hub without subscribers.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{}), done: make(chan struct{})}
+}
+
+// Subscription receives the updates matching its filter until it ends.
+type Subscription struct {
+	hub   *Hub
+	match func(u Update) bool
+	ch    chan Update
+	done  chan struct{}
+	err   error // set before done is closed
+}
+
+// Subscribe returns a subscription to the updates for which match returns true,
+// or to all updates if match is nil.
+func (h *Hub) Subscribe(match func(u Update) bool) *Subscription {
+	s := &Subscription{
+		hub:   h,
+		match: match,
+		ch:    make(chan Update, subscriberBuffer),
+		done:  make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		s.stop(ErrHubClosed)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Active reports whether the hub has subscribers.
+func (h *Hub) Active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// Publish sends an update to the matching subscribers, dropping those that fell behind.
+func (h *Hub) Publish(u Update) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if s.match != nil && !s.match(u) {
+			continue
+		}
+		select {
+		case s.ch <- u:
+		default:
+			delete(h.subs, s)
+			s.stop(ErrSlowSubscriber)
+		}
+	}
+}
+
+// Notify publishes an alert state change, so that the hub can be added to the alerting engine.
+func (h *Hub) Notify(_ context.Context, alert alerting.Alert) error {
+	h.Publish(Update{Alert: &alert})
+	return nil
+}
+
+// Close ends all subscriptions; later subscriptions end immediately.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		close(h.done)
+	}
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		s.stop(ErrHubClosed)
+	}
+}
+
+// Done returns a channel closed when the hub is closed.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Updates returns the channel of updates. It is not closed when the subscription ends.
+func (s *Subscription) Updates() <-chan Update {
+	return s.ch
+}
+
+// Done returns a channel closed when the subscription ends.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscription ended, or nil while it is active or after Close.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		s.stop(nil)
+	}
+}
+
+// stop ends the subscription with the reason. h.mu must be held.
+func (s *Subscription) stop(err error) {
+	s.err = err
+	close(s.done)
+}
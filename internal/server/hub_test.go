@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	require.False(t, h.Active())
+
+	all := h.Subscribe(nil)
+	gauges := h.Subscribe(func(u Update) bool { return u.Metric != nil && u.Metric.Type == model.Gauge })
+	require.True(t, h.Active())
+
+	h.Publish(Update{Metric: &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(1)}})
+	h.Publish(Update{Metric: &model.Metric{ID: "b", Type: model.Counter, Delta: utils.I64Ptr(2)}})
+	require.NoError(t, h.Notify(context.Background(), alerting.Alert{Rule: "HighLoad", State: alerting.StateFiring}))
+
+	require.Equal(t, "a", (<-all.Updates()).Metric.ID)
+	require.Equal(t, "b", (<-all.Updates()).Metric.ID)
+	require.Equal(t, "HighLoad", (<-all.Updates()).Alert.Rule)
+	require.Equal(t, "a", (<-gauges.Updates()).Metric.ID)
+	require.Empty(t, gauges.Updates())
+
+	gauges.Close()
+	require.NoError(t, gauges.Err())
+	h.Publish(Update{Metric: &model.Metric{ID: "c", Type: model.Gauge, Value: utils.F64Ptr(3)}})
+	require.Empty(t, gauges.Updates())
+
+	h.Close()
+	<-all.Done()
+	require.ErrorIs(t, all.Err(), ErrHubClosed)
+	require.False(t, h.Active())
+
+	late := h.Subscribe(nil)
+	<-late.Done()
+	require.ErrorIs(t, late.Err(), ErrHubClosed)
+}
+
+func TestHub_DropsSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	slow := h.Subscribe(nil)
+	fast := h.Subscribe(nil)
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Publish(Update{Metric: &model.Metric{ID: "a", Type: model.Gauge, Value: utils.F64Ptr(float64(i))}})
+		<-fast.Updates()
+	}
+
+	<-slow.Done()
+	require.ErrorIs(t, slow.Err(), ErrSlowSubscriber)
+	require.Len(t, slow.Updates(), subscriberBuffer, "buffered updates stay readable")
+	require.NoError(t, fast.Err())
+	require.True(t, h.Active())
+}
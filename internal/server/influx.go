@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	// maxInfluxLine limits the length of a single line protocol line.
+	maxInfluxLine = 1 << 20
+	// maxInfluxBody limits the request size.
+	maxInfluxBody = 32 << 20
+)
+
+// influxPrecisions are the units of line protocol timestamps by the precision query parameter.
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// compileInfluxCounters compiles anchored patterns of metric IDs stored as counters.
+// Invalid patterns are logged and skipped.
+func compileInfluxCounters(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			log.Printf("invalid influx counter pattern %q: %v", p, err)
+			continue
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+// InfluxWriteHandler accepts metrics in the InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Every numeric or boolean field becomes a metric named measurement_field, or just
+// measurement for a field called value, labeled with the tags. Floats, unsigned
+// integers and booleans are stored as gauges. Integers are stored as gauges, or as
+// counters if the metric name matches one of the configured counter patterns. Such
+// integers are cumulative totals, as Telegraf reports them: the increase since the
+// previous write of the series is added, so the first write only records the baseline,
+// and a decrease is taken as a counter reset. Timestamps, in the unit of the precision
+// query parameter (ns by default), order the writes of a series: points not newer than
+// the last written one are dropped. String fields are ignored.
+func (srv *Server) InfluxWriteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		http.Error(w, "unsupported precision", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := parseInfluxLines(http.MaxBytesReader(w, r.Body, maxInfluxBody), srv.influxCounters, precision)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range samples {
+		srv.applySource(source, &samples[i].metric)
+	}
+
+	metricsArray, done, err := srv.influxSums.metrics(ctx, samples)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	saved := false
+	defer func() { done(saved) }()
+	if len(metricsArray) > 0 {
+		err = utils.WithRetry(ctx, func() error {
+			return srv.saveBatchToStorage(ctx, metricsArray)
+		})
+		if err != nil {
+			log.Printf("failed to save influx metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	saved = true
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseInfluxLines parses a line protocol body with timestamps in the precision unit.
+// Blank lines and comments are skipped.
+func parseInfluxLines(body io.Reader, counters []*regexp.Regexp, precision time.Duration) ([]sumSample, error) {
+	var res []sumSample
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 64<<10), maxInfluxLine)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		samples, err := parseInfluxLine(line, counters, precision)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		res = append(res, samples...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return res, nil
+}
+
+func parseInfluxLine(line string, counters []*regexp.Regexp, precision time.Duration) ([]sumSample, error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, errors.New("want measurement, fields and optional timestamp")
+	}
+	var ts int64
+	if len(sections) == 3 {
+		v, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil || v <= 0 || v > math.MaxInt64/int64(precision) {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		ts = v * int64(precision)
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(series[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+
+	var labels map[string]string
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(series)-1)
+		}
+		labels[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	var res []sumSample
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		key, value, ok := cutUnescaped(field, '=')
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		key = unescapeInflux(key)
+
+		id := measurement + "_" + key
+		if key == "value" {
+			id = measurement
+		}
+		s, ok, err := influxFieldSample(id, value, counters)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", key, err)
+		}
+		if !ok {
+			continue
+		}
+		s.metric.Labels = labels
+		s.time = ts
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// influxFieldSample converts a field value; ok is false for string fields.
+// Integers of counters are cumulative sums.
+func influxFieldSample(id, value string, counters []*regexp.Regexp) (s sumSample, ok bool, err error) {
+	s.metric = model.Metric{ID: id, Type: model.Gauge}
+	switch last := value[len(value)-1]; {
+	case value[0] == '"':
+		if len(value) < 2 || last != '"' {
+			return s, false, errors.New("unterminated string")
+		}
+		return s, false, nil
+	case last == 'i':
+		v, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return s, false, errors.New("invalid integer")
+		}
+		s.value = float64(v)
+		if matchesAny(counters, id) {
+			s.metric.Type, s.cumulative = model.Counter, true
+		}
+	case last == 'u':
+		v, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return s, false, errors.New("invalid unsigned integer")
+		}
+		s.value = float64(v)
+	default:
+		switch value {
+		case "t", "T", "true", "True", "TRUE":
+			s.value = 1
+		case "f", "F", "false", "False", "FALSE":
+			s.value = 0
+		default:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return s, false, errors.New("invalid float")
+			}
+			s.value = v
+		}
+	}
+	return s, true, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitUnescaped splits s at sep characters that are not escaped with a backslash
+// and, if quotes is set, not inside double-quoted strings.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var res []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+// cutUnescaped cuts s around the first unescaped sep.
+func cutUnescaped(s string, sep byte) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// unescapeInflux removes backslashes escaping commas, spaces and equal signs.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
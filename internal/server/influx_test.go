@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseInfluxLines(t *testing.T) {
+	counters := compileInfluxCounters([]string{"net_.*", "("})
+	body := strings.Join([]string{
+		"# comment",
+		`cpu,host=web\ 1,core=0 usage_idle=97.5,busy=t 1700000000000000000`,
+		`net,iface=eth0 bytes_recv=120i,drops=3u`,
+		`disk\,io value=4i,label="sda\" root"`,
+		``,
+	}, "\n")
+
+	got, err := parseInfluxLines(strings.NewReader(body), counters, time.Nanosecond)
+	require.NoError(t, err)
+
+	cpu := map[string]string{"host": "web 1", "core": "0"}
+	require.Equal(t, []sumSample{
+		{metric: model.Metric{ID: "cpu_usage_idle", Type: model.Gauge, Labels: cpu}, value: 97.5, time: 1700000000000000000},
+		{metric: model.Metric{ID: "cpu_busy", Type: model.Gauge, Labels: cpu}, value: 1, time: 1700000000000000000},
+		{metric: model.Metric{ID: "net_bytes_recv", Type: model.Counter, Labels: map[string]string{"iface": "eth0"}}, value: 120, cumulative: true},
+		{metric: model.Metric{ID: "net_drops", Type: model.Gauge, Labels: map[string]string{"iface": "eth0"}}, value: 3},
+		{metric: model.Metric{ID: "disk,io", Type: model.Gauge}, value: 4},
+	}, got)
+
+	got, err = parseInfluxLines(strings.NewReader("cpu usage=1 1700000000"), nil, time.Second)
+	require.NoError(t, err)
+	require.EqualValues(t, 1700000000*int64(time.Second), got[0].time)
+}
+
+func TestParseInfluxLines_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"cpu",
+		"cpu usage=1 ts",
+		"cpu usage=1 -5",
+		"cpu,host usage=1",
+		"cpu usage",
+		"cpu usage=abc",
+		"cpu usage=1.5i",
+		`cpu usage="open`,
+		",host=a usage=1",
+		"cpu usage=1 1 extra",
+	} {
+		_, err := parseInfluxLines(strings.NewReader(line), nil, time.Nanosecond)
+		require.Error(t, err, line)
+	}
+	_, err := parseInfluxLines(strings.NewReader("cpu usage=1 9000000000000"), nil, time.Second)
+	require.Error(t, err, "timestamp overflow")
+}
+
+func TestInfluxWriteHandler(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{
+		Logger:         zap.NewNop().Sugar(),
+		InfluxCounters: []string{"requests_.*"},
+	}, nil)
+	h := srv.buildRouter()
+
+	post := func(query, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/write"+query, strings.NewReader(body))
+		req.Header.Set(AgentIDHeader, "telegraf-1")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	labels := map[string]string{"route": "/a", SourceLabel: "telegraf-1"}
+	count := func() int64 {
+		m, err := st.Get(ctx, &model.Metric{ID: "requests_count", Type: model.Counter, Labels: labels})
+		require.NoError(t, err)
+		return *m.Delta
+	}
+
+	require.Equal(t, http.StatusNoContent, post("", "requests,route=/a count=2i\nmem used_percent=41.5"))
+	_, err := st.Get(ctx, &model.Metric{ID: "requests_count", Type: model.Counter, Labels: labels})
+	require.Error(t, err, "the first cumulative value is the baseline")
+	require.Equal(t, http.StatusNoContent, post("", "requests,route=/a count=5i"))
+	require.EqualValues(t, 3, count())
+	require.Equal(t, http.StatusNoContent, post("", "requests,route=/a count=1i"))
+	require.EqualValues(t, 4, count(), "a decrease is a reset")
+	require.Equal(t, http.StatusBadRequest, post("", "broken"))
+	require.Equal(t, http.StatusBadRequest, post("?precision=d", "mem used_percent=1"))
+
+	m, err := st.Get(ctx, &model.Metric{ID: "mem_used_percent", Type: model.Gauge, Labels: map[string]string{SourceLabel: "telegraf-1"}})
+	require.NoError(t, err)
+	require.Equal(t, 41.5, *m.Value)
+
+	require.Equal(t, http.StatusNoContent, post("?precision=s", "requests,route=/a count=11i 1700000010\nmem used_percent=50 1700000010"))
+	require.EqualValues(t, 14, count())
+	require.Equal(t, http.StatusNoContent, post("?precision=s", "requests,route=/a count=9i 1700000005\nmem used_percent=45 1700000005"))
+	require.EqualValues(t, 14, count(), "older points are dropped")
+	m, err = st.Get(ctx, &model.Metric{ID: "mem_used_percent", Type: model.Gauge, Labels: map[string]string{SourceLabel: "telegraf-1"}})
+	require.NoError(t, err)
+	require.Equal(t, 50.0, *m.Value)
+
+	require.Equal(t, http.StatusBadRequest, post("", strings.Repeat("mem used_percent=1\n", maxInfluxBody/19+1)))
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/and161185/metrics-alerting/internal/errs"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// getMetric returns the stored series of the metric. If no series has exactly its
+// labels, the most recently written series with the same ID and type whose labels
+// include them is returned. Agents label their metrics with host and source, so
+// /value/gauge/Alloc and ?source=<agent> still find them.
+func (srv *Server) getMetric(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+	stored, err := srv.Storage.Get(ctx, m)
+	if !errors.Is(err, errs.ErrMetricNotFound) {
+		return stored, err
+	}
+	return srv.Storage.GetLatest(ctx, m)
+}
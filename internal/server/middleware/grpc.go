@@ -0,0 +1,257 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rsa"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// gRPC metadata keys, the lowercase forms of the HTTP headers.
+const (
+	hashMetadata      = "hashsha256"
+	encryptedMetadata = "x-encrypted"
+
+	// encryptedField is the bytes field holding an encrypted request.
+	encryptedField = "encrypted"
+	// hashField is the string field holding the hash of a stream message.
+	hashField = "hash"
+)
+
+// LogInterceptor logs unary calls like LogMiddleware logs HTTP requests.
+func LogInterceptor(logger *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		duration := time.Since(start)
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		logger.Infof(
+			"method=%s status=%s size=%d duration=%s request=%v metadata=%v",
+			info.FullMethod, status.Code(err), messageSize(resp), duration, req, md,
+		)
+		return resp, err
+	}
+}
+
+// VerifyHashInterceptor validates the hashsha256 metadata of unary calls like
+// VerifyHashMiddleware: the hash covers the deterministic protobuf encoding of the
+// request, and the response hash is sent in the header metadata.
+func VerifyHashInterceptor(cfg *config.ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if cfg.Key == "" {
+			return handler(ctx, req)
+		}
+
+		if hash := firstMetadata(ctx, hashMetadata); hash != "" {
+			sum, err := messageHash(req, cfg.Key)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, "bad request")
+			}
+			if hash != sum {
+				return nil, status.Error(codes.InvalidArgument, "invalid hash")
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		if sum, hashErr := messageHash(resp, cfg.Key); hashErr == nil {
+			_ = grpc.SetHeader(ctx, metadata.Pairs(hashMetadata, sum))
+		}
+		return resp, nil
+	}
+}
+
+// DecryptInterceptor decrypts requests sent with x-encrypted metadata v1 like
+// DecryptMiddleware. The encrypted field of such a request holds the encrypted
+// protobuf encoding of the request. Without a private key calls pass through.
+func DecryptInterceptor(priv *rsa.PrivateKey, require bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if priv == nil {
+			return handler(ctx, req)
+		}
+		if err := decryptMessage(ctx, priv, require, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// LogStreamInterceptor logs streaming calls once they end, with the number of
+// messages received and sent.
+func LogStreamInterceptor(logger *zap.SugaredLogger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		cs := &countingStream{ServerStream: ss}
+		err := handler(srv, cs)
+		duration := time.Since(start)
+
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		logger.Infof(
+			"method=%s status=%s received=%d sent=%d duration=%s metadata=%v",
+			info.FullMethod, status.Code(err), cs.received, cs.sent, duration, md,
+		)
+		return err
+	}
+}
+
+// VerifyHashStreamInterceptor validates the hash field of stream messages: it covers
+// the deterministic protobuf encoding of the message with the hash unset.
+// Messages without a hash are accepted; a mismatch ends the stream.
+func VerifyHashStreamInterceptor(cfg *config.ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if cfg.Key == "" {
+			return handler(srv, ss)
+		}
+		return handler(srv, &recvStream{ServerStream: ss, after: func(m any) error {
+			return verifyMessageHash(m, cfg.Key)
+		}})
+	}
+}
+
+// DecryptStreamInterceptor decrypts the messages of streams opened with x-encrypted
+// metadata v1, each carrying its encrypted protobuf encoding in the encrypted field.
+// Without a private key streams pass through.
+func DecryptStreamInterceptor(priv *rsa.PrivateKey, require bool) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if priv == nil {
+			return handler(srv, ss)
+		}
+		return handler(srv, &recvStream{ServerStream: ss, after: func(m any) error {
+			return decryptMessage(ss.Context(), priv, require, m)
+		}})
+	}
+}
+
+// recvStream runs a check on every received message.
+type recvStream struct {
+	grpc.ServerStream
+	after func(m any) error
+}
+
+func (s *recvStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.after(m)
+}
+
+// countingStream counts the messages of a stream.
+type countingStream struct {
+	grpc.ServerStream
+	received, sent int
+}
+
+func (s *countingStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received++
+	}
+	return err
+}
+
+func (s *countingStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent++
+	}
+	return err
+}
+
+// verifyMessageHash checks and clears the hash field of a message.
+func verifyMessageHash(m any, key string) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Error(codes.InvalidArgument, "bad request")
+	}
+	field := msg.ProtoReflect().Descriptor().Fields().ByName(hashField)
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return nil
+	}
+	hash := msg.ProtoReflect().Get(field).String()
+	if hash == "" {
+		return nil
+	}
+	msg.ProtoReflect().Clear(field)
+	sum, err := messageHash(msg, key)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "bad request")
+	}
+	if hash != sum {
+		return status.Error(codes.InvalidArgument, "invalid hash")
+	}
+	return nil
+}
+
+// decryptMessage replaces an encrypted request with its decrypted contents.
+func decryptMessage(ctx context.Context, priv *rsa.PrivateKey, require bool, req any) error {
+	ver := firstMetadata(ctx, encryptedMetadata)
+	if ver == "" {
+		if require {
+			return status.Error(codes.InvalidArgument, "encryption required")
+		}
+		return nil
+	}
+	if ver != "v1" {
+		return status.Error(codes.InvalidArgument, "unsupported encryption version")
+	}
+
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return status.Error(codes.InvalidArgument, "request can't be encrypted")
+	}
+	field := msg.ProtoReflect().Descriptor().Fields().ByName(encryptedField)
+	if field == nil || field.Kind() != protoreflect.BytesKind {
+		return status.Error(codes.InvalidArgument, "request can't be encrypted")
+	}
+
+	plain, err := crypto.DecryptEnvelope(priv, msg.ProtoReflect().Get(field).Bytes())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "decrypt failed")
+	}
+	proto.Reset(msg)
+	if err := proto.Unmarshal(plain, msg); err != nil {
+		return status.Error(codes.InvalidArgument, "decrypt failed")
+	}
+	return nil
+}
+
+// messageHash returns the keyed hash of the deterministic protobuf encoding of a message.
+func messageHash(m any, key string) (string, error) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return "", status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return utils.CalculateHash(b, key), nil
+}
+
+func firstMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func messageSize(m any) int {
+	if msg, ok := m.(proto.Message); ok {
+		return proto.Size(msg)
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	pb "github.com/and161185/metrics-alerting/internal/proto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var unaryInfo = &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/UpdateMetrics"}
+
+func echoHandler(_ context.Context, req any) (any, error) {
+	return req, nil
+}
+
+func incoming(kv ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(kv...))
+}
+
+func TestLogInterceptor(t *testing.T) {
+	core, obs := observer.New(zap.InfoLevel)
+	i := LogInterceptor(zap.New(core).Sugar())
+
+	_, err := i(context.Background(), &pb.ListMetricsRequest{}, unaryInfo, func(context.Context, any) (any, error) {
+		return nil, status.Error(codes.NotFound, "nope")
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Len(t, obs.All(), 1)
+	require.Contains(t, obs.All()[0].Message, "status=NotFound")
+}
+
+func TestVerifyHashInterceptor(t *testing.T) {
+	req := &pb.GetMetricRequest{Id: "a", Labels: map[string]string{"x": "1", "y": "2"}}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+
+	i := VerifyHashInterceptor(&config.ServerConfig{Key: "k"})
+	_, err = i(incoming("hashsha256", utils.CalculateHash(b, "k")), req, unaryInfo, echoHandler)
+	require.NoError(t, err)
+	_, err = i(context.Background(), req, unaryInfo, echoHandler)
+	require.NoError(t, err, "hash is optional")
+	_, err = i(incoming("hashsha256", "bad"), req, unaryInfo, echoHandler)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = VerifyHashInterceptor(&config.ServerConfig{})(incoming("hashsha256", "bad"), req, unaryInfo, echoHandler)
+	require.NoError(t, err, "no key")
+}
+
+func TestDecryptInterceptor(t *testing.T) {
+	priv, pub := genKey(t)
+	plain, err := proto.Marshal(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "a"}}})
+	require.NoError(t, err)
+	env, err := crypto.EncryptEnvelope(pub, plain)
+	require.NoError(t, err)
+
+	i := DecryptInterceptor(priv, false)
+	resp, err := i(incoming("x-encrypted", "v1"), &pb.UpdateMetricsRequest{Encrypted: env}, unaryInfo, echoHandler)
+	require.NoError(t, err)
+	require.Equal(t, "a", resp.(*pb.UpdateMetricsRequest).GetMetrics()[0].GetId())
+	require.Empty(t, resp.(*pb.UpdateMetricsRequest).GetEncrypted())
+
+	_, err = i(context.Background(), &pb.ListMetricsRequest{}, unaryInfo, echoHandler)
+	require.NoError(t, err, "unencrypted requests pass")
+	_, err = DecryptInterceptor(priv, true)(context.Background(), &pb.ListMetricsRequest{}, unaryInfo, echoHandler)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "encryption required")
+	_, err = i(incoming("x-encrypted", "v2"), &pb.UpdateMetricsRequest{Encrypted: env}, unaryInfo, echoHandler)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = i(incoming("x-encrypted", "v1"), &pb.ListMetricsRequest{}, unaryInfo, echoHandler)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "no encrypted field")
+
+	_, err = DecryptInterceptor(nil, true)(incoming("x-encrypted", "v1"), &pb.ListMetricsRequest{}, unaryInfo, echoHandler)
+	require.NoError(t, err, "no key")
+}
+
+// fakeServerStream receives the queued messages.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	msgs []proto.Message
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func (s *fakeServerStream) RecvMsg(m any) error {
+	proto.Merge(m.(proto.Message), s.msgs[0])
+	s.msgs = s.msgs[1:]
+	return nil
+}
+
+var streamInfo = &grpc.StreamServerInfo{FullMethod: "/metrics.Metrics/StreamMetrics", IsClientStream: true}
+
+// recvOne returns the first message received by the handler of the interceptor.
+func recvOne(i grpc.StreamServerInterceptor, ss grpc.ServerStream) (*pb.StreamMetricsRequest, error) {
+	req := &pb.StreamMetricsRequest{}
+	err := i(nil, ss, streamInfo, func(_ any, ss grpc.ServerStream) error { return ss.RecvMsg(req) })
+	return req, err
+}
+
+func TestVerifyHashStreamInterceptor(t *testing.T) {
+	req := &pb.StreamMetricsRequest{Seq: 1, Metrics: []*pb.Metric{{Id: "a"}}}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+	signed := proto.Clone(req).(*pb.StreamMetricsRequest)
+	signed.Hash = utils.CalculateHash(b, "k")
+
+	i := VerifyHashStreamInterceptor(&config.ServerConfig{Key: "k"})
+	got, err := recvOne(i, &fakeServerStream{ctx: context.Background(), msgs: []proto.Message{signed}})
+	require.NoError(t, err)
+	require.Empty(t, got.GetHash())
+	_, err = recvOne(i, &fakeServerStream{ctx: context.Background(), msgs: []proto.Message{req}})
+	require.NoError(t, err, "hash is optional")
+	_, err = recvOne(i, &fakeServerStream{ctx: context.Background(), msgs: []proto.Message{&pb.StreamMetricsRequest{Seq: 2, Hash: signed.Hash}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDecryptStreamInterceptor(t *testing.T) {
+	priv, pub := genKey(t)
+	plain, err := proto.Marshal(&pb.StreamMetricsRequest{Seq: 7})
+	require.NoError(t, err)
+	env, err := crypto.EncryptEnvelope(pub, plain)
+	require.NoError(t, err)
+
+	i := DecryptStreamInterceptor(priv, false)
+	got, err := recvOne(i, &fakeServerStream{ctx: incoming("x-encrypted", "v1"), msgs: []proto.Message{&pb.StreamMetricsRequest{Encrypted: env}}})
+	require.NoError(t, err)
+	require.EqualValues(t, 7, got.GetSeq())
+
+	_, err = recvOne(i, &fakeServerStream{ctx: incoming("x-encrypted", "v1"), msgs: []proto.Message{&pb.StreamMetricsRequest{Encrypted: []byte("bad")}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = recvOne(DecryptStreamInterceptor(priv, true), &fakeServerStream{ctx: context.Background(), msgs: []proto.Message{&pb.StreamMetricsRequest{}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "encryption required")
+}
@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -58,6 +60,20 @@ func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush event streams.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// Hijack lets WebSocket handlers take over the connection.
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(lrw.ResponseWriter).Hijack()
+	if err == nil {
+		lrw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
 func isProbablyText(b []byte) bool {
 	for _, c := range b {
 		if c == 0 || c > 127 {
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/and161185/metrics-alerting/cmd/server/metrics"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpProtobufContentType = "application/x-protobuf"
+	otlpJSONContentType     = "application/json"
+	// maxOTLPBody limits the decoded request size.
+	maxOTLPBody = 32 << 20
+)
+
+// Field numbers of the OTLP metrics protobuf messages (opentelemetry.proto.metrics.v1).
+const (
+	otlpRequestResourceMetrics  = 1  // ExportMetricsServiceRequest.resource_metrics
+	otlpResourceMetricsResource = 1  // ResourceMetrics.resource
+	otlpResourceMetricsScope    = 2  // ResourceMetrics.scope_metrics
+	otlpResourceAttributes      = 1  // Resource.attributes
+	otlpScopeMetricsMetrics     = 2  // ScopeMetrics.metrics
+	otlpMetricName              = 1  // Metric.name
+	otlpMetricGauge             = 5  // Metric.gauge
+	otlpMetricSum               = 7  // Metric.sum
+	otlpMetricHistogram         = 9  // Metric.histogram
+	otlpMetricExpHistogram      = 10 // Metric.exponential_histogram
+	otlpMetricSummary           = 11 // Metric.summary
+	otlpDataPoints              = 1  // data_points of Gauge, Sum, Histogram and Summary
+	otlpSumTemporality          = 2  // Sum.aggregation_temporality
+	otlpSumMonotonic            = 3  // Sum.is_monotonic
+	otlpPointStartTime          = 2  // NumberDataPoint.start_time_unix_nano: fixed64
+	otlpPointAsDouble           = 4  // NumberDataPoint.as_double: double
+	otlpPointAsInt              = 6  // NumberDataPoint.as_int: sfixed64
+	otlpPointAttributes         = 7  // NumberDataPoint.attributes
+	otlpKeyValueKey             = 1  // KeyValue.key
+	otlpKeyValueValue           = 2  // KeyValue.value: AnyValue
+	otlpAnyString               = 1  // AnyValue.string_value
+	otlpAnyBool                 = 2  // AnyValue.bool_value
+	otlpAnyInt                  = 3  // AnyValue.int_value
+	otlpAnyDouble               = 4  // AnyValue.double_value
+
+	otlpResponsePartialSuccess = 1 // ExportMetricsServiceResponse.partial_success
+	otlpPartialRejected        = 1 // ExportMetricsPartialSuccess.rejected_data_points
+	otlpPartialMessage         = 2 // ExportMetricsPartialSuccess.error_message
+)
+
+// Metric data kinds and Sum aggregation temporalities.
+const (
+	otlpKindGauge = iota + 1
+	otlpKindSum
+	otlpKindUnsupported // histograms and summaries
+
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// otlpResource holds the metrics of one ResourceMetrics message.
+type otlpResource struct {
+	attrs   map[string]string
+	metrics []otlpMetric
+}
+
+type otlpMetric struct {
+	name        string
+	kind        int
+	temporality int
+	monotonic   bool
+	points      []otlpPoint
+	unsupported int // data points of unsupported kinds
+}
+
+type otlpPoint struct {
+	attrs    map[string]string
+	start    uint64
+	value    float64
+	hasValue bool
+}
+
+// OTLPMetricsHandler accepts OpenTelemetry OTLP/HTTP metric exports encoded as
+// protobuf or JSON. Gauge data points are stored as gauges. Monotonic sums are
+// stored as counters: delta sums add their values, cumulative sums add the
+// increase since the previous export of the series, so the first export only
+// records the baseline. Non-monotonic cumulative sums are stored as gauges.
+// Series are labeled with the resource attributes overridden by the data point
+// attributes; attributes with empty keys or non-scalar values are dropped.
+// Histograms, summaries, non-monotonic delta sums, sums without a temporality
+// and non-finite values are rejected and reported in the partial success of
+// the response.
+func (srv *Server) OTLPMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != otlpProtobufContentType && contentType != otlpJSONContentType {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOTLPBody))
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+
+	var resources []otlpResource
+	if contentType == otlpJSONContentType {
+		resources, err = decodeOTLPJSON(body)
+	} else {
+		resources, err = decodeOTLPRequest(body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid export request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, rejected := otlpSamples(resources)
+	for i := range samples {
+		srv.applySource(source, &samples[i].metric)
+	}
+	metricsArray, done, err := srv.otlpSums.metrics(ctx, samples)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	saved := false
+	defer func() { done(saved) }()
+	for i := range metricsArray {
+		if err := metrics.CheckMetric(&metricsArray[i]); err != nil {
+			http.Error(w, fmt.Sprintf("invalid metric %s: %v", metricsArray[i].Key(), err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(metricsArray) > 0 {
+		err = utils.WithRetry(ctx, func() error {
+			return srv.saveBatchToStorage(ctx, metricsArray)
+		})
+		if err != nil {
+			log.Printf("failed to save otlp metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	saved = true
+
+	var msg string
+	if rejected > 0 {
+		msg = fmt.Sprintf("%d data points rejected: only gauges, monotonic sums and cumulative sums with finite values are supported", rejected)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if contentType == otlpJSONContentType {
+		_, _ = w.Write(encodeOTLPJSONResponse(rejected, msg))
+	} else {
+		_, _ = w.Write(encodeOTLPResponse(rejected, msg))
+	}
+}
+
+// otlpSamples maps gauge and sum data points to samples and counts the rejected ones.
+func otlpSamples(resources []otlpResource) ([]sumSample, int64) {
+	var res []sumSample
+	var rejected int64
+	for _, rm := range resources {
+		for _, m := range rm.metrics {
+			rejected += int64(m.unsupported)
+			if m.kind == otlpKindSum && m.temporality != otlpTemporalityCumulative &&
+				(!m.monotonic || m.temporality != otlpTemporalityDelta) {
+				rejected += int64(len(m.points))
+				continue
+			}
+			for _, p := range m.points {
+				if !p.hasValue || math.IsNaN(p.value) || math.IsInf(p.value, 0) {
+					rejected++
+					continue
+				}
+				s := sumSample{
+					metric: model.Metric{ID: m.name, Type: model.Gauge, Labels: mergeLabels(rm.attrs, p.attrs)},
+					value:  p.value,
+				}
+				if m.kind == otlpKindSum && m.monotonic {
+					s.metric.Type = model.Counter
+					s.cumulative = m.temporality == otlpTemporalityCumulative
+					s.start = p.start
+				}
+				res = append(res, s)
+			}
+		}
+	}
+	return res, rejected
+}
+
+// mergeLabels returns the union of both label sets; labels of b take precedence.
+func mergeLabels(a, b map[string]string) map[string]string {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		res[k] = v
+	}
+	for k, v := range b {
+		res[k] = v
+	}
+	return res
+}
+
+// decodeOTLPRequest decodes an ExportMetricsServiceRequest, skipping unknown fields.
+func decodeOTLPRequest(b []byte) ([]otlpResource, error) {
+	var res []otlpResource
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != otlpRequestResourceMetrics || typ != protowire.BytesType {
+			return nil
+		}
+		rm, err := decodeOTLPResourceMetrics(v)
+		if err != nil {
+			return err
+		}
+		res = append(res, rm)
+		return nil
+	})
+	return res, err
+}
+
+func decodeOTLPResourceMetrics(b []byte) (otlpResource, error) {
+	var res otlpResource
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case otlpResourceMetricsResource:
+			attrs, err := decodeOTLPAttributes(v, otlpResourceAttributes)
+			if err != nil {
+				return err
+			}
+			res.attrs = attrs
+		case otlpResourceMetricsScope:
+			return forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if num != otlpScopeMetricsMetrics || typ != protowire.BytesType {
+					return nil
+				}
+				m, err := decodeOTLPMetric(v)
+				if err != nil {
+					return err
+				}
+				res.metrics = append(res.metrics, m)
+				return nil
+			})
+		}
+		return nil
+	})
+	return res, err
+}
+
+func decodeOTLPMetric(b []byte) (otlpMetric, error) {
+	var m otlpMetric
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case otlpMetricName:
+			m.name = string(v)
+		case otlpMetricGauge, otlpMetricSum:
+			m.kind = otlpKindGauge
+			if num == otlpMetricSum {
+				m.kind = otlpKindSum
+			}
+			return forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == otlpDataPoints && typ == protowire.BytesType:
+					p, err := decodeOTLPPoint(v)
+					if err != nil {
+						return err
+					}
+					m.points = append(m.points, p)
+				case num == otlpSumTemporality && typ == protowire.VarintType:
+					t, _ := protowire.ConsumeVarint(v)
+					m.temporality = int(t)
+				case num == otlpSumMonotonic && typ == protowire.VarintType:
+					mono, _ := protowire.ConsumeVarint(v)
+					m.monotonic = mono != 0
+				}
+				return nil
+			})
+		case otlpMetricHistogram, otlpMetricExpHistogram, otlpMetricSummary:
+			m.kind = otlpKindUnsupported
+			return forEachField(v, func(num protowire.Number, typ protowire.Type, _ []byte) error {
+				if num == otlpDataPoints && typ == protowire.BytesType {
+					m.unsupported++
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err == nil && m.kind != 0 && m.name == "" {
+		err = errors.New("metric without name")
+	}
+	return m, err
+}
+
+func decodeOTLPPoint(b []byte) (otlpPoint, error) {
+	var p otlpPoint
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == otlpPointAttributes && typ == protowire.BytesType:
+			key, value, ok, err := decodeOTLPKeyValue(v)
+			if err != nil || !ok || key == "" {
+				return err
+			}
+			if p.attrs == nil {
+				p.attrs = make(map[string]string)
+			}
+			p.attrs[key] = value
+		case num == otlpPointStartTime && typ == protowire.Fixed64Type:
+			p.start, _ = protowire.ConsumeFixed64(v)
+		case num == otlpPointAsDouble && typ == protowire.Fixed64Type:
+			bits, _ := protowire.ConsumeFixed64(v)
+			p.value, p.hasValue = math.Float64frombits(bits), true
+		case num == otlpPointAsInt && typ == protowire.Fixed64Type:
+			bits, _ := protowire.ConsumeFixed64(v)
+			p.value, p.hasValue = float64(int64(bits)), true
+		}
+		return nil
+	})
+	return p, err
+}
+
+// decodeOTLPAttributes decodes the KeyValue fields with the given number of a message.
+func decodeOTLPAttributes(b []byte, field protowire.Number) (map[string]string, error) {
+	var attrs map[string]string
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != field || typ != protowire.BytesType {
+			return nil
+		}
+		key, value, ok, err := decodeOTLPKeyValue(v)
+		if err != nil || !ok || key == "" {
+			return err
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[key] = value
+		return nil
+	})
+	return attrs, err
+}
+
+// decodeOTLPKeyValue decodes an attribute; ok is false for non-scalar values.
+func decodeOTLPKeyValue(b []byte) (key, value string, ok bool, err error) {
+	err = forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case otlpKeyValueKey:
+			key = string(v)
+		case otlpKeyValueValue:
+			return forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == otlpAnyString && typ == protowire.BytesType:
+					value, ok = string(v), true
+				case num == otlpAnyBool && typ == protowire.VarintType:
+					b, _ := protowire.ConsumeVarint(v)
+					value, ok = strconv.FormatBool(b != 0), true
+				case num == otlpAnyInt && typ == protowire.VarintType:
+					i, _ := protowire.ConsumeVarint(v)
+					value, ok = strconv.FormatInt(int64(i), 10), true
+				case num == otlpAnyDouble && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					value, ok = strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64), true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return key, value, ok, err
+}
+
+// encodeOTLPResponse encodes an ExportMetricsServiceResponse.
+func encodeOTLPResponse(rejected int64, msg string) []byte {
+	if rejected == 0 {
+		return nil
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, otlpPartialRejected, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, otlpPartialMessage, protowire.BytesType)
+	partial = protowire.AppendString(partial, msg)
+
+	b := protowire.AppendTag(nil, otlpResponsePartialSuccess, protowire.BytesType)
+	return protowire.AppendBytes(b, partial)
+}
+
+// OTLP JSON encoding: protobuf JSON mapping with lowerCamelCase field names,
+// 64-bit integers as strings and enums as numbers or names.
+
+type otlpJSONRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otlpJSONMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpJSONMetric struct {
+	Name  string `json:"name"`
+	Gauge *struct {
+		DataPoints []otlpJSONPoint `json:"dataPoints"`
+	} `json:"gauge"`
+	Sum *struct {
+		DataPoints             []otlpJSONPoint `json:"dataPoints"`
+		AggregationTemporality otlpJSONScalar  `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	} `json:"sum"`
+	Histogram            *otlpJSONUnsupported `json:"histogram"`
+	ExponentialHistogram *otlpJSONUnsupported `json:"exponentialHistogram"`
+	Summary              *otlpJSONUnsupported `json:"summary"`
+}
+
+type otlpJSONUnsupported struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type otlpJSONPoint struct {
+	Attributes        []otlpJSONKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpJSONScalar     `json:"startTimeUnixNano"`
+	AsDouble          *otlpJSONScalar    `json:"asDouble"`
+	AsInt             *otlpJSONScalar    `json:"asInt"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string         `json:"stringValue"`
+		BoolValue   *bool           `json:"boolValue"`
+		IntValue    *otlpJSONScalar `json:"intValue"`
+		DoubleValue *otlpJSONScalar `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// otlpJSONScalar is a number that may be encoded as a JSON number or string.
+type otlpJSONScalar string
+
+// UnmarshalJSON accepts numbers and strings.
+func (s *otlpJSONScalar) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var str string
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+		*s = otlpJSONScalar(str)
+		return nil
+	}
+	*s = otlpJSONScalar(b)
+	return nil
+}
+
+func (s otlpJSONScalar) float() (float64, error) {
+	return strconv.ParseFloat(string(s), 64)
+}
+
+func (s otlpJSONScalar) int() (int64, error) {
+	return strconv.ParseInt(string(s), 10, 64)
+}
+
+func (s otlpJSONScalar) uint() (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(s), 10, 64)
+}
+
+// temporality accepts the enum number or name.
+func (s otlpJSONScalar) temporality() (int, error) {
+	switch strings.ToUpper(string(s)) {
+	case "", "AGGREGATION_TEMPORALITY_UNSPECIFIED":
+		return 0, nil
+	case "AGGREGATION_TEMPORALITY_DELTA":
+		return otlpTemporalityDelta, nil
+	case "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		return otlpTemporalityCumulative, nil
+	}
+	return strconv.Atoi(string(s))
+}
+
+// decodeOTLPJSON decodes an ExportMetricsServiceRequest in the OTLP JSON encoding.
+func decodeOTLPJSON(b []byte) ([]otlpResource, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+
+	res := make([]otlpResource, 0, len(req.ResourceMetrics))
+	for _, rm := range req.ResourceMetrics {
+		attrs, err := otlpJSONAttributes(rm.Resource.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		resource := otlpResource{attrs: attrs}
+		for _, sm := range rm.ScopeMetrics {
+			for _, jm := range sm.Metrics {
+				m, err := jm.metric()
+				if err != nil {
+					return nil, fmt.Errorf("metric %q: %w", jm.Name, err)
+				}
+				resource.metrics = append(resource.metrics, m)
+			}
+		}
+		res = append(res, resource)
+	}
+	return res, nil
+}
+
+func (jm otlpJSONMetric) metric() (otlpMetric, error) {
+	m := otlpMetric{name: jm.Name}
+	var points []otlpJSONPoint
+	switch {
+	case jm.Gauge != nil:
+		m.kind, points = otlpKindGauge, jm.Gauge.DataPoints
+	case jm.Sum != nil:
+		m.kind, points, m.monotonic = otlpKindSum, jm.Sum.DataPoints, jm.Sum.IsMonotonic
+		t, err := jm.Sum.AggregationTemporality.temporality()
+		if err != nil {
+			return m, fmt.Errorf("invalid aggregation temporality %q", jm.Sum.AggregationTemporality)
+		}
+		m.temporality = t
+	default:
+		m.kind = otlpKindUnsupported
+		for _, u := range []*otlpJSONUnsupported{jm.Histogram, jm.ExponentialHistogram, jm.Summary} {
+			if u != nil {
+				m.unsupported += len(u.DataPoints)
+			}
+		}
+		return m, nil
+	}
+	if m.name == "" {
+		return m, errors.New("metric without name")
+	}
+
+	for _, jp := range points {
+		var p otlpPoint
+		var err error
+		if p.attrs, err = otlpJSONAttributes(jp.Attributes); err != nil {
+			return m, err
+		}
+		if p.start, err = jp.StartTimeUnixNano.uint(); err != nil {
+			return m, fmt.Errorf("invalid start time %q", jp.StartTimeUnixNano)
+		}
+		switch {
+		case jp.AsDouble != nil:
+			if p.value, err = jp.AsDouble.float(); err != nil {
+				return m, fmt.Errorf("invalid value %q", *jp.AsDouble)
+			}
+			p.hasValue = true
+		case jp.AsInt != nil:
+			i, err := jp.AsInt.int()
+			if err != nil {
+				return m, fmt.Errorf("invalid value %q", *jp.AsInt)
+			}
+			p.value, p.hasValue = float64(i), true
+		}
+		m.points = append(m.points, p)
+	}
+	return m, nil
+}
+
+// otlpJSONAttributes converts scalar attributes to labels.
+func otlpJSONAttributes(kvs []otlpJSONKeyValue) (map[string]string, error) {
+	var attrs map[string]string
+	for _, kv := range kvs {
+		var value string
+		v := kv.Value
+		switch {
+		case v.StringValue != nil:
+			value = *v.StringValue
+		case v.BoolValue != nil:
+			value = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			i, err := v.IntValue.int()
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: invalid int value", kv.Key)
+			}
+			value = strconv.FormatInt(i, 10)
+		case v.DoubleValue != nil:
+			f, err := v.DoubleValue.float()
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: invalid double value", kv.Key)
+			}
+			value = strconv.FormatFloat(f, 'g', -1, 64)
+		default:
+			continue
+		}
+		if kv.Key == "" {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[kv.Key] = value
+	}
+	return attrs, nil
+}
+
+// encodeOTLPJSONResponse encodes an ExportMetricsServiceResponse in the JSON encoding.
+func encodeOTLPJSONResponse(rejected int64, msg string) []byte {
+	if rejected == 0 {
+		return []byte("{}")
+	}
+	resp := map[string]any{"partialSuccess": map[string]any{
+		"rejectedDataPoints": strconv.FormatInt(rejected, 10),
+		"errorMessage":       msg,
+	}}
+	b, _ := json.Marshal(resp)
+	return b
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendOTLPMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func encodeOTLPKeyValue(key, v string) []byte {
+	var value []byte
+	value = protowire.AppendTag(value, otlpAnyString, protowire.BytesType)
+	value = protowire.AppendString(value, v)
+
+	var kv []byte
+	kv = protowire.AppendTag(kv, otlpKeyValueKey, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	return appendOTLPMessage(kv, otlpKeyValueValue, value)
+}
+
+func encodeOTLPPoint(attrs map[string]string, start uint64, value float64) []byte {
+	var p []byte
+	for k, v := range attrs {
+		p = appendOTLPMessage(p, otlpPointAttributes, encodeOTLPKeyValue(k, v))
+	}
+	p = protowire.AppendTag(p, otlpPointStartTime, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, start)
+	p = protowire.AppendTag(p, otlpPointAsDouble, protowire.Fixed64Type)
+	return protowire.AppendFixed64(p, math.Float64bits(value))
+}
+
+// encodeOTLPRequest builds an ExportMetricsServiceRequest with one resource and
+// the given encoded metrics.
+func encodeOTLPRequest(resourceAttrs map[string]string, metrics ...[]byte) []byte {
+	var resource []byte
+	for k, v := range resourceAttrs {
+		resource = appendOTLPMessage(resource, otlpResourceAttributes, encodeOTLPKeyValue(k, v))
+	}
+	var scope []byte
+	for _, m := range metrics {
+		scope = appendOTLPMessage(scope, otlpScopeMetricsMetrics, m)
+	}
+	var rm []byte
+	rm = appendOTLPMessage(rm, otlpResourceMetricsResource, resource)
+	rm = appendOTLPMessage(rm, otlpResourceMetricsScope, scope)
+	return appendOTLPMessage(nil, otlpRequestResourceMetrics, rm)
+}
+
+func encodeOTLPMetric(name string, kind protowire.Number, temporality int, monotonic bool, points ...[]byte) []byte {
+	var data []byte
+	for _, p := range points {
+		data = appendOTLPMessage(data, otlpDataPoints, p)
+	}
+	if kind == otlpMetricSum {
+		data = protowire.AppendTag(data, otlpSumTemporality, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(temporality))
+		data = protowire.AppendTag(data, otlpSumMonotonic, protowire.VarintType)
+		data = protowire.AppendVarint(data, protowire.EncodeBool(monotonic))
+	}
+	var m []byte
+	m = protowire.AppendTag(m, otlpMetricName, protowire.BytesType)
+	m = protowire.AppendString(m, name)
+	return appendOTLPMessage(m, kind, data)
+}
+
+const otlpRejectedMsg = "1 data points rejected: only gauges, monotonic sums and cumulative sums with finite values are supported"
+
+func TestDecodeOTLPRequest(t *testing.T) {
+	body := encodeOTLPRequest(map[string]string{"service.name": "checkout"},
+		encodeOTLPMetric("queue.size", otlpMetricGauge, 0, false,
+			encodeOTLPPoint(map[string]string{"queue": "orders"}, 0, 7)),
+		encodeOTLPMetric("requests", otlpMetricSum, otlpTemporalityCumulative, true,
+			encodeOTLPPoint(nil, 100, 42)),
+		encodeOTLPMetric("latency", otlpMetricHistogram, 0, false, []byte{}, []byte{}),
+	)
+
+	got, err := decodeOTLPRequest(body)
+	require.NoError(t, err)
+	require.Equal(t, []otlpResource{{
+		attrs: map[string]string{"service.name": "checkout"},
+		metrics: []otlpMetric{
+			{name: "queue.size", kind: otlpKindGauge,
+				points: []otlpPoint{{attrs: map[string]string{"queue": "orders"}, value: 7, hasValue: true}}},
+			{name: "requests", kind: otlpKindSum, temporality: otlpTemporalityCumulative, monotonic: true,
+				points: []otlpPoint{{start: 100, value: 42, hasValue: true}}},
+			{name: "latency", kind: otlpKindUnsupported, unsupported: 2},
+		},
+	}}, got)
+
+	_, err = decodeOTLPRequest([]byte{0x0a, 0xff})
+	require.Error(t, err)
+}
+
+func TestOTLPMetricsHandler(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	h := srv.buildRouter()
+
+	post := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(AgentIDHeader, "checkout-1")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(id string, typ model.MetricType, labels map[string]string) *model.Metric {
+		labels[SourceLabel] = "checkout-1"
+		m, err := st.Get(ctx, &model.Metric{ID: id, Type: typ, Labels: labels})
+		require.NoError(t, err)
+		return m
+	}
+
+	export := func(requests float64) []byte {
+		return encodeOTLPRequest(map[string]string{"service.name": "checkout"},
+			encodeOTLPMetric("queue.size", otlpMetricGauge, 0, false,
+				encodeOTLPPoint(map[string]string{"queue": "orders"}, 0, 7)),
+			encodeOTLPMetric("requests", otlpMetricSum, otlpTemporalityCumulative, true,
+				encodeOTLPPoint(map[string]string{"service.name": "api"}, 100, requests)),
+			encodeOTLPMetric("latency", otlpMetricHistogram, 0, false, []byte{}),
+		)
+	}
+
+	rr := post("application/x-protobuf", export(40))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/x-protobuf", rr.Header().Get("Content-Type"))
+	require.Equal(t, encodeOTLPResponse(1, otlpRejectedMsg), rr.Body.Bytes())
+
+	m := get("queue.size", model.Gauge, map[string]string{"service.name": "checkout", "queue": "orders"})
+	require.Equal(t, 7.0, *m.Value)
+
+	require.Equal(t, http.StatusOK, post("application/x-protobuf", export(45)).Code)
+	m = get("requests", model.Counter, map[string]string{"service.name": "api"})
+	require.EqualValues(t, 5, *m.Delta)
+
+	jsonBody := `{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"host.name","value":{"stringValue":"web-1"}},{"key":"tags","value":{"arrayValue":{}}}]},
+		"scopeMetrics":[{"scope":{"name":"app"},"metrics":[
+			{"name":"jobs","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","isMonotonic":true,
+				"dataPoints":[{"asInt":"3","timeUnixNano":"1700000000000000000"}]}},
+			{"name":"temp","gauge":{"dataPoints":[{"asDouble":21.5,"attributes":[{"key":"room","value":{"intValue":"4"}}]}]}}
+		]}]}]}`
+	rr = post("application/json", []byte(jsonBody))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{}`, rr.Body.String())
+
+	m = get("jobs", model.Counter, map[string]string{"host.name": "web-1"})
+	require.EqualValues(t, 3, *m.Delta)
+	m = get("temp", model.Gauge, map[string]string{"host.name": "web-1", "room": "4"})
+	require.Equal(t, 21.5, *m.Value)
+
+	rr = post("application/json", []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"free","sum":{"aggregationTemporality":1,"dataPoints":[{"asInt":"1"}]}}]}]}]}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"partialSuccess":{"rejectedDataPoints":"1","errorMessage":"`+otlpRejectedMsg+`"}}`, rr.Body.String())
+
+	require.Equal(t, http.StatusUnsupportedMediaType, post("text/plain", nil).Code)
+	require.Equal(t, http.StatusBadRequest, post("application/x-protobuf", []byte{0x0a, 0xff}).Code)
+	require.Equal(t, http.StatusBadRequest, post("application/json", []byte(`{"resourceMetrics":{}}`)).Code)
+}
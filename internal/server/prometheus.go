@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusHandler renders all stored metrics in the Prometheus text exposition format 0.0.4.
+func (srv *Server) PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var all map[string]*model.Metric
+	err := utils.WithRetry(ctx, func() error {
+		var err error
+		all, err = srv.Storage.GetAll(ctx)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("failed to get all metrics from storage: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	bw := bufio.NewWriter(w)
+	writePrometheus(bw, all)
+	if err := bw.Flush(); err != nil {
+		log.Printf("failed to write prometheus response: %v", err)
+	}
+}
+
+// writePrometheus writes metrics grouped into families sorted by name. Metrics are
+// taken in series key order, so that when sanitized names collide, e.g. a.b and a_b,
+// the first one wins deterministically: a metric whose family has another type or
+// whose rendered series is already written is skipped.
+func writePrometheus(w *bufio.Writer, all map[string]*model.Metric) {
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	type series struct {
+		labels string
+		value  string
+	}
+	families := make(map[string][]series)
+	types := make(map[string]model.MetricType)
+	seen := make(map[string]struct{})
+	for _, k := range keys {
+		m := all[k]
+		name := sanitizeMetricName(m.ID)
+		if typ, ok := types[name]; ok && typ != m.Type {
+			log.Printf("prometheus: skip metric %s: type %s conflicts with %s", k, m.Type, typ)
+			continue
+		}
+		v, ok := promValue(m)
+		if !ok {
+			continue
+		}
+		labels := formatLabels(m.Labels)
+		if _, ok := seen[name+labels]; ok {
+			log.Printf("prometheus: skip metric %s: duplicates series %s%s", k, name, labels)
+			continue
+		}
+		seen[name+labels] = struct{}{}
+		types[name] = m.Type
+		families[name] = append(families[name], series{labels: labels, value: v})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w.WriteString("# TYPE " + name + " " + string(types[name]) + "\n")
+		for _, s := range families[name] {
+			w.WriteString(name + s.labels + " " + s.value + "\n")
+		}
+	}
+}
+
+// formatLabels renders labels as {name="value",...} sorted by name.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	written := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		// of label names that sanitize alike, the first in sorted order is kept
+		sanitized := sanitizeLabelName(name)
+		if _, ok := written[sanitized]; ok {
+			continue
+		}
+		if len(written) > 0 {
+			b.WriteByte(',')
+		}
+		written[sanitized] = struct{}{}
+		b.WriteString(sanitized)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sanitizeLabelName maps a label name to the [a-zA-Z_][a-zA-Z0-9_]* Prometheus label charset.
+func sanitizeLabelName(name string) string {
+	return strings.ReplaceAll(sanitizeMetricName(name), ":", "_")
+}
+
+// promValue formats the metric value the way Prometheus expects it.
+func promValue(m *model.Metric) (string, bool) {
+	switch {
+	case m.Type == model.Gauge && m.Value != nil:
+		return formatFloat(*m.Value), true
+	case m.Type == model.Counter && m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10), true
+	default:
+		return "", false
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// sanitizeMetricName maps a metric ID to the [a-zA-Z_:][a-zA-Z0-9_:]* Prometheus name charset.
+func sanitizeMetricName(id string) string {
+	if id == "" {
+		return "_"
+	}
+	var b strings.Builder
+	b.Grow(len(id) + 1)
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	cases := map[string]string{
+		"HeapAlloc":        "HeapAlloc",
+		"cpu.usage-user":   "cpu_usage_user",
+		"9lives":           "_9lives",
+		"ns:sub_metric":    "ns:sub_metric",
+		"héllo wörld":      "h_llo_w_rld",
+		"":                 "_",
+		"CPUutilization12": "CPUutilization12",
+	}
+	for in, want := range cases {
+		require.Equal(t, want, sanitizeMetricName(in), in)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	require.Equal(t, "", formatLabels(nil))
+	require.Equal(t,
+		`{core="1",host="web \"1\"\\n",x_y="a\nb"}`,
+		formatLabels(map[string]string{"host": `web "1"\n`, "core": "1", "x:y": "a\nb"}))
+}
+
+func TestWritePrometheus_LabeledSeries(t *testing.T) {
+	all := map[string]*model.Metric{
+		`cpu{core="2"}`: {ID: "cpu", Type: model.Gauge, Value: utils.F64Ptr(20), Labels: map[string]string{"core": "2"}},
+		`cpu{core="1"}`: {ID: "cpu", Type: model.Gauge, Value: utils.F64Ptr(10), Labels: map[string]string{"core": "1"}},
+	}
+
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	writePrometheus(w, all)
+	require.NoError(t, w.Flush())
+
+	require.Equal(t, "# TYPE cpu gauge\ncpu{core=\"1\"} 10\ncpu{core=\"2\"} 20\n", sb.String())
+}
+
+func TestWritePrometheus(t *testing.T) {
+	all := map[string]*model.Metric{
+		"b.gauge":   {ID: "b.gauge", Type: model.Gauge, Value: utils.F64Ptr(1.5)},
+		"a_counter": {ID: "a_counter", Type: model.Counter, Delta: utils.I64Ptr(42)},
+		"b_gauge":   {ID: "b_gauge", Type: model.Counter, Delta: utils.I64Ptr(1)},
+		"nan":       {ID: "nan", Type: model.Gauge, Value: utils.F64Ptr(math.NaN())},
+		"empty":     {ID: "empty", Type: model.Gauge},
+	}
+
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	writePrometheus(w, all)
+	require.NoError(t, w.Flush())
+
+	out := sb.String()
+	require.True(t, strings.HasPrefix(out, "# TYPE a_counter counter\na_counter 42\n"), out)
+	require.Contains(t, out, "# TYPE nan gauge\nnan NaN\n")
+	require.NotContains(t, out, "empty")
+	require.Equal(t, 1, strings.Count(out, "# TYPE b_gauge"))
+	require.Contains(t, out, "# TYPE b_gauge gauge\nb_gauge 1.5\n", "the first series key wins a type conflict")
+}
+
+func TestWritePrometheus_NameCollisions(t *testing.T) {
+	all := map[string]*model.Metric{
+		"a.b":                {ID: "a.b", Type: model.Gauge, Value: utils.F64Ptr(1)},
+		"a_b":                {ID: "a_b", Type: model.Gauge, Value: utils.F64Ptr(2)},
+		"a~b":                {ID: "a~b", Type: model.Counter, Delta: utils.I64Ptr(3)},
+		`a_b{host="web"}`:    {ID: "a_b", Type: model.Gauge, Value: utils.F64Ptr(4), Labels: map[string]string{"host": "web"}},
+		`c{x.y="1",x_y="2"}`: {ID: "c", Type: model.Gauge, Value: utils.F64Ptr(5), Labels: map[string]string{"x.y": "1", "x_y": "2"}},
+	}
+
+	render := func() string {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		writePrometheus(w, all)
+		require.NoError(t, w.Flush())
+		return sb.String()
+	}
+	want := "# TYPE a_b gauge\na_b 1\na_b{host=\"web\"} 4\n# TYPE c gauge\nc{x_y=\"1\"} 5\n"
+	for i := 0; i < 20; i++ {
+		require.Equal(t, want, render())
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/errs"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+const (
+	defaultQueryRange = time.Hour
+	defaultQueryStep  = time.Minute
+	maxQueryPoints    = 11000
+)
+
+// Point is a single aggregated value of a range query.
+type Point struct {
+	Timestamp time.Time `json:"timestamp"` // Start of the step interval.
+	Value     float64   `json:"value"`
+}
+
+// RangeResult is the response of QueryRangeHandler.
+type RangeResult struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Agg    string            `json:"agg"`
+	Step   float64           `json:"step"` // Step in seconds.
+	Points []Point           `json:"points"`
+}
+
+var aggregators = map[string]func(values []float64) float64{
+	"avg": func(v []float64) float64 {
+		var sum float64
+		for _, x := range v {
+			sum += x
+		}
+		return sum / float64(len(v))
+	},
+	"min": func(v []float64) float64 {
+		res := v[0]
+		for _, x := range v[1:] {
+			res = math.Min(res, x)
+		}
+		return res
+	},
+	"max": func(v []float64) float64 {
+		res := v[0]
+		for _, x := range v[1:] {
+			res = math.Max(res, x)
+		}
+		return res
+	},
+	"sum": func(v []float64) float64 {
+		var sum float64
+		for _, x := range v {
+			sum += x
+		}
+		return sum
+	},
+	"last": func(v []float64) float64 { return v[len(v)-1] },
+}
+
+// QueryRangeHandler returns the history of a metric aggregated into step intervals.
+// Query parameters: id, from, to (RFC3339 or unix seconds), step (duration or seconds),
+// agg (avg, min, max, sum or last) and repeated label=name=value selecting a labeled series;
+// source=<agent> is a shorthand for label=source=<agent>. Labels the query doesn't
+// name may take any value; the latest written of several matching series is returned.
+func (srv *Server) QueryRangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	id := q.Get("id")
+	if id == "" {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return
+	}
+
+	labels, err := parseQueryLabels(q["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if source := q.Get("source"); source != "" {
+		if labels == nil {
+			labels = make(map[string]string, 1)
+		}
+		labels[SourceLabel] = source
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := parseQueryTime(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultQueryRange)
+	if v := q.Get("from"); v != "" {
+		t, err := parseQueryTime(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	step := defaultQueryStep
+	if v := q.Get("step"); v != "" {
+		d, err := parseQueryStep(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid step: %v", err), http.StatusBadRequest)
+			return
+		}
+		step = d
+	}
+
+	if to.Sub(from)/step > maxQueryPoints {
+		http.Error(w, "too many points, increase step", http.StatusBadRequest)
+		return
+	}
+
+	agg := q.Get("agg")
+	if agg == "" {
+		agg = "avg"
+	}
+	aggregate, ok := aggregators[agg]
+	if !ok {
+		http.Error(w, "unsupported agg", http.StatusBadRequest)
+		return
+	}
+
+	series := &model.Metric{ID: id, Labels: labels}
+	var samples []model.Sample
+	err = utils.WithRetry(ctx, func() error {
+		var err error
+		samples, err = srv.Storage.GetRange(ctx, series, from, to)
+		if !errors.Is(err, errs.ErrMetricNotFound) {
+			return err
+		}
+		// agents label their series with more than the query names, e.g. the host
+		stored, err := srv.getMetric(ctx, series)
+		if err != nil {
+			return err
+		}
+		series.Labels = stored.Labels
+		samples, err = srv.Storage.GetRange(ctx, series, from, to)
+		return err
+	})
+
+	if err != nil {
+		if errors.Is(err, errs.ErrMetricNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("failed to get range from storage [name=%s]: %v", id, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := RangeResult{
+		ID:     id,
+		Labels: series.Labels,
+		Agg:    agg,
+		Step:   step.Seconds(),
+		Points: aggregateSamples(samples, from, step, aggregate),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("failed to write range response: %v", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// aggregateSamples groups ordered samples into [from+k*step, from+(k+1)*step) intervals.
+// Empty intervals are omitted.
+func aggregateSamples(samples []model.Sample, from time.Time, step time.Duration, aggregate func([]float64) float64) []Point {
+	points := []Point{}
+	var (
+		bucket int64 = -1
+		values []float64
+	)
+	flush := func() {
+		if len(values) > 0 {
+			points = append(points, Point{
+				Timestamp: from.Add(time.Duration(bucket) * step),
+				Value:     aggregate(values),
+			})
+		}
+		values = values[:0]
+	}
+
+	for _, s := range samples {
+		v, ok := sampleValue(s)
+		if !ok {
+			continue
+		}
+		b := int64(s.Timestamp.Sub(from) / step)
+		if b != bucket {
+			flush()
+			bucket = b
+		}
+		values = append(values, v)
+	}
+	flush()
+
+	return points
+}
+
+func sampleValue(s model.Sample) (float64, bool) {
+	switch {
+	case s.Value != nil:
+		return *s.Value, true
+	case s.Delta != nil:
+		return float64(*s.Delta), true
+	default:
+		return 0, false
+	}
+}
+
+// parseQueryLabels parses label=name=value query parameters.
+func parseQueryLabels(params []string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(params))
+	for _, p := range params {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label %q: expected name=value", p)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, frac := math.Modf(sec)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseQueryStep(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		sec, convErr := strconv.ParseFloat(s, 64)
+		if convErr != nil {
+			return 0, err
+		}
+		d = time.Duration(sec * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, errors.New("step must be positive")
+	}
+	return d, nil
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/and161185/metrics-alerting/cmd/server/metrics"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteContentType = "application/x-protobuf"
+	// maxRemoteWriteBody limits both the compressed and the decoded request size.
+	maxRemoteWriteBody = 32 << 20
+	// metricNameLabel holds the metric name in Prometheus series labels.
+	metricNameLabel = "__name__"
+)
+
+// Field numbers of the Prometheus remote_write protobuf messages (prompb).
+const (
+	rwWriteRequestTimeseries = 1 // WriteRequest.timeseries: repeated TimeSeries
+	rwTimeSeriesLabels       = 1 // TimeSeries.labels: repeated Label
+	rwTimeSeriesSamples      = 2 // TimeSeries.samples: repeated Sample
+	rwLabelName              = 1 // Label.name: string
+	rwLabelValue             = 2 // Label.value: string
+	rwSampleValue            = 1 // Sample.value: double
+	rwSampleTimestamp        = 2 // Sample.timestamp: int64, milliseconds
+)
+
+// promSeries is a decoded remote_write time series.
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+// RemoteWriteHandler accepts Prometheus remote_write requests: snappy-compressed
+// protobuf WriteRequest messages. Every series is stored as a gauge named by its
+// __name__ label with the value of its latest sample, since remote_write carries
+// absolute values. Stale markers and other non-finite samples are skipped.
+func (srv *Server) RemoteWriteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("Content-Type") != remoteWriteContentType {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBody))
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > maxRemoteWriteBody {
+		http.Error(w, "invalid snappy payload", http.StatusBadRequest)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "invalid snappy payload", http.StatusBadRequest)
+		return
+	}
+
+	series, err := decodeWriteRequest(raw)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	metricsArray, err := remoteWriteMetrics(series)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range metricsArray {
+		srv.applySource(source, &metricsArray[i])
+	}
+
+	if len(metricsArray) > 0 {
+		err = utils.WithRetry(ctx, func() error {
+			return srv.saveBatchToStorage(ctx, metricsArray)
+		})
+		if err != nil {
+			log.Printf("failed to save remote write metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remoteWriteMetrics converts series to gauges holding their latest finite sample.
+func remoteWriteMetrics(series []promSeries) ([]model.Metric, error) {
+	res := make([]model.Metric, 0, len(series))
+	for _, s := range series {
+		var latest *promSample
+		for i := range s.samples {
+			smp := &s.samples[i]
+			if math.IsNaN(smp.value) || math.IsInf(smp.value, 0) {
+				continue
+			}
+			if latest == nil || smp.timestamp >= latest.timestamp {
+				latest = smp
+			}
+		}
+		if latest == nil {
+			continue
+		}
+
+		m := model.Metric{ID: s.labels[metricNameLabel], Type: model.Gauge, Value: utils.F64Ptr(latest.value)}
+		if m.ID == "" {
+			return nil, errors.New("series without __name__ label")
+		}
+		for name, value := range s.labels {
+			if name == metricNameLabel {
+				continue
+			}
+			if m.Labels == nil {
+				m.Labels = make(map[string]string, len(s.labels)-1)
+			}
+			m.Labels[name] = value
+		}
+		if err := metrics.CheckMetric(&m); err != nil {
+			return nil, fmt.Errorf("invalid series %s: %w", m.Key(), err)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// decodeWriteRequest decodes the time series of a WriteRequest, skipping metadata
+// and unknown fields.
+func decodeWriteRequest(b []byte) ([]promSeries, error) {
+	var res []promSeries
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != rwWriteRequestTimeseries || typ != protowire.BytesType {
+			return nil
+		}
+		s, err := decodeTimeSeries(v)
+		if err != nil {
+			return err
+		}
+		res = append(res, s)
+		return nil
+	})
+	return res, err
+}
+
+func decodeTimeSeries(b []byte) (promSeries, error) {
+	s := promSeries{labels: make(map[string]string)}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case rwTimeSeriesLabels:
+			var name, value string
+			err := forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.BytesType {
+					return nil
+				}
+				switch num {
+				case rwLabelName:
+					name = string(v)
+				case rwLabelValue:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.labels[name] = value
+		case rwTimeSeriesSamples:
+			var smp promSample
+			err := forEachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == rwSampleValue && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					smp.value = math.Float64frombits(bits)
+				case num == rwSampleTimestamp && typ == protowire.VarintType:
+					ts, _ := protowire.ConsumeVarint(v)
+					smp.timestamp = int64(ts)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.samples = append(s.samples, smp)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// forEachField calls fn for every field of a protobuf message. For length-delimited
+// fields v is the payload; for other types v is the raw encoded value.
+func forEachField(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			payload, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			v, n = payload, m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			v = b[:n]
+		}
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodeWriteRequest builds a prompb.WriteRequest with one series per entry.
+func encodeWriteRequest(series []promSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var ts []byte
+		for _, name := range names {
+			var l []byte
+			l = protowire.AppendTag(l, rwLabelName, protowire.BytesType)
+			l = protowire.AppendString(l, name)
+			l = protowire.AppendTag(l, rwLabelValue, protowire.BytesType)
+			l = protowire.AppendString(l, s.labels[name])
+			ts = protowire.AppendTag(ts, rwTimeSeriesLabels, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		for _, smp := range s.samples {
+			var b []byte
+			b = protowire.AppendTag(b, rwSampleValue, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(smp.value))
+			b = protowire.AppendTag(b, rwSampleTimestamp, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(smp.timestamp))
+			ts = protowire.AppendTag(ts, rwTimeSeriesSamples, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, b)
+		}
+		req = protowire.AppendTag(req, rwWriteRequestTimeseries, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	// metadata (field 3) must be skipped
+	req = protowire.AppendTag(req, 3, protowire.BytesType)
+	req = protowire.AppendBytes(req, []byte{0x08, 0x01})
+	return req
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	in := []promSeries{
+		{labels: map[string]string{"__name__": "up", "job": "node"}, samples: []promSample{{1, 1000}, {0, 2000}}},
+	}
+	got, err := decodeWriteRequest(encodeWriteRequest(in))
+	require.NoError(t, err)
+	require.Equal(t, in, got)
+
+	_, err = decodeWriteRequest([]byte{0x0a, 0x05, 0x01})
+	require.Error(t, err)
+}
+
+func TestRemoteWriteMetrics(t *testing.T) {
+	got, err := remoteWriteMetrics([]promSeries{
+		{labels: map[string]string{"__name__": "temp", "room": "a"}, samples: []promSample{{20, 2000}, {19, 1000}}},
+		{labels: map[string]string{"__name__": "stale"}, samples: []promSample{{math.NaN(), 1000}}},
+		{labels: map[string]string{"__name__": "plain"}, samples: []promSample{{5, 1}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []model.Metric{
+		{ID: "temp", Type: model.Gauge, Value: utils.F64Ptr(20), Labels: map[string]string{"room": "a"}},
+		{ID: "plain", Type: model.Gauge, Value: utils.F64Ptr(5)},
+	}, got)
+
+	_, err = remoteWriteMetrics([]promSeries{{labels: map[string]string{"job": "x"}, samples: []promSample{{1, 1}}}})
+	require.Error(t, err)
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewMemStorage(ctx)
+	srv := newServer(t, st, &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, nil)
+	h := srv.buildRouter()
+
+	body := snappy.Encode(nil, encodeWriteRequest([]promSeries{
+		{labels: map[string]string{"__name__": "node_load1", "instance": "web-1:9100"}, samples: []promSample{{0.5, 1000}}},
+	}))
+	post := func(body []byte, mutate func(r *http.Request)) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("HashSHA256", utils.CalculateHash(body, "secret"))
+		req.Header.Set(AgentIDHeader, "prom-1")
+		if mutate != nil {
+			mutate(req)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusNoContent, post(body, nil))
+	m, err := st.Get(ctx, &model.Metric{ID: "node_load1", Type: model.Gauge,
+		Labels: map[string]string{"instance": "web-1:9100", SourceLabel: "prom-1"}})
+	require.NoError(t, err)
+	require.Equal(t, 0.5, *m.Value)
+	require.Equal(t, "prom-1", srv.Sources.List()[0].ID)
+
+	require.Equal(t, http.StatusBadRequest, post(body, func(r *http.Request) { r.Header.Set("HashSHA256", "bad") }))
+	require.Equal(t, http.StatusUnsupportedMediaType, post(body, func(r *http.Request) { r.Header.Set("Content-Type", "application/json") }))
+
+	garbage := []byte("not snappy")
+	require.Equal(t, http.StatusBadRequest, post(garbage, nil))
+}
@@ -9,11 +9,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/and161185/metrics-alerting/cmd/server/metrics"
+	"github.com/and161185/metrics-alerting/internal/alerting"
 	"github.com/and161185/metrics-alerting/internal/config"
 	"github.com/and161185/metrics-alerting/internal/errs"
+	"github.com/and161185/metrics-alerting/internal/notifier"
 	"github.com/and161185/metrics-alerting/internal/server/middleware"
 	"github.com/and161185/metrics-alerting/internal/utils"
 	"github.com/and161185/metrics-alerting/model"
@@ -21,6 +25,12 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
+const (
+	webhookTimeout = 10 * time.Second
+	// agentDownRule is the built-in alert rule firing for agents that stopped reporting.
+	agentDownRule = "AgentDown"
+)
+
 // Storage provides metric storage operations.
 type Storage interface {
 	// Save stores a single metric.
@@ -29,8 +39,13 @@ type Storage interface {
 	SaveBatch(ctx context.Context, metrics []model.Metric) error
 	// Get retrieves a metric by ID and type.
 	Get(ctx context.Context, metric *model.Metric) (*model.Metric, error)
+	// GetLatest returns the most recently written metric with the ID of the given one,
+	// its type unless empty, and all of its labels.
+	GetLatest(ctx context.Context, metric *model.Metric) (*model.Metric, error)
 	// GetAll returns all stored metrics.
 	GetAll(ctx context.Context) (map[string]*model.Metric, error)
+	// GetRange returns samples of a metric recorded within [from, to], oldest first.
+	GetRange(ctx context.Context, metric *model.Metric, from, to time.Time) ([]model.Sample, error)
 	// Ping checks the availability of the storage.
 	Ping(ctx context.Context) error
 }
@@ -46,18 +61,76 @@ type Server struct {
 	Config     *config.ServerConfig
 	FileStore  fileBackedStore
 	PrivateKey *rsa.PrivateKey
+	Alerting   *alerting.Engine
+	Sources    *SourceRegistry
+	Graphite   *GraphiteListener // set by Run when the Graphite listener is enabled
+	Hub        *Hub              // updates of saved metrics and alerts, nil to disable /stream and /ws
+
+	influxCounters []*regexp.Regexp // metric IDs of integer line protocol fields stored as counters
+	otlpSums       *sumState        // previous values of OTLP sums
+	influxSums     *sumState        // previous values of InfluxDB counters
+
+	grpcStopping chan struct{} // closed by shutdownGRPC to end agent streams
+
+	publishOnce sync.Once
+	published   chan []model.Metric // saves waiting to be published to the hub
 }
 
 // NewServer creates a new server instance with the given storage and configuration.
-func NewServer(storage Storage, config *config.ServerConfig, priv *rsa.PrivateKey) *Server {
+// It fails if the alert rules file can't be loaded.
+func NewServer(storage Storage, config *config.ServerConfig, priv *rsa.PrivateKey) (*Server, error) {
 	fileStore, _ := storage.(fileBackedStore)
 
-	return &Server{
+	srv := &Server{
 		Storage:    storage,
 		Config:     config,
 		FileStore:  fileStore,
 		PrivateKey: priv,
+		Sources:    NewSourceRegistry(config.AgentDownFactor),
+		Hub:        NewHub(),
+
+		influxCounters: compileInfluxCounters(config.InfluxCounters),
+		otlpSums:       newSumState(),
+		influxSums:     newSumState(),
+	}
+
+	var rules []alerting.Rule
+	if config.AlertRulesPath != "" {
+		loaded, err := alerting.LoadRules(config.AlertRulesPath)
+		if err != nil {
+			return nil, fmt.Errorf("alert rules: %w", err)
+		}
+		rules = loaded
+	}
+	rules = withAgentDownRule(rules)
+
+	srv.Alerting = alerting.NewEngine(liveSource{storage: storage, sources: srv.Sources}, rules, config.Logger)
+	for _, url := range config.WebhookURLs {
+		srv.Alerting.AddNotifier(notifier.NewWebhook(url, config.WebhookKey, webhookTimeout))
+	}
+	srv.Alerting.AddNotifier(srv.Hub)
+	// a forgotten agent is not back, so its AgentDown alert is dropped rather than resolved
+	srv.Sources.onForget = func(id string) {
+		srv.Alerting.Forget(UpMetric, map[string]string{SourceLabel: id})
+	}
+
+	return srv, nil
+}
+
+// withAgentDownRule appends the built-in AgentDown rule unless a rule with that name is configured.
+func withAgentDownRule(rules []alerting.Rule) []alerting.Rule {
+	for _, r := range rules {
+		if r.Name == agentDownRule {
+			return rules
+		}
 	}
+	return append(rules, alerting.Rule{
+		Name:      agentDownRule,
+		Type:      model.Gauge,
+		MetricID:  UpMetric,
+		Op:        "<",
+		Threshold: 1,
+	})
 }
 
 func (srv *Server) buildRouter() http.Handler {
@@ -65,20 +138,33 @@ func (srv *Server) buildRouter() http.Handler {
 	router.Use(chiMiddleware.StripSlashes)
 	router.Use(middleware.DecryptMiddleware(srv.PrivateKey, false))
 	router.Use(middleware.LogMiddleware(srv.Config.Logger))
-	router.Use(middleware.VerifyHashMiddleware(srv.Config))
-	router.Use(middleware.DecompressMiddleware)
-	router.Use(middleware.CompressMiddleware)
-	router.Post("/update/{type}/{name}/{value}", srv.UpdateMetricHandler)
-	router.Post("/update", srv.UpdateMetricHandlerJSON)
-	router.Post("/updates", srv.UpdateArrayMetricHandlerJSON)
-	router.Get("/value/{type}/{name}", srv.GetMetricHandler)
-	router.Post("/value", srv.GetMetricHandlerJSON)
-	router.Get("/", srv.ListMetricsHandler)
-	router.Get("/ping", srv.PingHandler)
+	// event streams and WebSockets are long-lived: their responses are neither hashed nor compressed
+	router.Get("/stream", srv.StreamHandler)
+	router.Get("/ws", srv.WebSocketHandler)
+	router.Group(func(r chi.Router) {
+		r.Use(middleware.VerifyHashMiddleware(srv.Config))
+		r.Use(middleware.DecompressMiddleware)
+		r.Use(middleware.CompressMiddleware)
+		r.Post("/update/{type}/{name}/{value}", srv.UpdateMetricHandler)
+		r.Post("/update", srv.UpdateMetricHandlerJSON)
+		r.Post("/updates", srv.UpdateArrayMetricHandlerJSON)
+		r.Post("/api/v1/write", srv.RemoteWriteHandler)
+		r.Post("/write", srv.InfluxWriteHandler)
+		r.Post("/v1/metrics", srv.OTLPMetricsHandler)
+		r.Get("/value/{type}/{name}", srv.GetMetricHandler)
+		r.Post("/value", srv.GetMetricHandlerJSON)
+		r.Get("/", srv.ListMetricsHandler)
+		r.Get("/ping", srv.PingHandler)
+		r.Get("/api/v1/alerts", srv.AlertsHandler)
+		r.Get("/api/v1/query_range", srv.QueryRangeHandler)
+		r.Get("/metrics", srv.PrometheusHandler)
+		r.Get("/sources", srv.SourcesHandler)
+	})
 	return router
 }
 
-// Run starts the HTTP server and, if configured, periodically saves metrics to a file.
+// Run starts the HTTP server and, if configured, the gRPC server and the Graphite
+// listener, and periodically saves metrics to a file.
 func (srv *Server) Run(ctx context.Context) error {
 	httpSrv := srv.buildHTTPServer()
 
@@ -86,24 +172,51 @@ func (srv *Server) Run(ctx context.Context) error {
 
 	stopAutosave := srv.startAutosave(ctx)
 	defer stopAutosave()
+	stopAlerting := srv.startAlerting(ctx)
+	defer stopAlerting()
 	defer srv.finalFlush()
 	defer srv.closeStorage()
 
+	graphite, err := srv.startGraphite()
+	if err != nil {
+		return err
+	}
+
+	grpcSrv, grpcErrCh, err := srv.startGRPC()
+	if err != nil {
+		_ = srv.shutdownGraphite(graphite, 5*time.Second)
+		return err
+	}
+
 	errCh := srv.startHTTP(httpSrv)
 
+	shutdown := func() {
+		_ = srv.shutdownHTTP(httpSrv, 5*time.Second)
+		srv.shutdownGRPC(grpcSrv, 5*time.Second)
+		_ = srv.shutdownGraphite(graphite, 5*time.Second)
+	}
+
 	select {
 	case <-ctx.Done():
-		_ = srv.shutdownHTTP(httpSrv, 5*time.Second)
+		shutdown()
 		return nil
 	case err := <-errCh:
-		_ = srv.shutdownHTTP(httpSrv, 5*time.Second)
+		shutdown()
 		return fmt.Errorf("server error: %w", err)
+	case err := <-grpcErrCh:
+		shutdown()
+		return fmt.Errorf("grpc server error: %w", err)
 	}
 }
 
 // buildHTTPServer creates and configures the HTTP server with the router.
 func (srv *Server) buildHTTPServer() *http.Server {
-	return &http.Server{Addr: srv.Config.Addr, Handler: srv.buildRouter()}
+	s := &http.Server{Addr: srv.Config.Addr, Handler: srv.buildRouter()}
+	if srv.Hub != nil {
+		// end event streams and WebSockets, which would otherwise keep their connections busy
+		s.RegisterOnShutdown(srv.Hub.Close)
+	}
+	return s
 }
 
 // restoreFromFile loads metrics from the file storage if Restore mode is enabled.
@@ -138,6 +251,27 @@ func (srv *Server) startAutosave(ctx context.Context) (stop func()) {
 	return func() { <-done }
 }
 
+// startAlerting launches a background goroutine that periodically evaluates alert rules.
+// Returns a function to wait for the evaluation loop to stop and the queued
+// notifications to be delivered.
+func (srv *Server) startAlerting(ctx context.Context) (stop func()) {
+	if srv.Alerting == nil {
+		return func() {}
+	}
+	if srv.Config.AlertInterval <= 0 {
+		return srv.Alerting.Close
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Alerting.Run(ctx, time.Duration(srv.Config.AlertInterval)*time.Second)
+	}()
+	return func() {
+		<-done
+		srv.Alerting.Close()
+	}
+}
+
 // startHTTP runs the HTTP server in a separate goroutine and returns a channel
 // that will contain an error if ListenAndServe fails.
 func (srv *Server) startHTTP(s *http.Server) <-chan error {
@@ -157,6 +291,35 @@ func (srv *Server) shutdownHTTP(s *http.Server, timeout time.Duration) error {
 	return s.Shutdown(sdCtx)
 }
 
+// startGraphite starts the Graphite listener if an address is configured.
+// It returns nil when the listener is disabled.
+func (srv *Server) startGraphite() (*GraphiteListener, error) {
+	if srv.Config.GraphiteAddr == "" {
+		return nil, nil
+	}
+	g, err := ListenGraphite(srv.Config.GraphiteAddr, func(ctx context.Context, metrics []model.Metric) error {
+		return utils.WithRetry(ctx, func() error {
+			return srv.saveBatchToStorage(ctx, metrics)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	srv.Graphite = g
+	g.Serve()
+	return g, nil
+}
+
+// shutdownGraphite gracefully stops the Graphite listener with the given timeout.
+func (srv *Server) shutdownGraphite(g *GraphiteListener, timeout time.Duration) error {
+	if g == nil {
+		return nil
+	}
+	sdCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return g.Shutdown(sdCtx)
+}
+
 // finalFlush ensures all pending metrics are written to file storage before exit.
 func (srv *Server) finalFlush() {
 	if srv.FileStore != nil && srv.Config.FileStoragePath != "" {
@@ -186,6 +349,13 @@ func (srv *Server) UpdateMetricHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.applySource(source, metric)
+
 	err = utils.WithRetry(ctx, func() error {
 		return srv.saveToStorage(ctx, metric)
 	})
@@ -221,6 +391,13 @@ func (srv *Server) UpdateMetricHandlerJSON(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.applySource(source, &metric)
+
 	err = utils.WithRetry(ctx, func() error {
 		return srv.saveToStorage(ctx, &metric)
 	})
@@ -269,6 +446,15 @@ func (srv *Server) UpdateArrayMetricHandlerJSON(w http.ResponseWriter, r *http.R
 		}
 	}
 
+	source, err := requestSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range metricsArray {
+		srv.applySource(source, &metricsArray[i])
+	}
+
 	err = utils.WithRetry(ctx, func() error {
 		return srv.saveBatchToStorage(ctx, metricsArray)
 	})
@@ -288,6 +474,7 @@ func (srv *Server) saveToStorage(ctx context.Context, metric *model.Metric) erro
 	if err != nil {
 		return err
 	}
+	srv.publish([]model.Metric{*metric})
 
 	if srv.Config.StoreInterval == 0 && srv.FileStore != nil {
 		if err := srv.FileStore.SaveToFile(ctx, srv.Config.FileStoragePath); err != nil {
@@ -303,6 +490,7 @@ func (srv *Server) saveBatchToStorage(ctx context.Context, metricsArray []model.
 	if err != nil {
 		return err
 	}
+	srv.publish(metricsArray)
 
 	if srv.Config.StoreInterval == 0 && srv.FileStore != nil {
 		if err := srv.FileStore.SaveToFile(ctx, srv.Config.FileStoragePath); err != nil {
@@ -314,6 +502,8 @@ func (srv *Server) saveBatchToStorage(ctx context.Context, metricsArray []model.
 }
 
 // GetMetricHandler returns the value of a metric as a plain string (gauge/counter).
+// The optional source query parameter selects the series of a single agent. Labels
+// the request doesn't name, such as the host label of agents, may take any value.
 func (srv *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -326,11 +516,14 @@ func (srv *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if source := r.URL.Query().Get("source"); source != "" {
+		metric.Labels = map[string]string{SourceLabel: source}
+	}
 
 	var storedMetric *model.Metric
 	err = utils.WithRetry(ctx, func() error {
 		var getErr error
-		storedMetric, getErr = srv.Storage.Get(ctx, metric)
+		storedMetric, getErr = srv.getMetric(ctx, metric)
 		return getErr
 	})
 
@@ -370,7 +563,8 @@ func (srv *Server) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// GetMetricHandlerJSON returns the value of a metric in JSON format.
+// GetMetricHandlerJSON returns the value of a metric in JSON format. The request
+// labels select the series; labels it doesn't name may take any value.
 func (srv *Server) GetMetricHandlerJSON(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -388,7 +582,7 @@ func (srv *Server) GetMetricHandlerJSON(w http.ResponseWriter, r *http.Request)
 	var storedMetric *model.Metric
 	err := utils.WithRetry(ctx, func() error {
 		var err error
-		storedMetric, err = srv.Storage.Get(ctx, &reqMetric)
+		storedMetric, err = srv.getMetric(ctx, &reqMetric)
 		return err
 	})
 
@@ -431,7 +625,7 @@ func (srv *Server) ListMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, m := range all {
-		_, err = fmt.Fprintf(w, "<li>%s (%s): %v</li>", m.ID, m.Type, m.Value)
+		_, err = fmt.Fprintf(w, "<li>%s (%s): %v</li>", m.Key(), m.Type, m.Value)
 		if err != nil {
 			log.Printf("failed to write response body for list metrics for metric [name=%s]: %v", m.ID, err)
 		}
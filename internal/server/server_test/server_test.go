@@ -3,18 +3,22 @@ package server_test
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/and161185/metrics-alerting/internal/alerting"
 	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/errs"
 	srv "github.com/and161185/metrics-alerting/internal/server"
 	"github.com/and161185/metrics-alerting/internal/server/testutils"
 	"github.com/and161185/metrics-alerting/internal/utils"
@@ -247,14 +251,39 @@ func (s *stubStore) Get(ctx context.Context, m *model.Metric) (*model.Metric, er
 	}
 	return v, s.err
 }
+func (s *stubStore) GetLatest(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+	return nil, errors.New("not found")
+}
 func (s *stubStore) GetAll(ctx context.Context) (map[string]*model.Metric, error) {
 	return s.data, s.err
 }
+func (s *stubStore) GetRange(ctx context.Context, m *model.Metric, from, to time.Time) ([]model.Sample, error) {
+	return nil, s.err
+}
 func (s *stubStore) Ping(ctx context.Context) error { return s.err }
 
+// newServer creates a server with srv.NewServer, failing the test on error.
+func newServer(t *testing.T, st srv.Storage, cfg *config.ServerConfig, priv *rsa.PrivateKey) *srv.Server {
+	t.Helper()
+	s, err := srv.NewServer(st, cfg, priv)
+	require.NoError(t, err)
+	return s
+}
+
+func TestNewServer_InvalidAlertRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules":`), 0o600))
+
+	_, err := srv.NewServer(&stubStore{}, &config.ServerConfig{AlertRulesPath: path}, nil)
+	require.Error(t, err)
+
+	_, err = srv.NewServer(&stubStore{}, &config.ServerConfig{AlertRulesPath: filepath.Join(t.TempDir(), "missing.json")}, nil)
+	require.Error(t, err)
+}
+
 func TestNewServer_BuildRouter(t *testing.T) {
 	cfg := &config.ServerConfig{Addr: "127.0.0.1:0"}
-	s := srv.NewServer(&stubStore{}, cfg, nil)
+	s := newServer(t, &stubStore{}, cfg, nil)
 	require.NotNil(t, s)
 	h := getRouterForTest(s)
 	rr := httptest.NewRecorder()
@@ -271,7 +300,7 @@ func TestRun_StartStop(t *testing.T) {
 		Restore:         true,
 	}
 	st := &stubStore{data: map[string]*model.Metric{}}
-	s := srv.NewServer(st, cfg, nil)
+	s := newServer(t, st, cfg, nil)
 
 	fs := &memFS{}
 	s.FileStore = fs
@@ -287,7 +316,7 @@ func TestRun_StartStop(t *testing.T) {
 
 func TestUpdateMetricHandlerJSON_Happy(t *testing.T) {
 	cfg := &config.ServerConfig{Addr: "x"}
-	s := srv.NewServer(&stubStore{data: map[string]*model.Metric{}}, cfg, nil)
+	s := newServer(t, &stubStore{data: map[string]*model.Metric{}}, cfg, nil)
 
 	r := chi.NewRouter()
 	r.Post("/update", s.UpdateMetricHandlerJSON)
@@ -306,7 +335,7 @@ func TestUpdateMetricHandlerJSON_Happy(t *testing.T) {
 func TestUpdateArrayMetricHandlerJSON_Happy(t *testing.T) {
 	cfg := &config.ServerConfig{Addr: "x"}
 	st := &stubStore{data: map[string]*model.Metric{}}
-	s := srv.NewServer(st, cfg, nil)
+	s := newServer(t, st, cfg, nil)
 
 	r := chi.NewRouter()
 	r.Post("/updates", s.UpdateArrayMetricHandlerJSON)
@@ -331,7 +360,7 @@ func TestGetMetricHandler_Counter(t *testing.T) {
 	st := &stubStore{data: map[string]*model.Metric{
 		"c": {ID: "c", Type: model.Counter, Delta: utils.I64Ptr(9)},
 	}}
-	s := srv.NewServer(st, cfg, nil)
+	s := newServer(t, st, cfg, nil)
 
 	r := chi.NewRouter()
 	r.Get("/value/{type}/{name}", s.GetMetricHandler)
@@ -674,3 +703,365 @@ func Test_GetMetricHandler_NilValue_Plain(t *testing.T) {
 
 	require.Equal(t, http.StatusNotFound, rr.Code)
 }
+
+func TestAlertsHandler(t *testing.T) {
+	ctx := context.Background()
+	s := newServerWithInMem(t)
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(600e6)})
+
+	rule, err := alerting.ParseRule("HighHeap", "gauge HeapAlloc > 500e6")
+	require.NoError(t, err)
+	s.Alerting = alerting.NewEngine(s.Storage, []alerting.Rule{rule}, nopLogger())
+	require.NoError(t, s.Alerting.Evaluate(ctx))
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/alerts", s.AlertsHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/alerts", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var alerts []alerting.Alert
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&alerts))
+	require.Len(t, alerts, 1)
+	require.Equal(t, "HighHeap", alerts[0].Rule)
+	require.Equal(t, alerting.StateFiring, alerts[0].State)
+}
+
+func TestAlertsHandler_NoEngine(t *testing.T) {
+	s := newServerWithInMem(t)
+
+	rr := httptest.NewRecorder()
+	s.AlertsHandler(rr, httptest.NewRequest(http.MethodGet, "/api/v1/alerts", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, "[]", rr.Body.String())
+}
+
+type rangeStore struct {
+	srv.Storage
+	samples  []model.Sample
+	from, to time.Time
+}
+
+func (s *rangeStore) GetRange(_ context.Context, m *model.Metric, from, to time.Time) ([]model.Sample, error) {
+	if m.ID != "HeapAlloc" {
+		return nil, errs.ErrMetricNotFound
+	}
+	s.from, s.to = from, to
+	return s.samples, nil
+}
+
+func TestQueryRangeHandler(t *testing.T) {
+	base := time.Unix(1000, 0).UTC()
+	st := &rangeStore{samples: []model.Sample{
+		{Timestamp: base.Add(1 * time.Second), Value: utils.F64Ptr(1)},
+		{Timestamp: base.Add(5 * time.Second), Value: utils.F64Ptr(3)},
+		{Timestamp: base.Add(12 * time.Second), Value: utils.F64Ptr(10)},
+		{Timestamp: base.Add(31 * time.Second), Value: utils.F64Ptr(7)},
+		{Timestamp: base.Add(39 * time.Second), Value: utils.F64Ptr(2)},
+	}}
+	s := newServerWithInMem(t)
+	st.Storage = s.Storage
+	s.Storage = st
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/query_range", s.QueryRangeHandler)
+
+	tests := []struct {
+		agg  string
+		want []float64
+	}{
+		{"avg", []float64{2, 10, 4.5}},
+		{"min", []float64{1, 10, 2}},
+		{"max", []float64{3, 10, 7}},
+		{"sum", []float64{4, 10, 9}},
+		{"last", []float64{3, 10, 2}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.agg, func(t *testing.T) {
+			url := "/api/v1/query_range?id=HeapAlloc&from=1000&to=1970-01-01T00:17:20Z&step=10s&agg=" + tc.agg
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var res srv.RangeResult
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+			require.Equal(t, "HeapAlloc", res.ID)
+			require.Equal(t, tc.agg, res.Agg)
+			require.Equal(t, 10.0, res.Step)
+			require.Len(t, res.Points, len(tc.want))
+			for i, p := range res.Points {
+				require.InDelta(t, tc.want[i], p.Value, 1e-9)
+			}
+			require.True(t, base.Equal(res.Points[0].Timestamp))
+			require.True(t, base.Add(30*time.Second).Equal(res.Points[2].Timestamp))
+			require.True(t, base.Equal(st.from))
+			require.True(t, base.Add(40*time.Second).Equal(st.to))
+		})
+	}
+}
+
+func TestQueryRangeHandler_Errors(t *testing.T) {
+	s := newServerWithInMem(t)
+	s.Storage = &rangeStore{Storage: s.Storage}
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/query_range", s.QueryRangeHandler)
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"no_id", "/api/v1/query_range", http.StatusBadRequest},
+		{"bad_from", "/api/v1/query_range?id=HeapAlloc&from=yesterday", http.StatusBadRequest},
+		{"from_after_to", "/api/v1/query_range?id=HeapAlloc&from=100&to=50", http.StatusBadRequest},
+		{"bad_step", "/api/v1/query_range?id=HeapAlloc&step=-1s", http.StatusBadRequest},
+		{"too_many_points", "/api/v1/query_range?id=HeapAlloc&from=0&to=1000000&step=1", http.StatusBadRequest},
+		{"bad_agg", "/api/v1/query_range?id=HeapAlloc&agg=median", http.StatusBadRequest},
+		{"not_found", "/api/v1/query_range?id=absent", http.StatusNotFound},
+		{"defaults", "/api/v1/query_range?id=HeapAlloc", http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			require.Equal(t, tc.want, rr.Code)
+		})
+	}
+}
+
+func TestQueryRangeHandler_InMemoryHistory(t *testing.T) {
+	ctx := context.Background()
+	s := newServerWithInMem(t)
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(2)})
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(3)})
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/query_range", s.QueryRangeHandler)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?id=PollCount&agg=last", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var res srv.RangeResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	require.NotEmpty(t, res.Points)
+	require.Equal(t, 5.0, res.Points[len(res.Points)-1].Value)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	ctx := context.Background()
+	s := newServerWithInMem(t)
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "HeapAlloc", Type: model.Gauge, Value: utils.F64Ptr(1.25)})
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(7)})
+
+	r := chi.NewRouter()
+	r.Get("/metrics", s.PrometheusHandler)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Equal(t,
+		"# TYPE HeapAlloc gauge\nHeapAlloc 1.25\n# TYPE PollCount counter\nPollCount 7\n",
+		rr.Body.String())
+}
+
+func TestPrometheusHandler_StorageError(t *testing.T) {
+	s := newServerWithInMem(t)
+	s.Storage = &stubStore{err: errors.New("boom")}
+
+	rr := httptest.NewRecorder()
+	s.PrometheusHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestUpdateHandlers_Labels(t *testing.T) {
+	s := newServerWithInMem(t)
+	h := buildRouter(s)
+
+	send := func(path string, v any) {
+		body, _ := json.Marshal(v)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	send("/update", model.Metric{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(10), Labels: map[string]string{"core": "1"}})
+	send("/updates", []model.Metric{
+		{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(20), Labels: map[string]string{"core": "2"}},
+		{ID: "CPUutilization", Type: model.Gauge, Value: utils.F64Ptr(30)},
+	})
+
+	all, err := s.Storage.GetAll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+
+	body, _ := json.Marshal(model.Metric{ID: "CPUutilization", Type: model.Gauge, Labels: map[string]string{"core": "2"}})
+	req := httptest.NewRequest(http.MethodPost, "/value", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var got model.Metric
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+	require.Equal(t, 20.0, *got.Value)
+	require.Equal(t, map[string]string{"core": "2"}, got.Labels)
+}
+
+func TestSources_NamespaceAndList(t *testing.T) {
+	s := newServerWithInMem(t)
+	s.Sources = srv.NewSourceRegistry(3)
+
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", s.UpdateMetricHandler)
+	r.Post("/update", s.UpdateMetricHandlerJSON)
+	r.Post("/updates", s.UpdateArrayMetricHandlerJSON)
+	r.Get("/value/{type}/{name}", s.GetMetricHandler)
+	r.Get("/sources", s.SourcesHandler)
+
+	post := func(path, agent string, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if agent != "" {
+			req.Header.Set(srv.AgentIDHeader, agent)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	one, _ := json.Marshal(model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1)})
+	batch, _ := json.Marshal([]model.Metric{{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(2)}})
+	post("/update", "agent-a", one)
+	post("/updates", "agent-b", batch)
+	post("/update/gauge/Alloc/3", "", nil)
+
+	get := func(path string) string {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	require.Equal(t, "1", get("/value/gauge/Alloc?source=agent-a"))
+	require.Equal(t, "2", get("/value/gauge/Alloc?source=agent-b"))
+	require.Equal(t, "3", get("/value/gauge/Alloc"))
+
+	var sources []srv.Source
+	require.NoError(t, json.Unmarshal([]byte(get("/sources")), &sources))
+	require.Len(t, sources, 2)
+	require.Equal(t, "agent-a", sources[0].ID)
+	require.Equal(t, "agent-b", sources[1].ID)
+	require.False(t, sources[0].LastSeen.IsZero())
+}
+
+func TestSources_HeaderTooLong(t *testing.T) {
+	s := newServerWithInMem(t)
+	r := chi.NewRouter()
+	r.Post("/update", s.UpdateMetricHandlerJSON)
+
+	body, _ := json.Marshal(model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1)})
+	req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(srv.AgentIDHeader, strings.Repeat("a", 129))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSourcesHandler_NoRegistry(t *testing.T) {
+	s := newServerWithInMem(t)
+	rr := httptest.NewRecorder()
+	s.SourcesHandler(rr, httptest.NewRequest(http.MethodGet, "/sources", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `[]`, rr.Body.String())
+}
+
+func TestGetMetricHandlers_AgentLabels(t *testing.T) {
+	s := newServerWithInMem(t)
+	s.Sources = srv.NewSourceRegistry(3)
+	h := buildRouter(s)
+
+	post := func(agent string, metrics []model.Metric) {
+		body, _ := json.Marshal(metrics)
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(srv.AgentIDHeader, agent)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	get := func(path string) (int, string) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code, rr.Body.String()
+	}
+
+	host := map[string]string{"host": "web-1"}
+	post("web-1", []model.Metric{
+		{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1.5), Labels: host},
+		{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(5), Labels: host},
+	})
+
+	code, body := get("/value/gauge/Alloc")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.5", body)
+	code, body = get("/value/counter/PollCount")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "5", body)
+	code, body = get("/value/gauge/Alloc?source=web-1")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.5", body)
+	code, _ = get("/value/gauge/Alloc?source=web-2")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/value/gauge/PollCount")
+	require.Equal(t, http.StatusNotFound, code)
+
+	reqBody, _ := json.Marshal(model.Metric{ID: "PollCount", Type: model.Counter})
+	req := httptest.NewRequest(http.MethodPost, "/value", bytes.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var got model.Metric
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+	require.EqualValues(t, 5, *got.Delta)
+	require.Equal(t, map[string]string{"host": "web-1", srv.SourceLabel: "web-1"}, got.Labels)
+
+	// with several agents, the label-less lookup returns the latest write
+	post("web-2", []model.Metric{{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(2.5), Labels: map[string]string{"host": "web-2"}}})
+	code, body = get("/value/gauge/Alloc")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "2.5", body)
+	code, body = get("/value/gauge/Alloc?source=web-1")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.5", body)
+}
+
+func TestQueryRangeHandler_SourceOfLabeledSeries(t *testing.T) {
+	ctx := context.Background()
+	s := newServerWithInMem(t)
+	labels := map[string]string{"host": "web-1", srv.SourceLabel: "vm"}
+	_ = s.Storage.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(4), Labels: labels})
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/query_range", s.QueryRangeHandler)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?id=Alloc&source=vm&agg=last", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var res srv.RangeResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	require.Equal(t, labels, res.Labels)
+	require.Equal(t, 4.0, res.Points[len(res.Points)-1].Value)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?id=Alloc&source=other", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
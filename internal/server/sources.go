@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// AgentIDHeader carries the identity of the agent that sent the metrics.
+	AgentIDHeader = "X-Agent-ID"
+	// ReportIntervalHeader carries the agent report interval in seconds.
+	ReportIntervalHeader = "X-Report-Interval"
+	// SourceLabel is the label holding the agent identity of a series.
+	SourceLabel = "source"
+	// UpMetric is the gauge evaluated by alerting for every known agent: 1 if it reports, 0 if it is down.
+	UpMetric = "up"
+
+	maxAgentIDLen = 128
+	// defaultReportInterval is assumed for agents that don't send ReportIntervalHeader.
+	defaultReportInterval = 10 * time.Second
+	// sourceExpiry is how long an agent that stopped reporting stays known.
+	sourceExpiry = 24 * time.Hour
+	// maxSources caps the number of known agents; the least recently seen is forgotten first.
+	maxSources = 10000
+)
+
+// Source describes an agent that has sent metrics to the server.
+type Source struct {
+	ID             string    `json:"id"`
+	LastSeen       time.Time `json:"last_seen"`
+	ReportInterval float64   `json:"report_interval"` // Report interval in seconds.
+	Down           bool      `json:"down"`            // No report within DownFactor report intervals.
+}
+
+type sourceState struct {
+	lastSeen       time.Time
+	reportInterval time.Duration
+}
+
+// SourceRegistry tracks known agents and the time they were last seen. Agents not
+// seen for sourceExpiry are forgotten, and so are the least recently seen ones
+// when more than maxSources agents report.
+type SourceRegistry struct {
+	downFactor int
+	now        func() time.Time
+	onForget   func(id string) // called for every forgotten agent, without reg.mu held
+
+	mu      sync.RWMutex
+	sources map[string]*sourceState
+}
+
+// NewSourceRegistry creates an empty SourceRegistry. An agent is considered down
+// when it hasn't reported within downFactor of its report intervals; values below 1 mean 1.
+func NewSourceRegistry(downFactor int) *SourceRegistry {
+	if downFactor < 1 {
+		downFactor = 1
+	}
+	return &SourceRegistry{
+		downFactor: downFactor,
+		now:        time.Now,
+		sources:    make(map[string]*sourceState),
+	}
+}
+
+// Touch records that the agent has just sent metrics. A zero reportInterval
+// keeps the previously known interval.
+func (reg *SourceRegistry) Touch(id string, reportInterval time.Duration) {
+	now := reg.now()
+
+	reg.mu.Lock()
+	var forgotten []string
+	s, ok := reg.sources[id]
+	if !ok {
+		forgotten = reg.expireLocked(now)
+		if len(reg.sources) >= maxSources {
+			forgotten = append(forgotten, reg.evictOldestLocked())
+		}
+		s = &sourceState{reportInterval: defaultReportInterval}
+		reg.sources[id] = s
+	}
+	s.lastSeen = now
+	if reportInterval > 0 {
+		s.reportInterval = reportInterval
+	}
+	reg.mu.Unlock()
+
+	reg.forget(forgotten)
+}
+
+// expireLocked forgets agents not seen for sourceExpiry and returns their IDs.
+// reg.mu must be held for writing.
+func (reg *SourceRegistry) expireLocked(now time.Time) []string {
+	var expired []string
+	for id, s := range reg.sources {
+		if now.Sub(s.lastSeen) > sourceExpiry {
+			delete(reg.sources, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// evictOldestLocked forgets the least recently seen agent and returns its ID.
+// reg.mu must be held for writing.
+func (reg *SourceRegistry) evictOldestLocked() string {
+	var (
+		oldest string
+		seen   time.Time
+	)
+	for id, s := range reg.sources {
+		if oldest == "" || s.lastSeen.Before(seen) {
+			oldest, seen = id, s.lastSeen
+		}
+	}
+	delete(reg.sources, oldest)
+	return oldest
+}
+
+// forget reports forgotten agents to onForget.
+func (reg *SourceRegistry) forget(ids []string) {
+	if reg.onForget == nil {
+		return
+	}
+	for _, id := range ids {
+		reg.onForget(id)
+	}
+}
+
+// List returns a snapshot of known agents sorted by ID.
+func (reg *SourceRegistry) List() []Source {
+	now := reg.now()
+
+	reg.mu.Lock()
+	forgotten := reg.expireLocked(now)
+	res := make([]Source, 0, len(reg.sources))
+	for id, s := range reg.sources {
+		res = append(res, Source{
+			ID:             id,
+			LastSeen:       s.lastSeen,
+			ReportInterval: s.reportInterval.Seconds(),
+			Down:           now.Sub(s.lastSeen) > time.Duration(reg.downFactor)*s.reportInterval,
+		})
+	}
+	reg.mu.Unlock()
+
+	reg.forget(forgotten)
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// SourcesHandler returns the known agents, their last-seen time and liveness in JSON format.
+func (srv *Server) SourcesHandler(w http.ResponseWriter, r *http.Request) {
+	sources := []Source{}
+	if srv.Sources != nil {
+		sources = srv.Sources.List()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sources); err != nil {
+		log.Printf("failed to write sources response: %v", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// agentInfo identifies the agent that sent a request.
+type agentInfo struct {
+	ID             string
+	ReportInterval time.Duration
+}
+
+// requestSource reads the agent identity from the X-Agent-ID and X-Report-Interval headers.
+// Both are optional.
+func requestSource(r *http.Request) (agentInfo, error) {
+	return parseSource(r.Header.Get(AgentIDHeader), r.Header.Get(ReportIntervalHeader))
+}
+
+// metadataSource reads the agent identity from the x-agent-id and x-report-interval
+// metadata of a gRPC call. Both are optional.
+func metadataSource(ctx context.Context) (agentInfo, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	return parseSource(first(AgentIDHeader), first(ReportIntervalHeader))
+}
+
+func parseSource(id, interval string) (agentInfo, error) {
+	var agent agentInfo
+
+	agent.ID = strings.TrimSpace(id)
+	if len(agent.ID) > maxAgentIDLen {
+		return agentInfo{}, fmt.Errorf("%s is longer than %d bytes", AgentIDHeader, maxAgentIDLen)
+	}
+
+	if interval != "" {
+		sec, err := strconv.Atoi(interval)
+		if err != nil || sec < 0 {
+			return agentInfo{}, fmt.Errorf("invalid %s: %q", ReportIntervalHeader, interval)
+		}
+		agent.ReportInterval = time.Duration(sec) * time.Second
+	}
+
+	return agent, nil
+}
+
+// applySource labels the metric with the agent ID and records the agent as seen.
+// A non-empty agent ID overrides the source label of the payload; otherwise the payload label is kept.
+func (srv *Server) applySource(agent agentInfo, m *model.Metric) {
+	if agent.ID != "" && m.Labels[SourceLabel] != agent.ID {
+		labels := make(map[string]string, len(m.Labels)+1)
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		labels[SourceLabel] = agent.ID
+		m.Labels = labels
+	}
+	if source := m.Labels[SourceLabel]; source != "" && srv.Sources != nil {
+		srv.Sources.Touch(source, agent.ReportInterval)
+	}
+}
+
+// liveSource adds an up{source="<agent>"} gauge for every known agent to the stored
+// metrics, so that alert rules such as "gauge up < 1" detect agents that went down.
+type liveSource struct {
+	storage Storage
+	sources *SourceRegistry
+}
+
+// GetAll returns stored metrics together with the up gauges.
+func (s liveSource) GetAll(ctx context.Context) (map[string]*model.Metric, error) {
+	all, err := s.storage.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := s.sources.List()
+	res := make(map[string]*model.Metric, len(all)+len(sources))
+	for k, m := range all {
+		res[k] = m
+	}
+	for _, src := range sources {
+		up := 1.0
+		if src.Down {
+			up = 0
+		}
+		m := &model.Metric{
+			ID:     UpMetric,
+			Type:   model.Gauge,
+			Value:  utils.F64Ptr(up),
+			Labels: map[string]string{SourceLabel: src.ID},
+		}
+		res[m.Key()] = m
+	}
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+// newServer creates a server with NewServer, failing the test on error.
+func newServer(t *testing.T, st Storage, cfg *config.ServerConfig, priv *rsa.PrivateKey) *Server {
+	t.Helper()
+	srv, err := NewServer(st, cfg, priv)
+	require.NoError(t, err)
+	return srv
+}
+
+func TestSourceRegistry_Down(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	reg := NewSourceRegistry(3)
+	reg.now = func() time.Time { return now }
+
+	reg.Touch("fast", 2*time.Second)
+	reg.Touch("legacy", 0)
+
+	now = now.Add(7 * time.Second)
+	sources := reg.List()
+	require.Len(t, sources, 2)
+	require.Equal(t, Source{ID: "fast", LastSeen: now.Add(-7 * time.Second), ReportInterval: 2, Down: true}, sources[0])
+	require.Equal(t, "legacy", sources[1].ID)
+	require.Equal(t, defaultReportInterval.Seconds(), sources[1].ReportInterval)
+	require.False(t, sources[1].Down)
+
+	reg.Touch("fast", 0)
+	require.False(t, reg.List()[0].Down)
+	require.Equal(t, 2.0, reg.List()[0].ReportInterval)
+}
+
+func TestSourceRegistry_Expiry(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	reg := NewSourceRegistry(3)
+	reg.now = func() time.Time { return now }
+
+	reg.Touch("gone", 0)
+	now = now.Add(sourceExpiry / 2)
+	reg.Touch("alive", 0)
+	now = now.Add(sourceExpiry/2 + time.Second)
+
+	sources := reg.List()
+	require.Len(t, sources, 1, "agents not seen for sourceExpiry are forgotten")
+	require.Equal(t, "alive", sources[0].ID)
+}
+
+func TestSourceRegistry_Cap(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	reg := NewSourceRegistry(3)
+	reg.now = func() time.Time { return now }
+
+	for i := 0; i < maxSources; i++ {
+		reg.Touch(fmt.Sprintf("agent-%d", i), 0)
+		now = now.Add(time.Millisecond)
+	}
+	reg.Touch("agent-0", 0)
+	reg.Touch("new", 0)
+
+	sources := reg.List()
+	require.Len(t, sources, maxSources)
+	ids := make(map[string]bool, len(sources))
+	for _, s := range sources {
+		ids[s.ID] = true
+	}
+	require.True(t, ids["new"])
+	require.True(t, ids["agent-0"], "recently seen agent is kept")
+	require.False(t, ids["agent-1"], "least recently seen agent is forgotten")
+}
+
+func TestRequestSource(t *testing.T) {
+	r := httptest.NewRequest("POST", "/update", nil)
+	r.Header.Set(AgentIDHeader, " web-1 ")
+	r.Header.Set(ReportIntervalHeader, "5")
+	agent, err := requestSource(r)
+	require.NoError(t, err)
+	require.Equal(t, agentInfo{ID: "web-1", ReportInterval: 5 * time.Second}, agent)
+
+	r.Header.Set(ReportIntervalHeader, "soon")
+	_, err = requestSource(r)
+	require.Error(t, err)
+}
+
+func TestAgentDownAlert(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{AgentDownFactor: 2}, nil)
+
+	now := time.Unix(1_700_000_000, 0)
+	srv.Sources.now = func() time.Time { return now }
+
+	srv.applySource(agentInfo{ID: "web-1", ReportInterval: 10 * time.Second}, &model.Metric{ID: "Alloc"})
+	require.NoError(t, srv.Alerting.Evaluate(ctx))
+	require.Empty(t, srv.Alerting.Alerts())
+
+	now = now.Add(21 * time.Second)
+	require.NoError(t, srv.Alerting.Evaluate(ctx))
+	alerts := srv.Alerting.Alerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, agentDownRule, alerts[0].Rule)
+	require.Equal(t, map[string]string{SourceLabel: "web-1"}, alerts[0].Labels)
+	require.Equal(t, alerting.StateFiring, alerts[0].State)
+
+	srv.applySource(agentInfo{ID: "web-1"}, &model.Metric{ID: "Alloc"})
+	require.NoError(t, srv.Alerting.Evaluate(ctx))
+	require.Equal(t, alerting.StateResolved, srv.Alerting.Alerts()[0].State)
+}
+
+func TestAgentDownAlert_ForgottenAgent(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{AgentDownFactor: 2}, nil)
+
+	now := time.Unix(1_700_000_000, 0)
+	srv.Sources.now = func() time.Time { return now }
+
+	srv.applySource(agentInfo{ID: "web-1", ReportInterval: 10 * time.Second}, &model.Metric{ID: "Alloc"})
+	now = now.Add(21 * time.Second)
+	require.NoError(t, srv.Alerting.Evaluate(ctx))
+	require.Equal(t, alerting.StateFiring, srv.Alerting.Alerts()[0].State)
+
+	now = now.Add(sourceExpiry)
+	require.NoError(t, srv.Alerting.Evaluate(ctx))
+	require.Empty(t, srv.Alerting.Alerts(), "alert of a forgotten agent is dropped, not resolved")
+}
+
+func TestWithAgentDownRule_KeepsConfigured(t *testing.T) {
+	custom, err := alerting.ParseRule(agentDownRule, "gauge up < 1 for 1m")
+	require.NoError(t, err)
+
+	rules := withAgentDownRule([]alerting.Rule{custom})
+	require.Equal(t, []alerting.Rule{custom}, rules)
+
+	rules = withAgentDownRule(nil)
+	require.Len(t, rules, 1)
+	require.Equal(t, UpMetric, rules[0].MetricID)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// sseKeepAlive is the interval of comments sent to keep idle event streams open.
+const sseKeepAlive = 15 * time.Second
+
+// StreamHandler sends metric updates as Server-Sent Events: a "metric" event with
+// the stored metric in JSON every time a save changes it. The optional prefix and
+// type query parameters select metrics by ID prefix and type. The stream ends when
+// the client disconnects, falls behind or the server shuts down.
+func (srv *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if srv.Hub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	typ := model.MetricType(r.URL.Query().Get("type"))
+	if typ != "" && typ != model.Gauge && typ != model.Counter {
+		http.Error(w, "unsupported metric type", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sub := srv.Hub.Subscribe(func(u Update) bool {
+		m := u.Metric
+		return m != nil && strings.HasPrefix(m.ID, prefix) && (typ == "" || m.Type == typ)
+	})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("stream: flush: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case u := <-sub.Updates():
+			err = writeEvent(w, "metric", u.Metric)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-sub.Done():
+			if err := sub.Err(); err != nil {
+				log.Printf("stream: %v", err)
+			}
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Printf("stream: write: %v", err)
+			return
+		}
+	}
+}
+
+// writeEvent writes a Server-Sent Event with the JSON encoding of v as data.
+func writeEvent(w http.ResponseWriter, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// publishQueueSize is the number of saves whose updates may wait to be published.
+const publishQueueSize = 1024
+
+// publish queues saved metrics to be sent to the hub subscribers without delaying
+// the save: a publishing goroutine started on first use reads counters back to
+// publish their total. Updates are dropped while the queue is full.
+func (srv *Server) publish(saved []model.Metric) {
+	if srv.Hub == nil || !srv.Hub.Active() {
+		return
+	}
+	srv.publishOnce.Do(func() {
+		srv.published = make(chan []model.Metric, publishQueueSize)
+		go srv.runPublisher()
+	})
+	select {
+	case srv.published <- append([]model.Metric(nil), saved...):
+	default:
+		log.Printf("publish: queue full, dropping %d updates", len(saved))
+	}
+}
+
+// runPublisher publishes queued saves until the hub is closed. Gauges are published
+// as saved; counters are read back to publish their total.
+func (srv *Server) runPublisher() {
+	ctx := context.Background()
+	for {
+		select {
+		case saved := <-srv.published:
+			for i := range saved {
+				m := saved[i]
+				if m.Type == model.Counter {
+					stored, err := srv.Storage.Get(ctx, &m)
+					if err != nil {
+						log.Printf("publish %s: %v", m.ID, err)
+						continue
+					}
+					m = *stored
+				}
+				srv.Hub.Publish(Update{Metric: &m})
+			}
+		case <-srv.Hub.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// readEvent reads the next event of an event stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (event, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, nil)
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/stream?prefix=Poll&type=counter", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Eventually(t, srv.Hub.Active, time.Second, 5*time.Millisecond)
+
+	post := func(path, body string) {
+		r, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		r.Body.Close()
+		require.Equal(t, http.StatusOK, r.StatusCode)
+	}
+	post("/update/gauge/PollRate/1", "")
+	post("/update/counter/Other/1", "")
+	post("/update/counter/PollCount/2", "")
+
+	// counters are read back after the save, so read each event before the next save
+	body := bufio.NewReader(resp.Body)
+	event, data := readEvent(t, body)
+	require.Equal(t, "metric", event)
+	require.JSONEq(t, `{"id":"PollCount","type":"counter","delta":2}`, data)
+
+	post("/updates/", `[{"id":"PollCount","type":"counter","delta":3},{"id":"PollTotal","type":"counter","delta":1}]`)
+	_, data = readEvent(t, body)
+	require.JSONEq(t, `{"id":"PollCount","type":"counter","delta":5}`, data, "counters carry the stored total")
+	_, data = readEvent(t, body)
+	require.JSONEq(t, `{"id":"PollTotal","type":"counter","delta":1}`, data)
+
+	srv.Hub.Close()
+	_, err = body.ReadString('\n')
+	require.Error(t, err, "stream ends when the hub closes")
+}
+
+func TestStreamHandler_BadType(t *testing.T) {
+	srv := newServer(t, inmemory.NewMemStorage(context.Background()), &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	rec := httptest.NewRecorder()
+	srv.StreamHandler(rec, httptest.NewRequest(http.MethodGet, "/stream?type=histogram", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.False(t, srv.Hub.Active())
+}
+
+// blockingGetStorage blocks Get until release is closed.
+type blockingGetStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s *blockingGetStorage) Get(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+	<-s.release
+	return s.Storage.Get(ctx, m)
+}
+
+func TestPublish_DoesNotReadBackOnSave(t *testing.T) {
+	ctx := context.Background()
+	st := &blockingGetStorage{Storage: inmemory.NewMemStorage(ctx), release: make(chan struct{})}
+	srv := newServer(t, st, &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	sub := srv.Hub.Subscribe(nil)
+	defer srv.Hub.Close()
+
+	saved := make(chan error, 1)
+	go func() {
+		saved <- srv.saveToStorage(ctx, &model.Metric{ID: "PollCount", Type: model.Counter, Delta: utils.I64Ptr(2)})
+	}()
+	select {
+	case err := <-saved:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("save waits for the counter read-back")
+	}
+
+	close(st.release)
+	select {
+	case u := <-sub.Updates():
+		require.EqualValues(t, 2, *u.Metric.Delta)
+	case <-time.After(time.Second):
+		t.Fatal("update not published")
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+)
+
+// sumSeriesIdle is how long the state of a series is kept without writes. A cumulative
+// sum written again after that records a new baseline.
+const sumSeriesIdle = time.Hour
+
+// sumSample is a value mapped to a metric. For counters, value is the sum value yet
+// to be converted to a delta.
+type sumSample struct {
+	metric     model.Metric
+	value      float64
+	cumulative bool
+	start      uint64 // start time of a cumulative sum; a change means a reset
+	time       int64  // time of the value in Unix nanoseconds, or 0 if unknown
+}
+
+// sumState converts OTLP monotonic sums and cumulative InfluxDB counters into counter
+// deltas. Values are accumulated per series and only whole increments are reported;
+// fractions are carried over to the next write. Samples with a time not after the
+// last one written for their series are dropped as replayed or out of order.
+// It is safe for concurrent use; writes of the same series are serialized.
+type sumState struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	series    map[string]*sumSeries
+	writing   map[string]chan struct{} // series of writes in flight; closed when the write is done
+	lastSweep time.Time
+}
+
+type sumSeries struct {
+	start    uint64    // start time of a cumulative sum
+	total    float64   // sum value accumulated so far
+	reported float64   // part of total already stored
+	time     int64     // time of the last sample with a known time
+	seen     time.Time // time of the last committed write
+}
+
+func newSumState() *sumState {
+	return &sumState{
+		now:     time.Now,
+		series:  make(map[string]*sumSeries),
+		writing: make(map[string]chan struct{}),
+	}
+}
+
+// metrics returns gauges with their values and counters with their deltas. The first
+// sample of a cumulative sum only records the baseline. The series of the samples are
+// held until done is called, after the metrics are saved or failed to save, so that
+// concurrent writes of a series compute their deltas from the state saved by the
+// previous one; metrics waits for the series held by other writes, or returns the
+// context error. The state is only changed by done with saved set, so that a request
+// that fails to save can be retried.
+func (st *sumState) metrics(ctx context.Context, samples []sumSample) (res []model.Metric, done func(saved bool), err error) {
+	keys := make([]string, 0, len(samples))
+	for _, s := range samples {
+		keys = append(keys, s.metric.Key())
+	}
+
+	st.mu.Lock()
+	for {
+		busy := st.busyLocked(keys)
+		if busy == nil {
+			break
+		}
+		st.mu.Unlock()
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		st.mu.Lock()
+	}
+	release := make(chan struct{})
+	for _, key := range keys {
+		st.writing[key] = release
+	}
+	res, next := st.convertLocked(samples)
+	st.mu.Unlock()
+
+	return res, func(saved bool) { st.done(keys, release, next, saved) }, nil
+}
+
+// busyLocked returns the release channel of a write in flight holding one of the
+// series, or nil. st.mu must be held.
+func (st *sumState) busyLocked(keys []string) chan struct{} {
+	for _, key := range keys {
+		if release, ok := st.writing[key]; ok {
+			return release
+		}
+	}
+	return nil
+}
+
+// convertLocked converts the samples and returns the series state after them. st.mu must be held.
+func (st *sumState) convertLocked(samples []sumSample) ([]model.Metric, map[string]*sumSeries) {
+	next := make(map[string]*sumSeries)
+	res := make([]model.Metric, 0, len(samples))
+	for _, s := range samples {
+		m := s.metric
+		key := m.Key()
+		series, ok := next[key]
+		if !ok {
+			if prev, found := st.series[key]; found {
+				c := *prev
+				series, ok = &c, true
+			}
+		}
+		if s.time != 0 && ok {
+			if s.time <= series.time {
+				continue
+			}
+			series.time = s.time
+		}
+
+		if m.Type == model.Gauge {
+			m.Value = utils.F64Ptr(s.value)
+			res = append(res, m)
+			if s.time != 0 {
+				if !ok {
+					series = &sumSeries{time: s.time}
+				}
+				next[key] = series
+			}
+			continue
+		}
+
+		switch {
+		case !ok && s.cumulative:
+			next[key] = &sumSeries{start: s.start, total: s.value, reported: s.value, time: s.time}
+			continue
+		case !ok:
+			series = &sumSeries{time: s.time}
+		}
+		next[key] = series
+
+		if s.cumulative {
+			if s.value < series.total || s.start != series.start { // counter reset
+				series.reported = 0
+			}
+			series.start, series.total = s.start, s.value
+		} else {
+			series.total += s.value
+		}
+		delta := math.Floor(series.total - series.reported)
+		series.reported += delta
+		m.Delta = utils.I64Ptr(int64(delta))
+		res = append(res, m)
+	}
+	return res, next
+}
+
+// done releases the series of a write, records their state if the write was saved
+// and drops series idle for sumSeriesIdle.
+func (st *sumState) done(keys []string, release chan struct{}, next map[string]*sumSeries, saved bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, key := range keys {
+		delete(st.writing, key)
+	}
+	close(release)
+
+	now := st.now()
+	if saved {
+		for key, series := range next {
+			series.seen = now
+			st.series[key] = series
+		}
+	}
+	if now.Sub(st.lastSweep) < sumSeriesIdle {
+		return
+	}
+	st.lastSweep = now
+	for key, series := range st.series {
+		if now.Sub(series.seen) > sumSeriesIdle {
+			delete(st.series, key)
+		}
+	}
+}
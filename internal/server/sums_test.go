@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSumState(t *testing.T) {
+	st := newSumState()
+	counter := func(v float64, cumulative bool, start uint64) []model.Metric {
+		ms, done, err := st.metrics(context.Background(), []sumSample{{metric: model.Metric{ID: "c", Type: model.Counter}, value: v, cumulative: cumulative, start: start}})
+		require.NoError(t, err)
+		done(true)
+		return ms
+	}
+	delta := func(ms []model.Metric) int64 {
+		require.Len(t, ms, 1)
+		return *ms[0].Delta
+	}
+
+	require.Empty(t, counter(10, true, 1), "baseline")
+	require.EqualValues(t, 2, delta(counter(12.5, true, 1)))
+	require.EqualValues(t, 1, delta(counter(13.5, true, 1)), "fraction carried over")
+	require.EqualValues(t, 3, delta(counter(3, true, 2)), "restart")
+	require.EqualValues(t, 2, delta(counter(2, true, 2)), "reset")
+
+	st = newSumState()
+	require.EqualValues(t, 0, delta(counter(0.6, false, 0)))
+	require.EqualValues(t, 1, delta(counter(0.6, false, 0)))
+}
+
+func TestSumState_CommitAndExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	st := newSumState()
+	st.now = func() time.Time { return now }
+	sample := func(id string, v float64) []sumSample {
+		return []sumSample{{metric: model.Metric{ID: id, Type: model.Counter}, value: v, cumulative: true, start: 1}}
+	}
+
+	write := func(id string, v float64, saved bool) []model.Metric {
+		ms, done, err := st.metrics(context.Background(), sample(id, v))
+		require.NoError(t, err)
+		done(saved)
+		return ms
+	}
+
+	write("c", 10, true)
+	require.EqualValues(t, 5, *write("c", 15, false)[0].Delta)
+	require.EqualValues(t, 5, *write("c", 15, true)[0].Delta, "unsaved export is reported again on retry")
+	require.EqualValues(t, 0, *write("c", 15, false)[0].Delta)
+
+	now = now.Add(sumSeriesIdle / 2)
+	write("d", 1, true)
+	now = now.Add(sumSeriesIdle)
+	write("d", 2, true)
+	require.NotContains(t, st.series, "c", "idle series is dropped")
+	require.Contains(t, st.series, "d")
+}
+
+func TestSumState_SerializesSeries(t *testing.T) {
+	st := newSumState()
+	sample := func(v float64) []sumSample {
+		return []sumSample{{metric: model.Metric{ID: "c", Type: model.Counter}, value: v, cumulative: true, start: 1}}
+	}
+	_, done, err := st.metrics(context.Background(), sample(10))
+	require.NoError(t, err)
+	done(true)
+
+	ms, done, err := st.metrics(context.Background(), sample(15))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, *ms[0].Delta)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = st.metrics(ctx, sample(15))
+	require.ErrorIs(t, err, context.DeadlineExceeded, "series is held by the write in flight")
+
+	other, doneOther, err := st.metrics(context.Background(), []sumSample{{metric: model.Metric{ID: "g", Type: model.Gauge}, value: 1}})
+	require.NoError(t, err, "other series are not held")
+	require.Len(t, other, 1)
+	doneOther(true)
+
+	res := make(chan []model.Metric)
+	go func() {
+		ms, done, err := st.metrics(context.Background(), sample(15))
+		if err == nil {
+			done(true)
+		}
+		res <- ms
+	}()
+	done(true)
+	ms = <-res
+	require.Len(t, ms, 1)
+	require.EqualValues(t, 0, *ms[0].Delta, "waiting write computes its delta from the saved state")
+}
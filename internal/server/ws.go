@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+	wsMaxMessage   = 64 << 10
+)
+
+// WebSocket actions of client requests and types of server messages.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+
+	wsMetric        = "metric"
+	wsAlert         = "alert"
+	wsSubscriptions = "subscriptions"
+	wsError         = "error"
+)
+
+var wsUpgrader = websocket.Upgrader{}
+
+// wsRequest is a message of a WebSocket client. When the server has a hash key,
+// the optional hash is checked against the JSON encoding of the request with the
+// fields in this order and the hash unset.
+type wsRequest struct {
+	Action  string   `json:"action"`  // wsSubscribe or wsUnsubscribe
+	Metrics []string `json:"metrics"` // metric IDs or glob patterns
+	Hash    string   `json:"hash,omitempty"`
+}
+
+// wsMessage is a message sent to a WebSocket client. When the server has a hash
+// key, hash is set to the hash of the message JSON encoding without it.
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Metric  *model.Metric   `json:"metric,omitempty"`
+	Alert   *alerting.Alert `json:"alert,omitempty"`
+	Metrics []string        `json:"metrics,omitempty"` // patterns subscribed to, for wsSubscriptions
+	Error   string          `json:"error,omitempty"`
+	Hash    string          `json:"hash,omitempty"`
+}
+
+// WebSocketHandler lets clients subscribe to metric updates and alert state changes.
+// Clients send {"action":"subscribe","metrics":[...]} and "unsubscribe" requests
+// with metric IDs or glob patterns, as text messages or as binary messages holding
+// the request encrypted with the server public key. Each request is answered with
+// the current patterns or an error. Matching metric updates and alerts of matching
+// metrics are sent as they happen; a client that falls behind is disconnected.
+func (srv *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if srv.Hub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has replied with an error
+		log.Printf("ws: upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	patterns := &patternSet{patterns: make(map[string]struct{})}
+	sub := srv.Hub.Subscribe(func(u Update) bool {
+		switch {
+		case u.Metric != nil:
+			return patterns.match(u.Metric.ID)
+		case u.Alert != nil:
+			return patterns.match(u.Alert.MetricID)
+		}
+		return false
+	})
+	defer sub.Close()
+
+	replies := make(chan wsMessage)
+	stop := make(chan struct{})
+	defer close(stop)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		srv.readWebSocket(conn, patterns, replies, stop)
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case u := <-sub.Updates():
+			msg := wsMessage{Type: wsMetric, Metric: u.Metric}
+			if u.Alert != nil {
+				msg = wsMessage{Type: wsAlert, Alert: u.Alert}
+			}
+			err = srv.writeWebSocket(conn, msg)
+		case msg := <-replies:
+			err = srv.writeWebSocket(conn, msg)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		case <-sub.Done():
+			code := websocket.CloseGoingAway
+			if errors.Is(sub.Err(), ErrSlowSubscriber) {
+				code = websocket.CloseTryAgainLater
+			}
+			msg := websocket.FormatCloseMessage(code, fmt.Sprint(sub.Err()))
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+			return
+		case <-readDone:
+			return
+		}
+		if err != nil {
+			log.Printf("ws: write: %v", err)
+			return
+		}
+	}
+}
+
+// readWebSocket handles client requests until the connection fails or stop is closed.
+func (srv *Server) readWebSocket(conn *websocket.Conn, patterns *patternSet, replies chan<- wsMessage, stop <-chan struct{}) {
+	conn.SetReadLimit(wsMaxMessage)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		reply := srv.handleWebSocketRequest(patterns, typ, data)
+		select {
+		case replies <- reply:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleWebSocketRequest applies a client request to the patterns and returns the reply.
+func (srv *Server) handleWebSocketRequest(patterns *patternSet, typ int, data []byte) wsMessage {
+	if typ == websocket.BinaryMessage {
+		if srv.PrivateKey == nil {
+			return wsMessage{Type: wsError, Error: "encryption not supported"}
+		}
+		plain, err := crypto.DecryptEnvelope(srv.PrivateKey, data)
+		if err != nil {
+			return wsMessage{Type: wsError, Error: "decrypt failed"}
+		}
+		data = plain
+	}
+
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return wsMessage{Type: wsError, Error: "invalid JSON"}
+	}
+	if srv.Config.Key != "" && req.Hash != "" {
+		hash := req.Hash
+		req.Hash = ""
+		b, err := json.Marshal(req)
+		if err != nil || utils.CalculateHash(b, srv.Config.Key) != hash {
+			return wsMessage{Type: wsError, Error: "invalid hash"}
+		}
+	}
+	for _, p := range req.Metrics {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return wsMessage{Type: wsError, Error: fmt.Sprintf("invalid pattern %q", p)}
+		}
+	}
+
+	switch req.Action {
+	case wsSubscribe:
+		patterns.add(req.Metrics)
+	case wsUnsubscribe:
+		patterns.remove(req.Metrics)
+	default:
+		return wsMessage{Type: wsError, Error: fmt.Sprintf("unknown action %q", req.Action)}
+	}
+	return wsMessage{Type: wsSubscriptions, Metrics: patterns.list()}
+}
+
+// writeWebSocket sends a message, signed when the server has a hash key.
+func (srv *Server) writeWebSocket(conn *websocket.Conn, msg wsMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if srv.Config.Key != "" {
+		msg.Hash = utils.CalculateHash(b, srv.Config.Key)
+		if b, err = json.Marshal(msg); err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// patternSet is the set of metric ID glob patterns a WebSocket client subscribed to.
+type patternSet struct {
+	mu       sync.RWMutex
+	patterns map[string]struct{}
+}
+
+func (s *patternSet) add(patterns []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range patterns {
+		s.patterns[p] = struct{}{}
+	}
+}
+
+func (s *patternSet) remove(patterns []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range patterns {
+		delete(s.patterns, p)
+	}
+}
+
+func (s *patternSet) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]string, 0, len(s.patterns))
+	for p := range s.patterns {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// match reports whether the metric ID matches any of the patterns.
+func (s *patternSet) match(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for p := range s.patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
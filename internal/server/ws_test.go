@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/and161185/metrics-alerting/internal/alerting"
+	"github.com/and161185/metrics-alerting/internal/config"
+	"github.com/and161185/metrics-alerting/internal/crypto"
+	"github.com/and161185/metrics-alerting/internal/utils"
+	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// dialWS starts the server router and connects to its WebSocket endpoint.
+func dialWS(t *testing.T, srv *Server) (*websocket.Conn, *httptest.Server) {
+	t.Helper()
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(ts.Close)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, ts
+}
+
+// readWS reads the next message and checks its hash if key is set.
+func readWS(t *testing.T, conn *websocket.Conn, key string) wsMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var msg wsMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	if key != "" {
+		hash := msg.Hash
+		msg.Hash = ""
+		b, err := json.Marshal(msg)
+		require.NoError(t, err)
+		require.Equal(t, utils.CalculateHash(b, key), hash)
+	}
+	return msg
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	conn, ts := dialWS(t, srv)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsSubscribe, Metrics: []string{"Poll*", "Alloc"}}))
+	require.Equal(t, wsMessage{Type: wsSubscriptions, Metrics: []string{"Alloc", "Poll*"}}, readWS(t, conn, ""))
+
+	for _, path := range []string{"/update/gauge/Other/1", "/update/counter/PollCount/2", "/update/counter/PollCount/3"} {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	msg := readWS(t, conn, "")
+	require.Equal(t, wsMetric, msg.Type)
+	require.Equal(t, "PollCount", msg.Metric.ID)
+	require.EqualValues(t, 2, *msg.Metric.Delta)
+	require.EqualValues(t, 5, *readWS(t, conn, "").Metric.Delta)
+
+	require.NoError(t, srv.Hub.Notify(ctx, alerting.Alert{Rule: "Other", MetricID: "Other", State: alerting.StateFiring}))
+	require.NoError(t, srv.Hub.Notify(ctx, alerting.Alert{Rule: "LowMemory", MetricID: "Alloc", State: alerting.StateFiring}))
+	msg = readWS(t, conn, "")
+	require.Equal(t, wsAlert, msg.Type)
+	require.Equal(t, "LowMemory", msg.Alert.Rule)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsUnsubscribe, Metrics: []string{"Poll*"}}))
+	require.Equal(t, []string{"Alloc"}, readWS(t, conn, "").Metrics)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsSubscribe, Metrics: []string{"["}}))
+	require.Equal(t, wsMessage{Type: wsError, Error: `invalid pattern "["`}, readWS(t, conn, ""))
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: "list"}))
+	require.Equal(t, wsError, readWS(t, conn, "").Type)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("secret")))
+	require.Equal(t, wsMessage{Type: wsError, Error: "encryption not supported"}, readWS(t, conn, ""))
+}
+
+func TestWebSocketHandler_HashAndEncryption(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{Key: "secret", Logger: zap.NewNop().Sugar()}, priv)
+	conn, _ := dialWS(t, srv)
+
+	req := wsRequest{Action: wsSubscribe, Metrics: []string{"Alloc"}}
+	b, err := json.Marshal(req)
+	require.NoError(t, err)
+	req.Hash = utils.CalculateHash(b, "secret")
+	b, err = json.Marshal(req)
+	require.NoError(t, err)
+	env, err := crypto.EncryptEnvelope(&priv.PublicKey, b)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, env))
+	require.Equal(t, []string{"Alloc"}, readWS(t, conn, "secret").Metrics)
+
+	srv.publish([]model.Metric{{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1.5)}})
+	require.Equal(t, 1.5, *readWS(t, conn, "secret").Metric.Value)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsSubscribe, Metrics: []string{"Other"}, Hash: "bad"}))
+	require.Equal(t, "invalid hash", readWS(t, conn, "secret").Error)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("garbage")))
+	require.Equal(t, "decrypt failed", readWS(t, conn, "secret").Error)
+}
+
+func TestWebSocketHandler_DropsSlowConsumer(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t, inmemory.NewMemStorage(ctx), &config.ServerConfig{Logger: zap.NewNop().Sugar()}, nil)
+	conn, _ := dialWS(t, srv)
+	require.NoError(t, conn.WriteJSON(wsRequest{Action: wsSubscribe, Metrics: []string{"*"}}))
+	readWS(t, conn, "")
+
+	// the hub drops a subscriber whose buffer is full instead of blocking the save
+	srv.Hub.mu.Lock()
+	for s := range srv.Hub.subs {
+		delete(srv.Hub.subs, s)
+		s.stop(ErrSlowSubscriber)
+	}
+	srv.Hub.mu.Unlock()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err := conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), "got %v", err)
+
+	conn, _ = dialWS(t, srv)
+	srv.Hub.Close()
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+}
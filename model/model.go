@@ -1,6 +1,13 @@
 // Package model contains core data types for the project.
 package model
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // MetricType defines the type of a metric: gauge or counter.
 type MetricType string
 
@@ -11,8 +18,61 @@ const (
 
 // Metric represents a single metric with its ID, type, and value.
 type Metric struct {
-	ID    string     `json:"id"`              // Metric name.
-	Type  MetricType `json:"type"`            // Metric type: gauge or counter.
-	Delta *int64     `json:"delta,omitempty"` // Value for counter metrics.
-	Value *float64   `json:"value,omitempty"` // Value for gauge metrics.
+	ID     string            `json:"id"`               // Metric name.
+	Type   MetricType        `json:"type"`             // Metric type: gauge or counter.
+	Delta  *int64            `json:"delta,omitempty"`  // Value for counter metrics.
+	Value  *float64          `json:"value,omitempty"`  // Value for gauge metrics.
+	Labels map[string]string `json:"labels,omitempty"` // Optional labels distinguishing series with the same ID.
+	// Timestamp is the optional collection time of the value, set by agents when
+	// they send values queued while the server was unavailable.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// SampleTime returns the time the value is recorded at: its Timestamp, if set and
+// not after now, or now.
+func (m *Metric) SampleTime(now time.Time) time.Time {
+	if m.Timestamp == nil || m.Timestamp.After(now) {
+		return now
+	}
+	return *m.Timestamp
+}
+
+// Key returns the series key of the metric: the ID followed by its labels sorted by name,
+// e.g. CPUutilization{core="1",host="web-1"}. A metric without labels is keyed by its ID.
+func (m *Metric) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// SeriesKey builds the series key for the given ID and labels.
+func SeriesKey(id string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return id
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(id)
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Sample is a timestamped value of a metric recorded on every accepted write.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`       // Time the write was accepted, or the metric Timestamp.
+	Delta     *int64    `json:"delta,omitempty"` // Counter total after the write.
+	Value     *float64  `json:"value,omitempty"` // Gauge value.
 }
@@ -0,0 +1,25 @@
+package model
+
+import "testing"
+
+func TestSeriesKey(t *testing.T) {
+	cases := []struct {
+		name   string
+		id     string
+		labels map[string]string
+		want   string
+	}{
+		{"no_labels", "Alloc", nil, "Alloc"},
+		{"empty_labels", "Alloc", map[string]string{}, "Alloc"},
+		{"sorted", "CPUutilization", map[string]string{"host": "web-1", "core": "1"}, `CPUutilization{core="1",host="web-1"}`},
+		{"escaped", "x", map[string]string{"path": `a"b`}, `x{path="a\"b"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Metric{ID: tc.id, Labels: tc.labels}
+			if got := m.Key(); got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -7,35 +7,78 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/and161185/metrics-alerting/internal/errs"
+	"github.com/and161185/metrics-alerting/internal/utils"
 	"github.com/and161185/metrics-alerting/model"
 )
 
+// DefaultHistoryLimit is the number of samples kept per metric by NewMemStorage.
+const DefaultHistoryLimit = 10000
+
+// retentionSweepEvery is how often samples and metrics older than the retention are deleted.
+const retentionSweepEvery = time.Minute
+
 // MemStorage is an in-memory implementation of the Storage interface.
 type MemStorage struct {
-	metrics map[string]*model.Metric
-	mu      sync.RWMutex
+	metrics      map[string]*model.Metric
+	history      map[string][]model.Sample
+	written      map[string]lastWrite // last write of each series
+	writes       uint64
+	historyLimit int
+	retention    time.Duration
+	lastSweep    time.Time
+	now          func() time.Time
+	mu           sync.RWMutex
+}
+
+type lastWrite struct {
+	seq uint64 // number of the write
+	at  time.Time
 }
 
-// NewMemStorage creates a new MemStorage instance.
+// NewMemStorage creates a new MemStorage instance keeping up to DefaultHistoryLimit samples per metric.
 func NewMemStorage(ctx context.Context) *MemStorage {
+	return NewMemStorageWithHistory(ctx, DefaultHistoryLimit)
+}
+
+// NewMemStorageWithHistory creates a new MemStorage instance keeping up to limit samples per metric.
+// The oldest samples are dropped first; a limit of 0 disables history.
+func NewMemStorageWithHistory(ctx context.Context, limit int) *MemStorage {
+	return NewMemStorageWithRetention(ctx, limit, 0)
+}
+
+// NewMemStorageWithRetention creates a new MemStorage instance keeping up to limit samples
+// per metric, like NewMemStorageWithHistory. Samples older than retention and metrics not
+// written within it are deleted as well; a retention of 0 keeps them.
+func NewMemStorageWithRetention(ctx context.Context, limit int, retention time.Duration) *MemStorage {
 	return &MemStorage{
-		metrics: make(map[string]*model.Metric),
+		metrics:      make(map[string]*model.Metric),
+		history:      make(map[string][]model.Sample),
+		written:      make(map[string]lastWrite),
+		historyLimit: limit,
+		retention:    retention,
+		now:          time.Now,
 	}
 }
 
-// Save stores a single metric in memory.
+// Save stores a single metric in memory. Metrics with the same ID and different labels are stored separately.
 func (store *MemStorage) Save(ctx context.Context, m *model.Metric) error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	existing, ok := store.metrics[m.ID]
-	if !ok {
-		store.metrics[m.ID] = m
-	} else if m.Type == model.Gauge {
-		store.metrics[m.ID] = m
+	now := store.now()
+	key := m.Key()
+	ts := m.SampleTime(now)
+	existing, ok := store.metrics[key]
+	if !ok || m.Type == model.Gauge {
+		stored := *m
+		stored.Timestamp = nil
+		store.metrics[key] = &stored
 	} else if m.Type == model.Counter && m.Delta != nil {
 		if existing.Delta != nil {
 			newVal := *existing.Delta + *m.Delta
@@ -46,9 +89,66 @@ func (store *MemStorage) Save(ctx context.Context, m *model.Metric) error {
 			existing.Delta = &v
 		}
 	}
+
+	store.writes++
+	store.written[key] = lastWrite{seq: store.writes, at: now}
+	store.appendSample(key, store.metrics[key], ts)
+	store.expire(now)
 	return nil
 }
 
+// expire deletes samples older than the retention and metrics not written within it,
+// at most once per retentionSweepEvery. Callers must hold the write lock.
+func (store *MemStorage) expire(now time.Time) {
+	if store.retention <= 0 || now.Sub(store.lastSweep) < retentionSweepEvery {
+		return
+	}
+	store.lastSweep = now
+
+	cutoff := now.Add(-store.retention)
+	for key, w := range store.written {
+		if w.at.Before(cutoff) {
+			delete(store.metrics, key)
+			delete(store.history, key)
+			delete(store.written, key)
+			continue
+		}
+		samples := store.history[key]
+		if i := sort.Search(len(samples), func(i int) bool { return !samples[i].Timestamp.Before(cutoff) }); i > 0 {
+			store.history[key] = append([]model.Sample(nil), samples[i:]...)
+		}
+	}
+}
+
+// appendSample records the current state of a metric at ts, keeping the samples ordered
+// by time. Callers must hold the write lock.
+func (store *MemStorage) appendSample(key string, m *model.Metric, ts time.Time) {
+	if store.historyLimit <= 0 {
+		return
+	}
+
+	sample := model.Sample{Timestamp: ts}
+	if m.Delta != nil {
+		v := *m.Delta
+		sample.Delta = &v
+	}
+	if m.Value != nil {
+		v := *m.Value
+		sample.Value = &v
+	}
+
+	samples := store.history[key]
+	i := len(samples)
+	for i > 0 && samples[i-1].Timestamp.After(ts) {
+		i--
+	}
+	samples = slices.Insert(samples, i, sample)
+	if len(samples) > store.historyLimit {
+		samples = samples[len(samples)-store.historyLimit:]
+	}
+	store.history[key] = samples
+}
+
 // SaveBatch stores multiple metrics in memory.
 func (store *MemStorage) SaveBatch(ctx context.Context, metrics []model.Metric) error {
 	for _, m := range metrics {
@@ -61,27 +161,94 @@ func (store *MemStorage) SaveBatch(ctx context.Context, metrics []model.Metric)
 	return nil
 }
 
-// Get retrieves a metric by ID and type.
+// Get retrieves a metric by ID and labels.
 func (store *MemStorage) Get(ctx context.Context, m *model.Metric) (*model.Metric, error) {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
-	val, ok := store.metrics[m.ID]
+	val, ok := store.metrics[m.Key()]
 
 	if !ok {
 		return m, errs.ErrMetricNotFound
 	}
-	return val, nil
+	return clone(val), nil
 }
 
-// GetAll returns all stored metrics.
+// GetLatest returns the most recently written metric with the ID of m, the type of m
+// unless it is empty, and all labels of m.
+func (store *MemStorage) GetLatest(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var (
+		latest  *model.Metric
+		written uint64
+	)
+	for key, s := range store.metrics {
+		if s.ID != m.ID || (m.Type != "" && s.Type != m.Type) || !hasLabels(s.Labels, m.Labels) {
+			continue
+		}
+		if w := store.written[key]; w.seq >= written {
+			latest, written = s, w.seq
+		}
+	}
+	if latest == nil {
+		return nil, errs.ErrMetricNotFound
+	}
+	return clone(latest), nil
+}
+
+// hasLabels reports whether labels contain all of the wanted name-value pairs.
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// GetAll returns all stored metrics keyed by model.Metric.Key.
 func (store *MemStorage) GetAll(ctx context.Context) (map[string]*model.Metric, error) {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
 	result := make(map[string]*model.Metric, len(store.metrics))
 	for k, v := range store.metrics {
-		result[k] = v
+		result[k] = clone(v)
+	}
+	return result, nil
+}
+
+// clone copies the metric values, so that callers don't observe later counter updates.
+func clone(m *model.Metric) *model.Metric {
+	c := *m
+	if m.Delta != nil {
+		c.Delta = utils.I64Ptr(*m.Delta)
+	}
+	if m.Value != nil {
+		c.Value = utils.F64Ptr(*m.Value)
+	}
+	return &c
+}
+
+// GetRange returns samples of a metric recorded within [from, to], oldest first.
+func (store *MemStorage) GetRange(ctx context.Context, m *model.Metric, from, to time.Time) ([]model.Sample, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	key := m.Key()
+	if _, ok := store.metrics[key]; !ok {
+		return nil, errs.ErrMetricNotFound
+	}
+
+	samples := store.history[key]
+	start := sort.Search(len(samples), func(i int) bool { return !samples[i].Timestamp.Before(from) })
+	end := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp.After(to) })
+
+	result := make([]model.Sample, 0, max(end-start, 0))
+	if start < end {
+		result = append(result, samples[start:end]...)
 	}
 	return result, nil
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/and161185/metrics-alerting/internal/errs"
 	"github.com/and161185/metrics-alerting/internal/utils"
@@ -168,3 +169,211 @@ func TestPing_OK(t *testing.T) {
 		t.Fatalf("unexpected: %v", err)
 	}
 }
+
+func TestGetRange_RecordsEveryWrite(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	from := time.Now()
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(5)}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(3)}))
+
+	gs, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, from, time.Now())
+	requireNoErr(t, err)
+	if len(gs) != 2 || *gs[0].Value != 1 || *gs[1].Value != 2 {
+		t.Fatalf("unexpected gauge samples: %+v", gs)
+	}
+	if gs[1].Timestamp.Before(gs[0].Timestamp) {
+		t.Fatalf("samples are not ordered: %+v", gs)
+	}
+
+	cs, err := st.GetRange(ctx, &model.Metric{ID: "c", Type: model.Counter}, from, time.Now())
+	requireNoErr(t, err)
+	if len(cs) != 2 || *cs[0].Delta != 5 || *cs[1].Delta != 8 {
+		t.Fatalf("counter samples should hold totals: %+v", cs)
+	}
+}
+
+func TestGetRange_FiltersByTime(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+
+	past := time.Now().Add(-time.Hour)
+	got, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, past.Add(-time.Hour), past)
+	requireNoErr(t, err)
+	if len(got) != 0 {
+		t.Fatalf("want no samples, got %+v", got)
+	}
+}
+
+func TestGetRange_SampleTimestamp(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(1), Timestamp: &past}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(3), Timestamp: &future}))
+
+	got, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, time.Time{}, time.Now())
+	requireNoErr(t, err)
+	if len(got) != 3 || *got[0].Value != 1 || *got[1].Value != 2 || *got[2].Value != 3 {
+		t.Fatalf("samples should be ordered by timestamp, future ones recorded now: %+v", got)
+	}
+	if !got[0].Timestamp.Equal(past) {
+		t.Fatalf("want sample at %v, got %v", past, got[0].Timestamp)
+	}
+
+	m, err := st.Get(ctx, &model.Metric{ID: "g", Type: model.Gauge})
+	requireNoErr(t, err)
+	if m.Timestamp != nil {
+		t.Fatalf("stored value should not keep the timestamp: %v", m.Timestamp)
+	}
+}
+
+func TestGetRange_NotFound(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	_, err := st.GetRange(ctx, &model.Metric{ID: "nope", Type: model.Gauge}, time.Time{}, time.Now())
+	if err != errs.ErrMetricNotFound {
+		t.Fatalf("want ErrMetricNotFound, got %v", err)
+	}
+}
+
+func TestHistoryLimit_DropsOldest(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorageWithHistory(ctx, 3)
+	for i := 1; i <= 5; i++ {
+		requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(float64(i))}))
+	}
+
+	got, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, time.Time{}, time.Now())
+	requireNoErr(t, err)
+	if len(got) != 3 || *got[0].Value != 3 || *got[2].Value != 5 {
+		t.Fatalf("want last 3 samples, got %+v", got)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorageWithHistory(ctx, 0)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+
+	got, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, time.Time{}, time.Now())
+	requireNoErr(t, err)
+	if len(got) != 0 {
+		t.Fatalf("history should be disabled, got %+v", got)
+	}
+}
+
+func TestSave_LabelsSeparateSeries(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	a := map[string]string{"host": "a"}
+	b := map[string]string{"host": "b"}
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1), Labels: a}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(2), Labels: b}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Polls", Type: model.Counter, Delta: utils.I64Ptr(3), Labels: a}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Polls", Type: model.Counter, Delta: utils.I64Ptr(4), Labels: a}))
+
+	all, _ := st.GetAll(ctx)
+	if len(all) != 3 {
+		t.Fatalf("want 3 series, got %d: %v", len(all), all)
+	}
+	if got := *all[`Alloc{host="b"}`].Value; got != 2 {
+		t.Fatalf("want 2, got %v", got)
+	}
+
+	got, err := st.Get(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Labels: a})
+	requireNoErr(t, err)
+	if *got.Value != 1 {
+		t.Fatalf("want 1, got %v", *got.Value)
+	}
+	got, err = st.Get(ctx, &model.Metric{ID: "Polls", Type: model.Counter, Labels: a})
+	requireNoErr(t, err)
+	if *got.Delta != 7 {
+		t.Fatalf("want 7, got %v", *got.Delta)
+	}
+
+	if _, err := st.Get(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge}); err != errs.ErrMetricNotFound {
+		t.Fatalf("unlabeled series should not exist, got %v", err)
+	}
+}
+
+func TestGetAll_ReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(1)}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(1)}))
+
+	all, _ := st.GetAll(ctx)
+	snapshot := all["c"]
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "c", Type: model.Counter, Delta: utils.I64Ptr(5)}))
+
+	if *snapshot.Delta != 2 {
+		t.Fatalf("snapshot changed after Save: %d", *snapshot.Delta)
+	}
+	got, err := st.Get(ctx, &model.Metric{ID: "c", Type: model.Counter})
+	requireNoErr(t, err)
+	if *got.Delta != 7 {
+		t.Fatalf("want 7, got %d", *got.Delta)
+	}
+}
+
+func TestGetLatest(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemStorage(ctx)
+	a := map[string]string{"host": "a", "source": "x"}
+	b := map[string]string{"host": "b", "source": "x"}
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(1), Labels: a}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(2), Labels: b}))
+
+	got, err := st.GetLatest(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Labels: map[string]string{"source": "x"}})
+	requireNoErr(t, err)
+	if *got.Value != 2 {
+		t.Fatalf("want latest write 2, got %v", *got.Value)
+	}
+
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "Alloc", Type: model.Gauge, Value: utils.F64Ptr(3), Labels: a}))
+	got, err = st.GetLatest(ctx, &model.Metric{ID: "Alloc"})
+	requireNoErr(t, err)
+	if *got.Value != 3 {
+		t.Fatalf("want latest write 3, got %v", *got.Value)
+	}
+
+	for _, m := range []*model.Metric{
+		{ID: "Alloc", Type: model.Counter},
+		{ID: "Alloc", Labels: map[string]string{"source": "y"}},
+		{ID: "Other"},
+	} {
+		if _, err := st.GetLatest(ctx, m); err != errs.ErrMetricNotFound {
+			t.Fatalf("%s: want ErrMetricNotFound, got %v", m.Key(), err)
+		}
+	}
+}
+
+func TestRetention_DeletesOldSamplesAndMetrics(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	st := NewMemStorageWithRetention(ctx, 100, time.Hour)
+	st.now = func() time.Time { return now }
+
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "stale", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(1)}))
+	now = now.Add(45 * time.Minute)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(2)}))
+	now = now.Add(30 * time.Minute)
+	requireNoErr(t, st.Save(ctx, &model.Metric{ID: "g", Type: model.Gauge, Value: utils.F64Ptr(3)}))
+
+	if _, err := st.Get(ctx, &model.Metric{ID: "stale", Type: model.Gauge}); err != errs.ErrMetricNotFound {
+		t.Fatalf("metric not written within the retention should be deleted, got %v", err)
+	}
+	got, err := st.GetRange(ctx, &model.Metric{ID: "g", Type: model.Gauge}, time.Time{}, now)
+	requireNoErr(t, err)
+	if len(got) != 2 || *got[0].Value != 2 {
+		t.Fatalf("samples older than the retention should be deleted: %+v", got)
+	}
+}
@@ -7,6 +7,7 @@ package postgres
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	model "github.com/and161185/metrics-alerting/model"
 	gomock "github.com/golang/mock/gomock"
@@ -65,6 +66,36 @@ func (mr *MockStorageMockRecorder) GetAll(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockStorage)(nil).GetAll), ctx)
 }
 
+// GetLatest mocks base method.
+func (m *MockStorage) GetLatest(ctx context.Context, metric *model.Metric) (*model.Metric, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLatest", ctx, metric)
+	ret0, _ := ret[0].(*model.Metric)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLatest indicates an expected call of GetLatest.
+func (mr *MockStorageMockRecorder) GetLatest(ctx, metric interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLatest", reflect.TypeOf((*MockStorage)(nil).GetLatest), ctx, metric)
+}
+
+// GetRange mocks base method.
+func (m *MockStorage) GetRange(ctx context.Context, metric *model.Metric, from, to time.Time) ([]model.Sample, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRange", ctx, metric, from, to)
+	ret0, _ := ret[0].([]model.Sample)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRange indicates an expected call of GetRange.
+func (mr *MockStorageMockRecorder) GetRange(ctx, metric, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRange", reflect.TypeOf((*MockStorage)(nil).GetRange), ctx, metric, from, to)
+}
+
 // Ping mocks base method.
 func (m *MockStorage) Ping(ctx context.Context) error {
 	m.ctrl.T.Helper()
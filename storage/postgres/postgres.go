@@ -3,48 +3,142 @@ package postgres
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/and161185/metrics-alerting/internal/errs"
 	"github.com/and161185/metrics-alerting/model"
+	"github.com/and161185/metrics-alerting/storage/inmemory"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// DefaultHistoryLimit is the number of samples kept per metric by NewPostgresStorage,
+// the same as in the in-memory storage.
+const DefaultHistoryLimit = inmemory.DefaultHistoryLimit
+
+// pruneEvery is the number of samples recorded for a metric between deletions of its
+// samples beyond the history limit, so the history may exceed the limit by that many.
+const pruneEvery = 100
+
+// retentionSweepEvery is how often samples and metrics older than the retention are deleted.
+const retentionSweepEvery = time.Minute
+
 // PostgresStorage implements Storage interface using PostgreSQL.
 type PostgresStorage struct {
-	db *pgxpool.Pool
+	db           *pgxpool.Pool
+	historyLimit int
+	retention    time.Duration
+	now          func() time.Time
+
+	mu        sync.Mutex
+	samples   map[string]seriesSamples // by series key
+	lastSweep time.Time
 }
 
+type seriesSamples struct {
+	n    int       // samples committed since the last pruning
+	last time.Time // time of the last commit
+}
+
+// initSchemaQuery creates the tables and migrates databases created before labels
+// were introduced: a series is identified by (id, labels) instead of id alone.
+// updated_at is the time of the last write of a series.
 const initSchemaQuery = `
 	CREATE TABLE IF NOT EXISTS metrics (
-		id TEXT PRIMARY KEY,
+		id TEXT NOT NULL,
 		mtype TEXT NOT NULL,
 		delta BIGINT,
-		value DOUBLE PRECISION
-	);`
-
-const mergeMetricsQuery = `INSERT INTO metrics (id, mtype, delta, value)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (id) DO UPDATE
+		value DOUBLE PRECISION,
+		labels JSONB NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+	ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+	CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_labels_idx ON metrics (id, labels);
+	CREATE TABLE IF NOT EXISTS metric_samples (
+		id TEXT NOT NULL,
+		mtype TEXT NOT NULL,
+		ts TIMESTAMPTZ NOT NULL,
+		delta BIGINT,
+		value DOUBLE PRECISION,
+		labels JSONB NOT NULL DEFAULT '{}'
+	);
+	ALTER TABLE metric_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+	DROP INDEX IF EXISTS metric_samples_id_ts_idx;
+	CREATE INDEX IF NOT EXISTS metric_samples_id_labels_ts_idx ON metric_samples (id, labels, ts);`
+
+const mergeMetricsQuery = `INSERT INTO metrics (id, mtype, delta, value, labels, updated_at)
+		VALUES ($1, $2, $3, $4, $5, clock_timestamp())
+		ON CONFLICT (id, labels) DO UPDATE
 		SET mtype = EXCLUDED.mtype,
 			delta = EXCLUDED.delta,
-			value = EXCLUDED.value;`
+			value = EXCLUDED.value,
+			updated_at = EXCLUDED.updated_at;`
+
+const insertSampleQuery = `INSERT INTO metric_samples (id, mtype, ts, delta, value, labels)
+		VALUES ($1, $2, $3, $4, $5, $6);`
+
+// pruneSamplesQuery deletes the samples of a series except the newest $3.
+const pruneSamplesQuery = `DELETE FROM metric_samples WHERE ctid IN (
+		SELECT ctid FROM metric_samples WHERE id = $1 AND labels = $2
+		ORDER BY ts DESC OFFSET $3)`
+
+// expireSamplesQuery and expireMetricsQuery delete samples recorded and metrics last
+// written before $1.
+const (
+	expireSamplesQuery = `DELETE FROM metric_samples WHERE ts < $1`
+	expireMetricsQuery = `DELETE FROM metrics WHERE updated_at < $1`
+)
+
+const getRangeQuery = `SELECT ts, delta, value FROM metric_samples
+		WHERE id = $1 AND labels = $2 AND ts BETWEEN $3 AND $4
+		ORDER BY ts`
+
+const getMetricQuery = `SELECT id, mtype, delta, value, labels FROM metrics WHERE id = $1 AND labels = $2`
 
-const getMetricQuery = `SELECT id, mtype, delta, value FROM metrics WHERE id = $1`
+// getLatestMetricQuery returns the most recently written series with the id, the type
+// unless $2 is empty, and labels containing $3.
+const getLatestMetricQuery = `SELECT id, mtype, delta, value, labels FROM metrics
+		WHERE id = $1 AND ($2 = '' OR mtype = $2) AND labels @> $3
+		ORDER BY updated_at DESC LIMIT 1`
 
-const getAllMetricsQuery = `SELECT id, mtype, delta, value FROM metrics`
+const getAllMetricsQuery = `SELECT id, mtype, delta, value, labels FROM metrics`
 
-// NewPostgresStorage creates a new PostgresStorage with the given database connection.
+// NewPostgresStorage creates a new PostgresStorage with the given database connection
+// keeping up to DefaultHistoryLimit samples per metric.
 func NewPostgresStorage(ctx context.Context, DatabaseDsn string) (*PostgresStorage, error) {
+	return NewPostgresStorageWithHistory(ctx, DatabaseDsn, DefaultHistoryLimit)
+}
+
+// NewPostgresStorageWithHistory creates a new PostgresStorage keeping up to limit samples
+// per metric. The oldest samples are deleted first; a limit of 0 disables history.
+func NewPostgresStorageWithHistory(ctx context.Context, DatabaseDsn string, limit int) (*PostgresStorage, error) {
+	return NewPostgresStorageWithRetention(ctx, DatabaseDsn, limit, 0)
+}
+
+// NewPostgresStorageWithRetention creates a new PostgresStorage keeping up to limit samples
+// per metric, like NewPostgresStorageWithHistory. Samples older than retention and metrics
+// not written within it are deleted as well; a retention of 0 keeps them.
+func NewPostgresStorageWithRetention(ctx context.Context, DatabaseDsn string, limit int, retention time.Duration) (*PostgresStorage, error) {
 	db, err := pgxpool.New(ctx, DatabaseDsn)
 	if err != nil {
 		return nil, err
 	}
 
-	storage := &PostgresStorage{db: db}
+	storage := &PostgresStorage{
+		db:           db,
+		historyLimit: limit,
+		retention:    retention,
+		now:          time.Now,
+		samples:      make(map[string]seriesSamples),
+	}
 
 	if err := storage.Ping(ctx); err != nil {
 		return nil, err
@@ -80,26 +174,151 @@ func (store *PostgresStorage) calculateDelta(ctx context.Context, m *model.Metri
 	return m.Delta, nil
 }
 
-// Save inserts or updates a single metric in the database.
-func (store *PostgresStorage) Save(ctx context.Context, m *model.Metric) error {
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
 
-	delta, err := store.calculateDelta(ctx, m, store.Get)
+// labelsParam encodes labels as a JSONB parameter; missing labels are stored as an empty object.
+func labelsParam(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(labels)
 	if err != nil {
+		return "", fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	return string(b), nil
+}
+
+// saveMetric upserts the metric value and, unless history is disabled, records it as a sample.
+func (store *PostgresStorage) saveMetric(ctx context.Context, q execer, m *model.Metric, delta *int64, ts time.Time) error {
+	labels, err := labelsParam(m.Labels)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(ctx, mergeMetricsQuery, m.ID, string(m.Type), delta, m.Value, labels); err != nil {
 		return err
 	}
+	if store.historyLimit <= 0 {
+		return nil
+	}
+	if _, err := q.Exec(ctx, insertSampleQuery, m.ID, string(m.Type), ts, delta, m.Value, labels); err != nil {
+		return fmt.Errorf("failed to save sample: %w", err)
+	}
+	return nil
+}
+
+// trimHistory runs after the metrics are committed. It deletes the samples of the
+// metrics beyond the history limit when due and, every retentionSweepEvery, samples
+// and metrics older than the retention. Failures are logged, as the metrics are saved.
+func (store *PostgresStorage) trimHistory(ctx context.Context, q execer, metrics []model.Metric) {
+	if store.historyLimit > 0 {
+		for _, m := range metrics {
+			if !store.pruneDue(m.Key()) {
+				continue
+			}
+			labels, err := labelsParam(m.Labels)
+			if err != nil {
+				continue
+			}
+			if _, err := q.Exec(ctx, pruneSamplesQuery, m.ID, labels, store.historyLimit); err != nil {
+				log.Printf("failed to prune samples of %s: %v", m.Key(), err)
+			}
+		}
+	}
+
+	cutoff, ok := store.sweepDue()
+	if !ok {
+		return
+	}
+	if _, err := q.Exec(ctx, expireSamplesQuery, cutoff); err != nil {
+		log.Printf("failed to delete expired samples: %v", err)
+	}
+	if _, err := q.Exec(ctx, expireMetricsQuery, cutoff); err != nil {
+		log.Printf("failed to delete expired metrics: %v", err)
+	}
+}
+
+// pruneDue counts a committed sample of the series and reports whether its samples
+// beyond the history limit should be deleted.
+func (store *PostgresStorage) pruneDue(key string) bool {
+	now := store.now()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	s := store.samples[key]
+	s.n++
+	s.last = now
+	if s.n < pruneEvery {
+		store.samples[key] = s
+		return false
+	}
+	delete(store.samples, key)
+	return true
+}
+
+// sweepDue reports whether samples and metrics older than the retention should be
+// deleted and returns the cutoff time. Sample counts of series not written since the
+// cutoff are dropped with them.
+func (store *PostgresStorage) sweepDue() (time.Time, bool) {
+	if store.retention <= 0 {
+		return time.Time{}, false
+	}
+	now := store.now()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if now.Sub(store.lastSweep) < retentionSweepEvery {
+		return time.Time{}, false
+	}
+	store.lastSweep = now
+	cutoff := now.Add(-store.retention)
+	for key, s := range store.samples {
+		if s.last.Before(cutoff) {
+			delete(store.samples, key)
+		}
+	}
+	return cutoff, true
+}
+
+// Save inserts or updates a single metric and records its sample in a transaction.
+func (store *PostgresStorage) Save(ctx context.Context, m *model.Metric) (err error) {
+	tx, err := store.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
 
-	_, err = store.db.Exec(ctx, mergeMetricsQuery, m.ID, string(m.Type), delta, m.Value)
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				log.Printf("failed to rollback transaction: %v", rollbackErr)
+			}
+		}
+	}()
+
+	delta, err := store.calculateDelta(ctx, m, func(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+		return GetWithTx(ctx, tx, m)
+	})
 	if err != nil {
 		return err
 	}
 
+	if err = store.saveMetric(ctx, tx, m, delta, m.SampleTime(time.Now())); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
 	m.Delta = delta
+	store.trimHistory(ctx, store.db, []model.Metric{*m})
 
 	return nil
 }
 
-// SaveBatch inserts or updates multiple metrics in a transaction.
-func (store *PostgresStorage) SaveBatch(ctx context.Context, metrics []model.Metric) error {
+// SaveBatch inserts or updates multiple metrics and records their samples in a transaction.
+func (store *PostgresStorage) SaveBatch(ctx context.Context, metrics []model.Metric) (err error) {
 	tx, err := store.db.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -113,6 +332,7 @@ func (store *PostgresStorage) SaveBatch(ctx context.Context, metrics []model.Met
 		}
 	}()
 
+	ts := time.Now()
 	for _, m := range metrics {
 		delta, err := store.calculateDelta(ctx, &m, func(ctx context.Context, m *model.Metric) (*model.Metric, error) {
 			return GetWithTx(ctx, tx, m)
@@ -121,8 +341,7 @@ func (store *PostgresStorage) SaveBatch(ctx context.Context, metrics []model.Met
 			return err
 		}
 
-		_, err = tx.Exec(ctx, mergeMetricsQuery, m.ID, string(m.Type), delta, m.Value)
-		if err != nil {
+		if err := store.saveMetric(ctx, tx, &m, delta, m.SampleTime(ts)); err != nil {
 			return fmt.Errorf("failed to save metric %s: %w", m.ID, err)
 		}
 	}
@@ -131,10 +350,11 @@ func (store *PostgresStorage) SaveBatch(ctx context.Context, metrics []model.Met
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	store.trimHistory(ctx, store.db, metrics)
 	return nil
 }
 
-// Get retrieves a single metric by ID and type from the database.
+// Get retrieves a single metric by ID and labels from the database.
 func (store *PostgresStorage) Get(ctx context.Context, m *model.Metric) (*model.Metric, error) {
 	return getMetric(ctx, store.db, m)
 }
@@ -144,14 +364,37 @@ func GetWithTx(ctx context.Context, tx pgx.Tx, m *model.Metric) (*model.Metric,
 	return getMetric(ctx, tx, m)
 }
 
-func getMetric(ctx context.Context, q interface {
+// GetLatest returns the most recently written metric with the ID of m, the type of m
+// unless it is empty, and all labels of m.
+func (store *PostgresStorage) GetLatest(ctx context.Context, m *model.Metric) (*model.Metric, error) {
+	return getLatestMetric(ctx, store.db, m)
+}
+
+type rowQuerier interface {
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
-}, m *model.Metric) (*model.Metric, error) {
-	row := q.QueryRow(ctx, getMetricQuery, m.ID)
+}
+
+func getMetric(ctx context.Context, q rowQuerier, m *model.Metric) (*model.Metric, error) {
+	labels, err := labelsParam(m.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return scanMetric(q.QueryRow(ctx, getMetricQuery, m.ID, labels))
+}
+
+func getLatestMetric(ctx context.Context, q rowQuerier, m *model.Metric) (*model.Metric, error) {
+	labels, err := labelsParam(m.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return scanMetric(q.QueryRow(ctx, getLatestMetricQuery, m.ID, string(m.Type), labels))
+}
 
+// scanMetric scans a metric row, returning ErrMetricNotFound if there is none.
+func scanMetric(row pgx.Row) (*model.Metric, error) {
 	var val model.Metric
 	var mtype string
-	err := row.Scan(&val.ID, &mtype, &val.Delta, &val.Value)
+	err := row.Scan(&val.ID, &mtype, &val.Delta, &val.Value, &val.Labels)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, errs.ErrMetricNotFound
@@ -159,11 +402,14 @@ func getMetric(ctx context.Context, q interface {
 		return nil, err
 	}
 	val.Type = model.MetricType(mtype)
+	if len(val.Labels) == 0 {
+		val.Labels = nil
+	}
 
 	return &val, nil
 }
 
-// GetAll returns all metrics stored in the database.
+// GetAll returns all metrics stored in the database keyed by model.Metric.Key.
 func (store *PostgresStorage) GetAll(ctx context.Context) (map[string]*model.Metric, error) {
 	rows, err := store.db.Query(ctx, getAllMetricsQuery)
 	if err != nil {
@@ -177,20 +423,61 @@ func (store *PostgresStorage) GetAll(ctx context.Context) (map[string]*model.Met
 		var m model.Metric
 		var mtype string
 
-		err := rows.Scan(&m.ID, &mtype, &m.Delta, &m.Value)
+		err := rows.Scan(&m.ID, &mtype, &m.Delta, &m.Value, &m.Labels)
 		if err != nil {
 			return nil, err
 		}
 
 		m.Type = model.MetricType(mtype)
+		if len(m.Labels) == 0 {
+			m.Labels = nil
+		}
 
 		copy := m
-		result[m.ID] = &copy
+		result[m.Key()] = &copy
 	}
 
 	return result, nil
 }
 
+// GetRange returns samples of a metric recorded within [from, to], oldest first.
+func (store *PostgresStorage) GetRange(ctx context.Context, m *model.Metric, from, to time.Time) ([]model.Sample, error) {
+	labels, err := labelsParam(m.Labels)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.db.Query(ctx, getRangeQuery, m.ID, labels, from, to)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := scanSamples(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(samples) == 0 {
+		if _, err := store.Get(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+
+	return samples, nil
+}
+
+func scanSamples(rows pgx.Rows) ([]model.Sample, error) {
+	defer rows.Close()
+
+	samples := []model.Sample{}
+	for rows.Next() {
+		var s model.Sample
+		if err := rows.Scan(&s.Timestamp, &s.Delta, &s.Value); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
 // Ping checks if the database is reachable.
 func (store *PostgresStorage) Ping(ctx context.Context) error {
 	return store.db.Ping(ctx)
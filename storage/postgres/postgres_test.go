@@ -5,11 +5,13 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/and161185/metrics-alerting/internal/errs"
 	"github.com/and161185/metrics-alerting/model"
 	"github.com/golang/mock/gomock"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/require"
 )
 
@@ -183,3 +185,183 @@ func Test_calculateDelta_PropagatesUnexpectedError(t *testing.T) {
 	})
 	require.Error(t, err)
 }
+
+func TestMockStorage_GetRange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorage := NewMockStorage(ctrl)
+
+	metric := &model.Metric{ID: "test", Type: model.Gauge}
+	from, to := time.Unix(0, 0), time.Unix(60, 0)
+	v := 1.5
+	want := []model.Sample{{Timestamp: time.Unix(30, 0), Value: &v}}
+	mockStorage.EXPECT().GetRange(gomock.Any(), metric, from, to).Return(want, nil)
+
+	got, err := mockStorage.GetRange(context.Background(), metric, from, to)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+type fakeRows struct {
+	pgx.Rows
+	samples []model.Sample
+	pos     int
+	err     error
+}
+
+func (r *fakeRows) Next() bool {
+	r.pos++
+	return r.pos <= len(r.samples)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	s := r.samples[r.pos-1]
+	*(dest[0].(*time.Time)) = s.Timestamp
+	*(dest[1].(**int64)) = s.Delta
+	*(dest[2].(**float64)) = s.Value
+	return nil
+}
+
+func (r *fakeRows) Err() error { return r.err }
+func (r *fakeRows) Close()     {}
+
+func Test_scanSamples(t *testing.T) {
+	d := int64(4)
+	rows := &fakeRows{samples: []model.Sample{
+		{Timestamp: time.Unix(1, 0), Delta: &d},
+		{Timestamp: time.Unix(2, 0), Delta: &d},
+	}}
+	got, err := scanSamples(rows)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, time.Unix(2, 0), got[1].Timestamp)
+	require.EqualValues(t, 4, *got[1].Delta)
+}
+
+func Test_scanSamples_RowsError(t *testing.T) {
+	_, err := scanSamples(&fakeRows{err: errors.New("conn lost")})
+	require.Error(t, err)
+}
+
+func Test_labelsParam(t *testing.T) {
+	got, err := labelsParam(nil)
+	require.NoError(t, err)
+	require.Equal(t, "{}", got)
+
+	got, err = labelsParam(map[string]string{"host": "a"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"host":"a"}`, got)
+}
+
+func Test_getMetric_WithLabels(t *testing.T) {
+	var gotArgs []any
+	q := argsQuerier{
+		row: fakeRow{scan: func(dest ...any) error {
+			*(dest[0].(*string)) = "Alloc"
+			*(dest[1].(*string)) = "gauge"
+			v := 1.0
+			*(dest[3].(**float64)) = &v
+			*(dest[4].(*map[string]string)) = map[string]string{"host": "a"}
+			return nil
+		}},
+		args: &gotArgs,
+	}
+	m, err := getMetric(context.Background(), q, &model.Metric{ID: "Alloc", Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"host": "a"}, m.Labels)
+	require.Equal(t, []any{"Alloc", `{"host":"a"}`}, gotArgs)
+}
+
+func Test_getLatestMetric(t *testing.T) {
+	var gotArgs []any
+	q := argsQuerier{
+		row: fakeRow{scan: func(dest ...any) error {
+			*(dest[0].(*string)) = "Alloc"
+			*(dest[1].(*string)) = "gauge"
+			*(dest[4].(*map[string]string)) = map[string]string{"host": "a", "source": "web-1"}
+			return nil
+		}},
+		args: &gotArgs,
+	}
+	m, err := getLatestMetric(context.Background(), q, &model.Metric{ID: "Alloc", Type: model.Gauge, Labels: map[string]string{"source": "web-1"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"host": "a", "source": "web-1"}, m.Labels)
+	require.Equal(t, []any{"Alloc", "gauge", `{"source":"web-1"}`}, gotArgs)
+
+	q.row = fakeRow{scan: func(dest ...any) error { return pgx.ErrNoRows }}
+	_, err = getLatestMetric(context.Background(), q, &model.Metric{ID: "Alloc"})
+	require.ErrorIs(t, err, errs.ErrMetricNotFound)
+	require.Equal(t, []any{"Alloc", "", "{}"}, gotArgs)
+}
+
+type argsQuerier struct {
+	row  pgx.Row
+	args *[]any
+}
+
+func (q argsQuerier) QueryRow(_ context.Context, _ string, args ...any) pgx.Row {
+	*q.args = args
+	return q.row
+}
+
+// recordingExecer records executed queries and their arguments.
+type recordingExecer struct {
+	queries []string
+	args    [][]any
+}
+
+func (e *recordingExecer) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	e.queries = append(e.queries, sql)
+	e.args = append(e.args, args)
+	return pgconn.CommandTag{}, nil
+}
+
+func Test_trimHistory_PrunesHistory(t *testing.T) {
+	ctx := context.Background()
+	store := &PostgresStorage{historyLimit: 50, now: time.Now, samples: make(map[string]seriesSamples)}
+	m := model.Metric{ID: "Alloc", Type: model.Gauge, Value: new(float64), Labels: map[string]string{"host": "a"}}
+
+	q := &recordingExecer{}
+	for i := 0; i < pruneEvery; i++ {
+		require.NoError(t, store.saveMetric(ctx, q, &m, nil, time.Now()))
+	}
+	require.Len(t, q.queries, 2*pruneEvery, "samples are not pruned within the transaction")
+
+	q = &recordingExecer{}
+	for i := 0; i < pruneEvery; i++ {
+		store.trimHistory(ctx, q, []model.Metric{m})
+	}
+	require.Equal(t, []string{pruneSamplesQuery}, q.queries, "samples beyond the limit are deleted every pruneEvery committed samples")
+	require.Equal(t, []any{"Alloc", `{"host":"a"}`, 50}, q.args[0])
+
+	store = &PostgresStorage{now: time.Now, samples: make(map[string]seriesSamples)}
+	q = &recordingExecer{}
+	require.NoError(t, store.saveMetric(ctx, q, &m, nil, time.Now()))
+	store.trimHistory(ctx, q, []model.Metric{m})
+	require.Equal(t, []string{mergeMetricsQuery}, q.queries, "no samples without history")
+}
+
+func Test_trimHistory_Retention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	store := &PostgresStorage{historyLimit: 50, retention: time.Hour, samples: make(map[string]seriesSamples)}
+	store.now = func() time.Time { return now }
+	stale := model.Metric{ID: "Stale", Type: model.Gauge}
+	m := model.Metric{ID: "Alloc", Type: model.Gauge}
+
+	q := &recordingExecer{}
+	store.trimHistory(ctx, q, []model.Metric{stale})
+	require.Equal(t, []string{expireSamplesQuery, expireMetricsQuery}, q.queries)
+	require.Equal(t, []any{now.Add(-time.Hour)}, q.args[0])
+
+	now = now.Add(retentionSweepEvery / 2)
+	q = &recordingExecer{}
+	store.trimHistory(ctx, q, []model.Metric{m})
+	require.Empty(t, q.queries, "expired rows are deleted every retentionSweepEvery")
+
+	now = now.Add(time.Hour)
+	store.trimHistory(ctx, q, []model.Metric{m})
+	require.Equal(t, []string{expireSamplesQuery, expireMetricsQuery}, q.queries)
+	require.NotContains(t, store.samples, stale.Key(), "sample count of an expired series is dropped")
+	require.Contains(t, store.samples, m.Key())
+}